@@ -22,6 +22,11 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"strings"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/db"
+	"bocker.software-services.dev/pkg/docker"
 	"bocker.software-services.dev/pkg/tui"
 	"github.com/spf13/cobra"
 )
@@ -29,44 +34,97 @@ import (
 // backupOpts holds the backup-subcommand's own flag state so it can't collide
 // with restore's bindings to the same config fields.
 var backupOpts struct {
-	DBUser, DBHost, DBSource, ContainerID string
-	ExportRoles, DaemonMode               bool
+	Engine, DBUser, DBHost, DBSource, ContainerID, MountFrom string
+	Mode, Format, Compression                                string
+	Jobs, CompressionLevel                                   int
+	ChunkSize                                                int64
+	Recipients, Schemas, ExcludeSchemas, Tables              []string
+	ExcludeTables, ExcludeTableData                          []string
+	ExportRoles, DaemonMode, Passphrase, Stream, Dedup       bool
 }
 
 var backupCmd = &cobra.Command{
 	Use:   "backup",
-	Short: "Backup a Postgresql Database",
-	Long: `This command creates a Postgresql database backup with pg_dump.
+	Short: "Backup a database",
+	Long: `This command creates a database backup with pg_dump (--engine postgres),
+mysqldump (--engine mysql), mariadb-dump (--engine mariadb),
+mongodump (--engine mongodb) or a sqlite3 VACUUM INTO snapshot
+(--engine sqlite, --db-source is the file path).
 The resulting file is wrapped in a Docker image.
 Finally, this Docker image is uploaded to a Docker registy.
 
+The image is assembled and pushed natively, so no Docker daemon is needed
+unless --container-id is used.
+
+bocker compresses the image layers itself (--compression, gzip by default),
+so dumps are taken uncompressed: pg_dump runs with -Z 0, and mongodump runs
+with --archive but without --gzip. Only with --compression none and without
+--dedup is mongodump --gzip used. restore handles both kinds of archive.
+
+With --mode physical, pg_basebackup copies the data directory of the whole
+PostgreSQL cluster instead; --db-source then only names the backup and is the database
+connected to for the server version.
+
 Requires:
-- Docker installed and configured
-- pg_dump installed
+- pg_dump (pg_basebackup for --mode physical), mysqldump, mariadb-dump,
+  mongodump or sqlite3 installed
 
 Example:
 bocker -H <host> -n <db name> -u <db user> -o <output file name>`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		app.Config.DB.Engine = backupOpts.Engine
+		app.Config.DB.Mode = backupOpts.Mode
+		app.Config.DB.Format = backupOpts.Format
+		app.Config.DB.Jobs = backupOpts.Jobs
+		app.Config.DB.Schemas = backupOpts.Schemas
+		app.Config.DB.ExcludeSchemas = backupOpts.ExcludeSchemas
+		app.Config.DB.Tables = backupOpts.Tables
+		app.Config.DB.ExcludeTables = backupOpts.ExcludeTables
+		app.Config.DB.ExcludeTableData = backupOpts.ExcludeTableData
 		app.Config.DB.User = backupOpts.DBUser
 		app.Config.DB.Host = backupOpts.DBHost
 		app.Config.DB.SourceName = backupOpts.DBSource
 		app.Config.Docker.ContainerID = backupOpts.ContainerID
+		app.Config.Docker.MountFrom = backupOpts.MountFrom
+		app.Config.Docker.ChunkSize = backupOpts.ChunkSize << 20
+		app.Config.Docker.Dedup = backupOpts.Dedup
+		app.Config.Docker.Compression = backupOpts.Compression
+		app.Config.Docker.CompressionLevel = backupOpts.CompressionLevel
 		app.Config.DB.ExportRoles = backupOpts.ExportRoles
 		app.Config.DaemonMode = backupOpts.DaemonMode
+		app.Config.Stream = backupOpts.Stream
+		app.Config.Encryption.Recipients = backupOpts.Recipients
+		app.Config.Encryption.Passphrase = backupOpts.Passphrase
 		return tui.InitBackupTui(cmd.Context(), app)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(backupCmd)
-	backupCmd.Flags().StringVarP(&backupOpts.DBUser, "db-user", "u", "", "Database user name (required)")
+	backupCmd.Flags().StringVar(&backupOpts.Engine, "engine", db.EnginePostgres, "Database engine: "+strings.Join(db.Engines(), ", "))
+	backupCmd.Flags().StringVar(&backupOpts.Mode, "mode", db.ModeLogical, "Backup mode: logical dumps one database, physical copies the whole cluster with pg_basebackup (postgres)")
+	backupCmd.Flags().StringVar(&backupOpts.Format, "format", "", "Dump format: custom or directory for postgres (default: the engine's)")
+	backupCmd.Flags().IntVarP(&backupOpts.Jobs, "jobs", "j", 0, "Number of parallel dump jobs (postgres directory format)")
+	backupCmd.Flags().StringArrayVar(&backupOpts.Schemas, "schema", nil, "Only dump schemas matching this pattern (repeatable, postgres)")
+	backupCmd.Flags().StringArrayVar(&backupOpts.ExcludeSchemas, "exclude-schema", nil, "Do not dump schemas matching this pattern (repeatable, postgres)")
+	backupCmd.Flags().StringArrayVar(&backupOpts.Tables, "table", nil, "Only dump tables matching this pattern, e.g. public.order_* (repeatable, postgres)")
+	backupCmd.Flags().StringArrayVar(&backupOpts.ExcludeTables, "exclude-table", nil, "Do not dump tables matching this pattern (repeatable, postgres)")
+	backupCmd.Flags().StringArrayVar(&backupOpts.ExcludeTableData, "exclude-table-data", nil, "Dump only the definition of tables matching this pattern (repeatable, postgres)")
+	backupCmd.Flags().StringVarP(&backupOpts.DBUser, "db-user", "u", "", "Database user name (required except for sqlite)")
 	backupCmd.Flags().StringVar(&backupOpts.DBHost, "db-host", "localhost", "Hostname of the database host")
-	backupCmd.Flags().StringVarP(&backupOpts.DBSource, "db-source", "s", "", "Source database name")
-	backupCmd.Flags().StringVarP(&backupOpts.ContainerID, "container-id", "c", "", "ID of container running PostgreSQL")
+	backupCmd.Flags().StringVarP(&backupOpts.DBSource, "db-source", "s", "", "Source database name, or file path for sqlite")
+	backupCmd.Flags().StringVarP(&backupOpts.ContainerID, "container-id", "c", "", "ID of container running the database")
+	backupCmd.Flags().Int64Var(&backupOpts.ChunkSize, "chunk-size", docker.DefaultChunkSize>>20, "Split the backup into layers of this many MiB")
+	backupCmd.Flags().StringVar(&backupOpts.Compression, "compression", config.CompressionGzip, "Layer compression: gzip, zstd or none")
+	backupCmd.Flags().IntVar(&backupOpts.CompressionLevel, "compression-level", 0, "Compression level (gzip 1-9, zstd 1-22; 0 for the default)")
+	backupCmd.Flags().BoolVar(&backupOpts.Dedup, "dedup", false, "Split the backup at content-defined boundaries so unchanged data is not uploaded again (ignores --chunk-size)")
+	backupCmd.Flags().StringVar(&backupOpts.MountFrom, "mount-from", "", "Repository in the same registry to cross-mount existing blobs from")
 	backupCmd.Flags().BoolVar(&backupOpts.ExportRoles, "export-roles", false, "Include roles in backup")
-	backupCmd.Flags().BoolVarP(&backupOpts.DaemonMode, "daemon", "d", false, "Run in daemon mode (no TTY required)")
+	backupCmd.Flags().StringArrayVar(&backupOpts.Recipients, "recipient", nil, "Encrypt the backup to this age public key (repeatable)")
+	backupCmd.Flags().BoolVar(&backupOpts.Passphrase, "passphrase", false, "Encrypt the backup with the stored encryption key as passphrase")
+	backupCmd.Flags().BoolVar(&backupOpts.Stream, "stream", false, "Upload the dump while it is produced, without temporary files (not for sqlite)")
+	backupCmd.Flags().BoolVarP(&backupOpts.DaemonMode, "daemon", "d", false, "Run without the TUI (no TTY required); see bocker daemon for scheduled backups")
 
-	_ = backupCmd.MarkFlagRequired("db-user")
 	_ = backupCmd.MarkFlagRequired("db-source")
-	_ = rootCmd.MarkPersistentFlagRequired("repository")
+	requireRepository(backupCmd)
 }
@@ -22,7 +22,10 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"cmp"
 	"fmt"
+	"strings"
+	"text/tabwriter"
 
 	"bocker.software-services.dev/pkg/config"
 	"github.com/spf13/cobra"
@@ -32,29 +35,61 @@ var showPassword bool
 
 var configListCmd = &cobra.Command{
 	Use:   "list",
-	Short: "List Registry Configuration",
+	Short: "List the effective configuration",
+	Long: `List the configuration bocker would use: the registry credentials and the
+settings from the selected profile, environment variables and the flags given
+here, each with where it came from. Secrets are masked.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		cfg, err := config.GetUsername()
+		cred, err := config.RegistryCredential(app.Config.Docker.Registry)
 		if err != nil {
-			return err
+			fmt.Fprintf(cmd.ErrOrStderr(), "warning: %v\n", err)
+			cred = &config.Credential{}
 		}
-		fmt.Printf("Username: %s\n", cfg.Username)
+		if cred.DockerError != nil {
+			fmt.Fprintf(cmd.ErrOrStderr(), "warning: %v; using %s credentials instead\n", cred.DockerError, cred.Source)
+		}
+		tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "profile\t%s\n", cmp.Or(app.Config.Profile, "(none)"))
+		fmt.Fprintf(tw, "username\t%s\t(%s)\n", cred.Username, cmp.Or(cred.Source, "not set"))
 
-		if !showPassword {
-			fmt.Println("Password: (hidden; pass --show-password to reveal)")
-			return nil
+		if showPassword {
+			fmt.Fprintf(tw, "password\t%s\n", cred.Secret)
+		} else {
+			fmt.Fprintf(tw, "password\t%s\t(pass --show-password to reveal)\n", mask(cred.Secret))
 		}
+		key, _ := config.GetEncryptionKey()
+		fmt.Fprintf(tw, "encryption-key\t%s\n", mask(key))
 
-		password, err := config.GetKey(config.AppName)
-		if err != nil {
-			return err
+		resolved := map[string]config.Resolved{}
+		for _, r := range effective {
+			resolved[r.Key] = r
+		}
+		for _, s := range (config.Profile{}).Settings() {
+			if r, ok := resolved[s.Key]; ok {
+				source := r.Source
+				if source == config.SourceEnv {
+					source += " " + config.EnvName(r.Key)
+				}
+				fmt.Fprintf(tw, "%s\t%s\t(%s)\n", r.Key, strings.Join(r.Values, ", "), source)
+			} else if f := cmd.Flags().Lookup(s.Key); f != nil && f.DefValue != "" {
+				fmt.Fprintf(tw, "%s\t%s\t(default)\n", s.Key, f.DefValue)
+			}
 		}
-		fmt.Printf("Password: %s\n", password)
-		return nil
+		return tw.Flush()
 	},
 }
 
+// mask hides a secret, only telling whether it is set.
+func mask(secret string) string {
+	if secret == "" {
+		return "(not set)"
+	}
+	return "********"
+}
+
 func init() {
 	configCmd.AddCommand(configListCmd)
-	configListCmd.Flags().BoolVar(&showPassword, "show-password", false, "Print the stored Docker Hub password to stdout")
+	configListCmd.Flags().BoolVar(&showPassword, "show-password", false, "Print the registry password to stdout")
+
+	useProfile(configListCmd)
 }
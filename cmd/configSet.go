@@ -28,10 +28,20 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var encryptionKey string
+
 var configSetCmd = &cobra.Command{
 	Use:   "set",
 	Short: "Set Registry Configuration",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if encryptionKey != "" {
+			if err := config.SetKey(config.EncryptionService, encryptionKey); err != nil {
+				return err
+			}
+			if username == "" && password == "" {
+				return nil
+			}
+		}
 		if username == "" || password == "" {
 			if err := config.ConfigTui(); err != nil {
 				return fmt.Errorf("could not start bocker: %w", err)
@@ -49,4 +59,5 @@ func init() {
 	configCmd.AddCommand(configSetCmd)
 	configSetCmd.Flags().StringVarP(&username, "username", "u", "", "Docker Hub Username")
 	configSetCmd.Flags().StringVarP(&password, "password", "p", "", "Docker Hub Password")
+	configSetCmd.Flags().StringVar(&encryptionKey, "encryption-key", "", "age identity (AGE-SECRET-KEY-...) or passphrase for encrypted backups")
 }
@@ -0,0 +1,75 @@
+/*
+Copyright © 2023 Benjamin Buetikofer <bbu@ik.me>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bocker.software-services.dev/pkg/daemon"
+	"github.com/spf13/cobra"
+)
+
+var daemonJobsFile string
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run scheduled backups",
+	Long: `Run the backup jobs listed in a jobs file on their cron schedules until
+stopped with SIGTERM or Ctrl+C. Each job's retention policy is applied after
+every successful backup.
+
+Only one backup runs at a time; a job that is still running or waiting when
+it is due again skips that run. A backup in progress when the daemon is
+stopped is cancelled and cleaned up before it exits.
+
+Example jobs file:
+
+jobs:
+  - name: billing
+    schedule: "0 2 * * *"
+    jitter: 15m
+    repository: billing_backup
+    db-source: billing
+    db-user: postgres
+    retention:
+      keep-daily: 7
+      keep-weekly: 4`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := daemonJobsFile
+		if path == "" {
+			var err error
+			if path, err = daemon.DefaultJobsFile(); err != nil {
+				return err
+			}
+		}
+		jobs, err := daemon.LoadJobs(path)
+		if err != nil {
+			return err
+		}
+		return daemon.Run(cmd.Context(), app, jobs, cmd.ErrOrStderr())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+	daemonCmd.Flags().StringVarP(&daemonJobsFile, "jobs-file", "f", "", "Jobs file (default: jobs.yaml in bocker's config directory)")
+
+	useProfile(daemonCmd)
+}
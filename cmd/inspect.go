@@ -0,0 +1,72 @@
+/*
+Copyright © 2023 Benjamin Buetikofer <bbu@ik.me>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bocker.software-services.dev/pkg/tui"
+	"github.com/spf13/cobra"
+)
+
+var inspectOpts struct {
+	Tag, DBSource, Identity, ContainerID string
+	tui.InspectOptions
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Show what is inside a backup",
+	Long: `Inspect fetches a PostgreSQL backup and lists its contents (schemas,
+tables, views, functions, extensions, ...) with pg_restore --list, without
+restoring anything.
+
+--sizes also measures how much data each table holds, which means reading
+the whole backup. --write-list saves the pg_restore list, so it can be
+trimmed and passed to "bocker restore --use-list".
+
+Requires:
+- pg_restore installed (or a container with it, see --container-id)
+
+Example:
+bocker inspect -r <repository> --tag 2024-03-12_02-00-00 --sizes`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		app.Config.Docker.Tag = inspectOpts.Tag
+		app.Config.DB.SourceName = inspectOpts.DBSource
+		app.Config.Docker.ContainerID = inspectOpts.ContainerID
+		app.Config.Encryption.IdentityFile = inspectOpts.Identity
+		return tui.InitInspectTui(cmd.Context(), app, inspectOpts.InspectOptions, cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().StringVar(&inspectOpts.Tag, "tag", "", "Tag of the image with the backup in it")
+	inspectCmd.Flags().StringVarP(&inspectOpts.DBSource, "db-source", "s", "", "Source database name (only needed for backups without metadata)")
+	inspectCmd.Flags().StringVarP(&inspectOpts.Identity, "identity", "i", "", "age identity file to decrypt the backup with")
+	inspectCmd.Flags().StringVarP(&inspectOpts.ContainerID, "container-id", "c", "", "ID of a container to run pg_restore in")
+	inspectCmd.Flags().StringVarP(&inspectOpts.Output, "output", "o", "tree", "Output format: tree or json")
+	inspectCmd.Flags().BoolVar(&inspectOpts.Sizes, "sizes", false, "Measure the data of each table (reads the whole backup)")
+	inspectCmd.Flags().StringVar(&inspectOpts.WriteList, "write-list", "", "Save the pg_restore --list output to this file for restore --use-list")
+
+	_ = inspectCmd.MarkFlagRequired("tag")
+	requireRepository(inspectCmd)
+}
@@ -26,19 +26,37 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var (
+	listOpts             backup.ListOptions
+	listSince, listUntil string
+)
+
 // listCmd represents the list command
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List available backups",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		var err error
+		if listOpts.Since, err = backup.ParseTime(listSince, false); err != nil {
+			return err
+		}
+		if listOpts.Until, err = backup.ParseTime(listUntil, true); err != nil {
+			return err
+		}
 		if err := app.Setup(); err != nil {
 			return err
 		}
-		return backup.List(cmd.Context(), app)
+		return backup.List(cmd.Context(), app, listOpts, cmd.OutOrStdout())
 	},
 }
 
 func init() {
 	backupCmd.AddCommand(listCmd)
-	_ = rootCmd.MarkPersistentFlagRequired("repository")
+	listCmd.Flags().IntVar(&listOpts.Limit, "limit", 0, "Show at most this many backups")
+	listCmd.Flags().StringVar(&listOpts.Sort, "sort", backup.SortDate, "Sort by date (newest first) or size (largest first)")
+	listCmd.Flags().StringVar(&listOpts.Filter, "filter", "", "Only show tags matching this glob, e.g. '2024-03-*'")
+	listCmd.Flags().StringVar(&listSince, "since", "", "Only show backups pushed at or after this time (YYYY-MM-DD, tag timestamp or RFC 3339)")
+	listCmd.Flags().StringVar(&listUntil, "until", "", "Only show backups pushed at or before this time (YYYY-MM-DD, tag timestamp or RFC 3339)")
+	listCmd.Flags().StringVarP(&listOpts.Output, "output", "o", "", "Output format: json, yaml, table or plain (default: table on a terminal, plain otherwise)")
+	requireRepository(listCmd)
 }
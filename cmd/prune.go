@@ -0,0 +1,58 @@
+/*
+Copyright © 2023 Benjamin Buetikofer <bbu@ik.me>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bocker.software-services.dev/pkg/backup"
+	"github.com/spf13/cobra"
+)
+
+var pruneDryRun bool
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete backups that fall outside the retention policy",
+	Long: `Prune deletes backup tags according to grandfather-father-son rules.
+A backup is kept if any rule selects it; tags that are not bocker timestamps
+are never touched.
+
+Example:
+bocker backup prune -r <repository> --keep-last 3 --keep-daily 7 --keep-weekly 4 --keep-monthly 12 --dry-run`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := app.Setup(); err != nil {
+			return err
+		}
+		return backup.Prune(cmd.Context(), app, pruneDryRun, cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	backupCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().IntVar(&app.Config.Retention.KeepLast, "keep-last", 0, "Keep the N most recent backups")
+	pruneCmd.Flags().IntVar(&app.Config.Retention.KeepDaily, "keep-daily", 0, "Keep the newest backup of each of the last N days")
+	pruneCmd.Flags().IntVar(&app.Config.Retention.KeepWeekly, "keep-weekly", 0, "Keep the newest backup of each of the last N weeks")
+	pruneCmd.Flags().IntVar(&app.Config.Retention.KeepMonthly, "keep-monthly", 0, "Keep the newest backup of each of the last N months")
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "Only list what would be removed")
+
+	requireRepository(pruneCmd)
+}
@@ -22,44 +22,97 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"errors"
+	"strings"
+
+	"bocker.software-services.dev/pkg/backup"
+	"bocker.software-services.dev/pkg/db"
 	"bocker.software-services.dev/pkg/tui"
 	"github.com/spf13/cobra"
 )
 
 var restoreOpts struct {
-	DBOwner, DBSource, DBTarget, DBHost, Tag, ContainerID string
-	ImportRoles                                           bool
+	Engine, DBOwner, DBSource, DBTarget, DBHost, Tag, ContainerID, Identity string
+	UseList, DataDir, Volume, TargetTime, Since                             string
+	Schemas, Tables                                                         []string
+	Jobs, Limit                                                             int
+	ImportRoles                                                             bool
 }
 
 var restoreCmd = &cobra.Command{
 	Use:   "restore",
-	Short: "Restore a Postgresql database",
+	Short: "Restore a database",
+	Long: `Restore a backup into a database.
+
+The engine (postgres, mysql, mariadb, mongodb or sqlite) is taken from the backup's metadata;
+--engine only acts as a safety check that the backup is of the expected kind.
+
+Physical backups (backup --mode physical) are restored with --data-dir or
+--volume instead of --db-target: bocker lays out the data directory there and
+a postgres container of the backup's major version can then start on it.
+With --target-time the server then replays the WAL archived by wal-push up
+to that point in time.
+
+Without --tag, bocker shows the newest backups so you can pick one and
+confirm the target database before anything is restored. The picker offers
+the newest 50 and says how many it left out; --limit and --since reach
+further back.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
+		app.Config.DB.Engine = restoreOpts.Engine
 		app.Config.DB.Owner = restoreOpts.DBOwner
 		app.Config.DB.SourceName = restoreOpts.DBSource
 		app.Config.DB.TargetName = restoreOpts.DBTarget
 		app.Config.DB.Host = restoreOpts.DBHost
+		app.Config.DB.Jobs = restoreOpts.Jobs
+		app.Config.DB.Schemas = restoreOpts.Schemas
+		app.Config.DB.Tables = restoreOpts.Tables
+		app.Config.DB.UseList = restoreOpts.UseList
+		app.Config.DB.DataDir = restoreOpts.DataDir
+		app.Config.Docker.Volume = restoreOpts.Volume
 		app.Config.Docker.Tag = restoreOpts.Tag
 		app.Config.Docker.ContainerID = restoreOpts.ContainerID
 		app.Config.DB.ImportRoles = restoreOpts.ImportRoles
-		return tui.InitRestoreTui(cmd.Context(), app)
+		app.Config.Encryption.IdentityFile = restoreOpts.Identity
+		var err error
+		if app.Config.DB.TargetTime, err = backup.ParseTime(restoreOpts.TargetTime, false); err != nil {
+			return err
+		}
+		if restoreOpts.DBTarget == "" && restoreOpts.DataDir == "" && restoreOpts.Volume == "" {
+			return errors.New("required flag \"db-target\" not set (or --data-dir or --volume for a physical backup)")
+		}
+		if restoreOpts.Limit < 0 {
+			return errors.New("--limit must not be negative")
+		}
+		pick := backup.ListOptions{Limit: restoreOpts.Limit}
+		if pick.Since, err = backup.ParseTime(restoreOpts.Since, false); err != nil {
+			return err
+		}
+		return tui.InitRestoreTui(cmd.Context(), app, pick)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(restoreCmd)
 
-	restoreCmd.Flags().StringVarP(&restoreOpts.DBOwner, "db-owner", "o", "", "Database user ")
-	restoreCmd.Flags().StringVarP(&restoreOpts.DBSource, "db-source", "s", "", "Source database name")
-	restoreCmd.Flags().StringVarP(&restoreOpts.DBTarget, "db-target", "t", "", "Target database name")
+	restoreCmd.Flags().StringVar(&restoreOpts.Engine, "engine", "", "Expected database engine: "+strings.Join(db.Engines(), ", ")+" (default: from the backup)")
+	restoreCmd.Flags().StringVarP(&restoreOpts.DBOwner, "db-owner", "o", "", "Database user (required except for sqlite)")
+	restoreCmd.Flags().StringVarP(&restoreOpts.DBSource, "db-source", "s", "", "Source database name (only needed for backups without metadata)")
+	restoreCmd.Flags().StringVarP(&restoreOpts.DBTarget, "db-target", "t", "", "Target database name, or file path for sqlite")
 	restoreCmd.Flags().StringVar(&restoreOpts.DBHost, "db-host", "localhost", "Hostname of the database host")
-	restoreCmd.Flags().StringVar(&restoreOpts.Tag, "tag", "", "Tag of the image with the backup in it")
-	restoreCmd.Flags().StringVarP(&restoreOpts.ContainerID, "container-id", "c", "", "ID of container running PostgreSQL")
+	restoreCmd.Flags().IntVarP(&restoreOpts.Jobs, "jobs", "j", 0, "Number of parallel pg_restore jobs (postgres custom and directory formats)")
+	restoreCmd.Flags().StringArrayVar(&restoreOpts.Schemas, "schema", nil, "Only restore objects in this schema (repeatable, postgres)")
+	restoreCmd.Flags().StringArrayVar(&restoreOpts.Tables, "table", nil, "Only restore this table (repeatable, postgres)")
+	restoreCmd.Flags().StringVar(&restoreOpts.UseList, "use-list", "", "Restore only the items listed in this pg_restore -l file, in its order (postgres)")
+	restoreCmd.Flags().StringVar(&restoreOpts.DataDir, "data-dir", "", "Lay out a physical backup as a data directory here (must be empty)")
+	restoreCmd.Flags().StringVar(&restoreOpts.Volume, "volume", "", "Lay out a physical backup in this Docker volume")
+	restoreCmd.Flags().StringVar(&restoreOpts.TargetTime, "target-time", "", "Recover a physical backup up to this time from the archived WAL (tag timestamp or RFC 3339)")
+	restoreCmd.Flags().StringVar(&restoreOpts.Tag, "tag", "", "Tag of the image with the backup in it (pick interactively if omitted)")
+	restoreCmd.Flags().IntVar(&restoreOpts.Limit, "limit", backup.PickLimit, "Number of newest backups the picker offers (0 for all)")
+	restoreCmd.Flags().StringVar(&restoreOpts.Since, "since", "", "Only offer backups pushed at or after this time in the picker (YYYY-MM-DD, tag timestamp or RFC 3339)")
+	restoreCmd.Flags().StringVarP(&restoreOpts.ContainerID, "container-id", "c", "", "ID of container running the database")
+	restoreCmd.Flags().StringVarP(&restoreOpts.Identity, "identity", "i", "", "age identity file to decrypt the backup with")
 	restoreCmd.Flags().BoolVar(&restoreOpts.ImportRoles, "import-roles", false, "Create roles from backup")
 
-	_ = restoreCmd.MarkFlagRequired("tag")
-	_ = restoreCmd.MarkFlagRequired("db-owner")
-	_ = restoreCmd.MarkFlagRequired("db-source")
-	_ = restoreCmd.MarkFlagRequired("db-target")
-	_ = rootCmd.MarkPersistentFlagRequired("repository")
+	restoreCmd.MarkFlagsMutuallyExclusive("db-target", "data-dir", "volume")
+	requireRepository(restoreCmd)
 }
@@ -22,13 +22,17 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"bocker.software-services.dev/pkg/config"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -44,7 +48,22 @@ reverse and restore your database from a backup in Docker Hub.`,
 		// banner so a failing pg_dump doesn't dump the full --help on the user.
 		SilenceUsage:  true,
 		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Annotations[profileSettings] == "" {
+				return nil
+			}
+			if err := applyProfile(cmd); err != nil {
+				return err
+			}
+			if cmd.Annotations[repositoryRequired] != "" && app.Config.Docker.Repository == "" {
+				return errors.New(`required flag(s) "repository" not set`)
+			}
+			return nil
+		},
 	}
+	profileName string
+	// effective are the settings applyProfile resolved, for `config list`.
+	effective []config.Resolved
 )
 
 // Execute wires Ctrl+C into a cancellable context and runs the root command.
@@ -56,7 +75,91 @@ func Execute() error {
 	return rootCmd.ExecuteContext(ctx)
 }
 
+// Annotations telling the root command's PersistentPreRunE what a
+// subcommand needs.
+const (
+	// profileSettings marks the commands that take settings from a
+	// config.yaml profile. Others don't read the profiles at all, so a typo
+	// in one cannot break e.g. `bocker config set`.
+	profileSettings = "bocker_profile_settings"
+	// repositoryRequired marks the commands that need --repository. It can't
+	// be marked required on the persistent flag itself since that is shared
+	// with commands such as daemon and version, which don't.
+	repositoryRequired = "bocker_repository_required"
+)
+
+func annotate(cmd *cobra.Command, key string) {
+	if cmd.Annotations == nil {
+		cmd.Annotations = map[string]string{}
+	}
+	cmd.Annotations[key] = "true"
+}
+
+// useProfile lets the selected profile fill in the flags of cmd.
+func useProfile(cmd *cobra.Command) {
+	annotate(cmd, profileSettings)
+}
+
+// requireRepository makes --repository mandatory for cmd, which takes its
+// settings from profiles too. The check runs after applyProfile, so a profile
+// or BOCKER_REPOSITORY can supply it.
+func requireRepository(cmd *cobra.Command) {
+	useProfile(cmd)
+	annotate(cmd, repositoryRequired)
+}
+
+// applyProfile fills in the flags of cmd from the selected config.yaml
+// profile and BOCKER_* environment variables, so that the environment wins
+// over flags given on the command line, and those over the profile.
+func applyProfile(cmd *cobra.Command) error {
+	file, err := config.LoadFile()
+	if err != nil {
+		return err
+	}
+	name, profile, err := file.Profile(cmp.Or(os.Getenv(config.EnvName("profile")), profileName))
+	if err != nil {
+		return err
+	}
+	app.Config.Profile = name
+
+	flags := cmd.Flags()
+	effective = config.Resolve(profile, func(names []string) ([]string, bool) {
+		for _, n := range names {
+			if f := flags.Lookup(n); f != nil && f.Changed {
+				if sv, ok := f.Value.(pflag.SliceValue); ok {
+					return sv.GetSlice(), true
+				}
+				return []string{f.Value.String()}, true
+			}
+		}
+		return nil, false
+	})
+	for _, r := range effective {
+		if r.Source == config.SourceFlag {
+			continue
+		}
+		for _, n := range r.Flags {
+			f := flags.Lookup(n)
+			if f == nil {
+				continue
+			}
+			if sv, ok := f.Value.(pflag.SliceValue); ok {
+				err = sv.Replace(r.Values)
+				f.Changed = true
+			} else {
+				err = flags.Set(n, r.Values[0])
+			}
+			if err != nil {
+				return fmt.Errorf("%s from %s: %w", r.Key, r.Source, err)
+			}
+		}
+	}
+	return nil
+}
+
 func init() {
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "Profile from config.yaml to take settings from (default: its default-profile)")
 	rootCmd.PersistentFlags().StringVarP(&app.Config.Docker.Namespace, "namespace", "n", "bueti", "Docker Namespace")
 	rootCmd.PersistentFlags().StringVarP(&app.Config.Docker.Repository, "repository", "r", "", "Docker Repository")
+	rootCmd.PersistentFlags().StringVar(&app.Config.Docker.Registry, "registry", "docker.io", "Registry host to push to and pull from")
 }
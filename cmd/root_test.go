@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/adrg/xdg"
+	"github.com/spf13/cobra"
+)
+
+const profiles = `default-profile: prod
+profiles:
+  prod:
+    repository: prod_backup
+    db-host: db.prod
+    db-user: produser
+    recipient: [age1prod]
+    keep-last: 7
+  staging:
+    repository: staging_backup
+`
+
+// writeConfig gives the test a config.yaml with content.
+func writeConfig(t *testing.T, content string) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Cleanup(xdg.Reload)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	xdg.Reload()
+	if err := os.MkdirAll(filepath.Join(dir, "bocker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bocker", "config.yaml"), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restoreLike is a command with some of the flags profiles fill in; it has
+// no --keep-last, and calls the database user --db-owner.
+type restoreLike struct {
+	cmd                    *cobra.Command
+	repository, host, user string
+	recipients             []string
+}
+
+func newRestoreLike(t *testing.T, args ...string) *restoreLike {
+	t.Helper()
+	r := &restoreLike{cmd: &cobra.Command{Use: "restore"}}
+	r.cmd.Flags().StringVarP(&r.repository, "repository", "r", "", "")
+	r.cmd.Flags().StringVar(&r.host, "db-host", "localhost", "")
+	r.cmd.Flags().StringVar(&r.user, "db-owner", "", "")
+	r.cmd.Flags().StringSliceVar(&r.recipients, "recipient", nil, "")
+	if err := r.cmd.Flags().Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestApplyProfile(t *testing.T) {
+	tests := []struct {
+		name       string
+		profile    string
+		env        map[string]string
+		args       []string
+		repository string
+		host       string
+		user       string
+		recipients []string
+	}{
+		{
+			name:       "default profile",
+			repository: "prod_backup", host: "db.prod", user: "produser", recipients: []string{"age1prod"},
+		},
+		{
+			name:       "flag over profile",
+			args:       []string{"-r", "cli_backup", "--recipient", "age1a,age1b"},
+			repository: "cli_backup", host: "db.prod", user: "produser", recipients: []string{"age1a", "age1b"},
+		},
+		{
+			name:       "env over flag",
+			env:        map[string]string{"BOCKER_REPOSITORY": "env_backup", "BOCKER_DB_USER": "envuser"},
+			args:       []string{"-r", "cli_backup", "--db-owner", "cliuser"},
+			repository: "env_backup", host: "db.prod", user: "envuser", recipients: []string{"age1prod"},
+		},
+		{
+			name:       "selected profile",
+			profile:    "staging",
+			repository: "staging_backup", host: "localhost",
+		},
+		{
+			name:       "profile from env",
+			env:        map[string]string{"BOCKER_PROFILE": "staging"},
+			profile:    "prod",
+			repository: "staging_backup", host: "localhost",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeConfig(t, profiles)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			profileName = tt.profile
+			t.Cleanup(func() { profileName = "" })
+
+			r := newRestoreLike(t, tt.args...)
+			if err := applyProfile(r.cmd); err != nil {
+				t.Fatal(err)
+			}
+			got := []any{r.repository, r.host, r.user, r.recipients}
+			want := []any{tt.repository, tt.host, tt.user, tt.recipients}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("repository, db-host, db-owner, recipient = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyProfileErrors(t *testing.T) {
+	writeConfig(t, profiles)
+	profileName = "prdo"
+	t.Cleanup(func() { profileName = "" })
+	if err := applyProfile(newRestoreLike(t).cmd); err == nil || !strings.Contains(err.Error(), `"prdo" not found`) {
+		t.Errorf("unknown profile: err = %v", err)
+	}
+
+	profileName = ""
+	t.Setenv("BOCKER_KEEP_LAST", "many")
+	list := &cobra.Command{Use: "prune"}
+	list.Flags().Int("keep-last", 0, "")
+	if err := applyProfile(list); err == nil || !strings.Contains(err.Error(), "keep-last from env") {
+		t.Errorf("invalid value: err = %v", err)
+	}
+}
+
+// Only commands that use profiles read them, and strictly.
+func TestPersistentPreRun(t *testing.T) {
+	writeConfig(t, "profiles:\n  prod:\n    repositry: typo\n")
+	if err := rootCmd.PersistentPreRunE(versionCmd, nil); err != nil {
+		t.Errorf("version: %v", err)
+	}
+	if err := rootCmd.PersistentPreRunE(configSetCmd, nil); err != nil {
+		t.Errorf("config set: %v", err)
+	}
+	if err := rootCmd.PersistentPreRunE(listCmd, nil); err == nil || !strings.Contains(err.Error(), "repositry") {
+		t.Errorf("backup list: err = %v, want the misspelt key reported", err)
+	}
+
+	writeConfig(t, "")
+	if err := rootCmd.PersistentPreRunE(listCmd, nil); err == nil || !strings.Contains(err.Error(), "repository") {
+		t.Errorf("backup list without a repository: err = %v", err)
+	}
+	if err := rootCmd.PersistentPreRunE(daemonCmd, nil); err != nil {
+		t.Errorf("daemon without a repository: %v", err)
+	}
+}
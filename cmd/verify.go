@@ -0,0 +1,74 @@
+/*
+Copyright © 2023 Benjamin Buetikofer <bbu@ik.me>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bocker.software-services.dev/pkg/tui"
+	"github.com/spf13/cobra"
+)
+
+var verifyOpts struct {
+	Tag, DBSource, Identity string
+	tui.VerifyOptions
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check that a backup can be restored",
+	Long: `Verify pulls a backup, restores it into a throwaway PostgreSQL container
+and runs sanity queries against the result. The container is removed
+afterwards, whether the checks pass or not.
+
+Without --query or --sql-file, bocker reports the number of tables and rows.
+Pass --record to mark the tag as verified in the registry so that
+"bocker backup list" shows it. The result is pushed as a separate
+verified-<tag> artifact that refers to the backup; the backup's own
+manifest and digest stay the same. "bocker backup prune" deletes the
+record together with its backup.
+
+Requires:
+- Docker installed and configured
+
+Example:
+bocker verify -r <repository> --tag 2024-03-12_02-00-00 --query 'SELECT count(*) FROM users' --record`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		app.Config.Docker.Tag = verifyOpts.Tag
+		app.Config.DB.SourceName = verifyOpts.DBSource
+		app.Config.Encryption.IdentityFile = verifyOpts.Identity
+		return tui.InitVerifyTui(cmd.Context(), app, verifyOpts.VerifyOptions, cmd.OutOrStdout())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().StringVar(&verifyOpts.Tag, "tag", "", "Tag of the image with the backup in it")
+	verifyCmd.Flags().StringVarP(&verifyOpts.DBSource, "db-source", "s", "", "Source database name (only needed for backups without metadata)")
+	verifyCmd.Flags().StringVarP(&verifyOpts.Identity, "identity", "i", "", "age identity file to decrypt the backup with")
+	verifyCmd.Flags().StringVar(&verifyOpts.Image, "image", "", "PostgreSQL image to restore into (default: matches the backup's server version)")
+	verifyCmd.Flags().StringArrayVar(&verifyOpts.Queries, "query", nil, "Sanity query that must succeed (repeatable)")
+	verifyCmd.Flags().StringVar(&verifyOpts.SQLFile, "sql-file", "", "SQL file to run after restoring; any error fails verification")
+	verifyCmd.Flags().BoolVar(&verifyOpts.Record, "record", false, "Push a verified-<tag> record to the registry on success")
+
+	_ = verifyCmd.MarkFlagRequired("tag")
+	requireRepository(verifyCmd)
+}
@@ -43,5 +43,6 @@ var versionCmd = &cobra.Command{
 }
 
 func init() {
+	app.Version = version
 	rootCmd.AddCommand(versionCmd)
 }
@@ -0,0 +1,56 @@
+/*
+Copyright © 2023 Benjamin Buetikofer <bbu@ik.me>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bocker.software-services.dev/pkg/backup"
+	"github.com/spf13/cobra"
+)
+
+var walFetchIdentity string
+
+var walFetchCmd = &cobra.Command{
+	Use:   "wal-fetch <file name> <path>",
+	Short: "Fetch an archived WAL file from the registry",
+	Long: `Fetch the WAL file archived by wal-push under the tag wal-<file name> and
+write it to path. Meant to be PostgreSQL's restore_command, which
+bocker restore --target-time sets up:
+
+restore_command = 'bocker wal-fetch -r <repository> %f %p'
+
+Files that were never archived make it fail, which tells PostgreSQL that
+the end of the archive has been reached.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		app.Config.Encryption.IdentityFile = walFetchIdentity
+		if err := app.Setup(); err != nil {
+			return err
+		}
+		return backup.WALFetch(cmd.Context(), app, args[0], args[1])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(walFetchCmd)
+	walFetchCmd.Flags().StringVarP(&walFetchIdentity, "identity", "i", "", "age identity file to decrypt the WAL file with")
+	requireRepository(walFetchCmd)
+}
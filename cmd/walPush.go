@@ -0,0 +1,68 @@
+/*
+Copyright © 2023 Benjamin Buetikofer <bbu@ik.me>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"bocker.software-services.dev/pkg/backup"
+	"bocker.software-services.dev/pkg/config"
+	"github.com/spf13/cobra"
+)
+
+var walPushOpts struct {
+	Compression      string
+	CompressionLevel int
+	Recipients       []string
+	Passphrase       bool
+}
+
+var walPushCmd = &cobra.Command{
+	Use:   "wal-push <path> <file name>",
+	Short: "Archive a WAL file to the registry",
+	Long: `Archive one WAL file as the tag wal-<file name> in the repository, next to
+the physical backups. Meant to be PostgreSQL's archive_command:
+
+archive_command = 'bocker wal-push -r <repository> %p %f'
+
+Pushing a file that is already archived succeeds as long as its contents are
+the same. bocker backup prune removes WAL files older than the oldest
+physical backup it keeps.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		app.Config.Docker.Compression = walPushOpts.Compression
+		app.Config.Docker.CompressionLevel = walPushOpts.CompressionLevel
+		app.Config.Encryption.Recipients = walPushOpts.Recipients
+		app.Config.Encryption.Passphrase = walPushOpts.Passphrase
+		if err := app.Setup(); err != nil {
+			return err
+		}
+		return backup.WALPush(cmd.Context(), app, args[0], args[1])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(walPushCmd)
+	walPushCmd.Flags().StringVar(&walPushOpts.Compression, "compression", config.CompressionGzip, "Layer compression: gzip, zstd or none")
+	walPushCmd.Flags().IntVar(&walPushOpts.CompressionLevel, "compression-level", 0, "Compression level (gzip 1-9, zstd 1-22; 0 for the default)")
+	walPushCmd.Flags().StringArrayVar(&walPushOpts.Recipients, "recipient", nil, "Encrypt the WAL file to this age public key (repeatable)")
+	walPushCmd.Flags().BoolVar(&walPushOpts.Passphrase, "passphrase", false, "Encrypt the WAL file with the stored encryption key as passphrase")
+	requireRepository(walPushCmd)
+}
@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+
+	"bocker.software-services.dev/pkg/db"
+	"charm.land/lipgloss/v2"
+	"charm.land/lipgloss/v2/tree"
+)
+
+// OutputTree renders the contents of a backup as a tree; see WriteContents.
+const OutputTree = "tree"
+
+// Contents describes what is inside a backup.
+type Contents struct {
+	Tag      string        `json:"tag"`
+	Database string        `json:"database"`
+	Format   string        `json:"format"`
+	Entries  []db.TOCEntry `json:"entries"`
+}
+
+// contentGroups are the object types shown in the tree, under their schema,
+// in this order. Everything else (constraints, indexes, ACLs, ...) is only
+// in the JSON output.
+var contentGroups = []struct {
+	title string
+	types []string
+}{
+	{"Tables", []string{"TABLE", "FOREIGN TABLE"}},
+	{"Views", []string{"VIEW", "MATERIALIZED VIEW"}},
+	{"Functions", []string{"FUNCTION", "PROCEDURE", "AGGREGATE"}},
+	{"Sequences", []string{"SEQUENCE"}},
+	{"Types", []string{"TYPE", "DOMAIN"}},
+}
+
+var (
+	treeRootStyle = lipgloss.NewStyle().Bold(true)
+	treeSizeStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("240"))
+)
+
+// WriteContents prints c to w as OutputTree or OutputJSON.
+func WriteContents(w io.Writer, c Contents, output string) error {
+	switch output {
+	case "", OutputTree:
+		_, err := fmt.Fprintln(w, contentsTree(c))
+		return err
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(c)
+	}
+	return fmt.Errorf("unknown output format %q (want %s or %s)", output, OutputTree, OutputJSON)
+}
+
+func contentsTree(c Contents) *tree.Tree {
+	sizes := map[string]int64{}
+	schemas := map[string]bool{}
+	var extensions []string
+	for _, e := range c.Entries {
+		switch e.Type {
+		case "TABLE DATA":
+			sizes[e.Schema+"."+e.Name] = e.Size
+		case "SCHEMA":
+			schemas[e.Name] = true
+		case "EXTENSION":
+			extensions = append(extensions, e.Name)
+		}
+		if e.Schema != "" {
+			schemas[e.Schema] = true
+		}
+	}
+
+	t := tree.Root(fmt.Sprintf("%s (%s, %s)", c.Database, c.Tag, c.Format)).RootStyle(treeRootStyle)
+	if len(extensions) > 0 {
+		sort.Strings(extensions)
+		ext := tree.Root("Extensions")
+		for _, name := range extensions {
+			ext.Child(name)
+		}
+		t.Child(ext)
+	}
+
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, schema := range names {
+		st := tree.Root(schema)
+		for _, g := range contentGroups {
+			var items []string
+			for _, e := range c.Entries {
+				if e.Schema != schema || !slices.Contains(g.types, e.Type) {
+					continue
+				}
+				item := e.Name
+				if size, ok := sizes[schema+"."+e.Name]; ok && size > 0 {
+					item += " " + treeSizeStyle.Render(mib(size))
+				}
+				items = append(items, item)
+			}
+			if len(items) == 0 {
+				continue
+			}
+			gt := tree.Root(g.title)
+			for _, item := range items {
+				gt.Child(item)
+			}
+			st.Child(gt)
+		}
+		t.Child(st)
+	}
+	return t
+}
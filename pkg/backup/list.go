@@ -5,110 +5,257 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
+	"os"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"bocker.software-services.dev/pkg/backup/tui"
 	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/db"
 	"bocker.software-services.dev/pkg/docker"
 	"charm.land/bubbles/v2/table"
 	tea "charm.land/bubbletea/v2"
+	"github.com/mattn/go-isatty"
+	"gopkg.in/yaml.v3"
 )
 
-type Layer struct {
-	Digest      string `json:"digest"`
-	Size        int    `json:"size"`
-	Instruction string `json:"instruction"`
+// Output formats accepted by List.
+const (
+	OutputTable = "table"
+	OutputPlain = "plain"
+	OutputJSON  = "json"
+	OutputYAML  = "yaml"
+)
+
+// Sort orders accepted by List.
+const (
+	SortDate = "date"
+	SortSize = "size"
+)
+
+// ListOptions controls what List prints and how.
+type ListOptions struct {
+	// Output is one of the Output* formats. Empty picks the interactive table
+	// when stdout is a terminal and plain output otherwise.
+	Output string
+	// Sort is SortDate (newest first, the default) or SortSize (largest
+	// first).
+	Sort string
+	// Filter is a glob (path.Match syntax) the tag name has to match.
+	Filter string
+	// Since and Until bound the push time; zero values are open ends.
+	Since, Until time.Time
+	// Limit caps the number of backups shown after filtering; 0 shows all.
+	Limit int
 }
 
-type Images struct {
-	Architecture string  `json:"architecture"`
-	Features     string  `json:"features"`
-	Variant      string  `json:"variant,omitempty"`
-	Digest       string  `json:"digest"`
-	Layers       []Layer `json:"layers"`
-	OS           string  `json:"os"`
-	OSFeatures   string  `json:"os_features"`
-	OSVersion    string  `json:"os_version,omitempty"`
-	Size         int     `json:"size"`
-	Status       string  `json:"status"`
-	LastPulled   string  `json:"last_pulled,omitempty"`
-	LastPushed   string  `json:"last_pushed"`
+// ParseTime parses the --since/--until forms: a date, a bocker tag
+// timestamp, or RFC 3339. until rounds a bare date up to the end of that day
+// so `--until 2024-03-12` includes backups taken on the 12th.
+func ParseTime(s string, until bool) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		if until {
+			t = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+		}
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(config.DateTimeFormat, s, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: use YYYY-MM-DD, %s or RFC 3339", s, config.DateTimeFormat)
 }
 
-type Response struct {
-	ID                  int      `json:"id"`
-	Images              []Images `json:"images"`
-	Creator             int      `json:"creator"`
-	LastUpdated         string   `json:"last_updated"`
-	LastUpdater         int      `json:"last_updater"`
-	LastUpdaterUsername string   `json:"last_updater_username"`
-	Name                string   `json:"name"`
-	Repository          int      `json:"repository"`
-	FullSize            int      `json:"full_size"`
-	V2                  bool     `json:"v2"`
-	Status              string   `json:"status"`
-	TagLastPulled       string   `json:"tag_last_pulled,omitempty"`
-	TagLastPushed       string   `json:"tag_last_pushed"`
+// Select filters, sorts and limits tags according to opts.
+func Select(tags []docker.Tag, opts ListOptions) ([]docker.Tag, error) {
+	var out []docker.Tag
+	for _, t := range tags {
+		if opts.Filter != "" {
+			ok, err := path.Match(opts.Filter, t.Name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter %q: %w", opts.Filter, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		if !opts.Since.IsZero() && t.LastPushed.Before(opts.Since) {
+			continue
+		}
+		if !opts.Until.IsZero() && t.LastPushed.After(opts.Until) {
+			continue
+		}
+		out = append(out, t)
+	}
+
+	switch opts.Sort {
+	case "", SortDate:
+		sort.SliceStable(out, func(i, j int) bool { return out[i].LastPushed.After(out[j].LastPushed) })
+	case SortSize:
+		sort.SliceStable(out, func(i, j int) bool { return out[i].Size > out[j].Size })
+	default:
+		return nil, fmt.Errorf("unknown sort order %q (want %s or %s)", opts.Sort, SortDate, SortSize)
+	}
+
+	if opts.Limit > 0 && len(out) > opts.Limit {
+		out = out[:opts.Limit]
+	}
+	return out, nil
 }
 
-type ListTagsResponse struct {
-	Count    int        `json:"count"`
-	Next     string     `json:"next,omitempty"`
-	Previous string     `json:"previous,omitempty"`
-	Results  []Response `json:"results"`
+// Entry is the machine-readable form of one backup.
+type Entry struct {
+	Tag         string           `json:"tag" yaml:"tag"`
+	Digest      string           `json:"digest" yaml:"digest"`
+	Size        int64            `json:"size" yaml:"size"`
+	LastPushed  time.Time        `json:"last_pushed" yaml:"last_pushed"`
+	Compression string           `json:"compression,omitempty" yaml:"compression,omitempty"`
+	Metadata    *docker.Metadata `json:"metadata,omitempty" yaml:"metadata,omitempty"`
 }
 
-func List(ctx context.Context, app *config.Application) error {
-	c, err := docker.NewHTTPClient(app)
+func List(ctx context.Context, app *config.Application, opts ListOptions, w io.Writer) error {
+	reg, err := docker.NewRegistry(app)
 	if err != nil {
 		return err
 	}
-
-	path := fmt.Sprintf("/v2/namespaces/%s/repositories/%s/tags", app.Config.Docker.Namespace, app.Config.Docker.Repository)
-	resp, err := c.DoRequest(ctx, http.MethodGet, path, nil)
+	tags, err := reg.Tags(ctx)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("docker hub returned status %d", resp.StatusCode)
+	if tags, err = Select(tags, opts); err != nil {
+		return err
 	}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	output := opts.Output
+	if output == "" {
+		output = OutputPlain
+		if isatty.IsTerminal(os.Stdout.Fd()) {
+			output = OutputTable
+		}
 	}
-	var tags ListTagsResponse
-	if err := json.Unmarshal(bodyBytes, &tags); err != nil {
+	if tags, err = reg.Describe(ctx, tags); err != nil {
 		return err
 	}
 
-	columns := []table.Column{
-		{Title: "ID", Width: 10},
-		{Title: "Tag", Width: 20},
-		{Title: "Last Updated", Width: 25},
-		{Title: "Size", Width: 10},
+	switch output {
+	case OutputTable:
+		return listTable(tags)
+	case OutputPlain:
+		return listPlain(w, tags)
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries(tags))
+	case OutputYAML:
+		enc := yaml.NewEncoder(w)
+		defer enc.Close()
+		return enc.Encode(entries(tags))
 	}
+	return fmt.Errorf("unknown output format %q (want %s, %s, %s or %s)", output, OutputJSON, OutputYAML, OutputTable, OutputPlain)
+}
 
-	rows := make([]table.Row, 0, len(tags.Results))
-	for _, v := range tags.Results {
-		size := float64(v.FullSize) / (1 << 20)
-		sizeStr := fmt.Sprintf("%.2f MiB", size)
-
-		dateTime, err := time.Parse(time.RFC3339, v.LastUpdated)
-		if err != nil {
-			return fmt.Errorf("cannot parse timestamp: %w", err)
+// listPlain prints one line per backup: tag, digest, size, push time,
+// engine, database, format, compression, encryption and verification time.
+// Empty fields are printed as "-" so every line has the same number of
+// columns for awk and cut.
+func listPlain(w io.Writer, tags []docker.Tag) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, v := range tags {
+		meta := v.Metadata
+		engine := meta.Engine
+		if engine == "" && meta.FileName != "" {
+			engine = db.EnginePostgres
+		}
+		fields := []string{v.Name, v.Digest, strconv.FormatInt(v.Size, 10), v.LastPushed.Format(time.RFC3339),
+			engine, meta.Database, meta.Format, v.Compression, meta.Encryption, meta.Verified}
+		for i, f := range fields {
+			if f == "" {
+				fields[i] = "-"
+			}
 		}
+		fmt.Fprintln(tw, strings.Join(fields, "\t"))
+	}
+	return tw.Flush()
+}
 
-		rows = append(rows, []string{strconv.Itoa(v.ID), v.Name, dateTime.Format("02 Jan 2006 15:04 MST"), sizeStr})
+func entries(tags []docker.Tag) []Entry {
+	out := make([]Entry, 0, len(tags))
+	for _, v := range tags {
+		e := Entry{Tag: v.Name, Digest: v.Digest, Size: v.Size, LastPushed: v.LastPushed, Compression: v.Compression}
+		if v.Metadata.FileName != "" {
+			meta := v.Metadata
+			e.Metadata = &meta
+		}
+		out = append(out, e)
 	}
+	return out
+}
 
+func listTable(tags []docker.Tag) error {
+	columns, rows := tableRows(tags)
 	m := tui.NewModel(columns, rows)
 	if _, err := tea.NewProgram(m).Run(); err != nil {
 		return fmt.Errorf("could not start backup list tui: %w", err)
 	}
 	return nil
 }
+
+func tableRows(tags []docker.Tag) ([]table.Column, []table.Row) {
+	columns := []table.Column{
+		{Title: "Digest", Width: 14},
+		{Title: "Tag", Width: 20},
+		{Title: "Last Updated", Width: 25},
+		{Title: "Size", Width: 10},
+		{Title: "Logical", Width: 10},
+		{Title: "Uploaded", Width: 10},
+		{Title: "Database", Width: 16},
+		{Title: "Server", Width: 8},
+		{Title: "Roles", Width: 5},
+		{Title: "Verified", Width: 8},
+	}
+
+	rows := make([]table.Row, 0, len(tags))
+	for _, v := range tags {
+		logical, uploaded := "", ""
+		if v.Metadata.LogicalSize > 0 {
+			logical, uploaded = mib(v.Metadata.LogicalSize), mib(v.Metadata.Uploaded)
+		}
+
+		roles, verified := "", ""
+		if v.Metadata.Roles {
+			roles = "yes"
+		}
+		if v.Metadata.Verified != "" {
+			verified = "yes"
+		}
+		rows = append(rows, []string{
+			shortDigest(v.Digest), v.Name, v.LastPushed.Format("02 Jan 2006 15:04 MST"), mib(v.Size),
+			logical, uploaded,
+			v.Metadata.Database, v.Metadata.ServerVersion, roles, verified,
+		})
+	}
+	return columns, rows
+}
+
+// mib formats a byte count the way the tables show sizes.
+func mib(n int64) string {
+	return fmt.Sprintf("%.2f MiB", float64(n)/(1<<20))
+}
+
+// shortDigest trims a digest to the 12 hex characters docker shows for IDs.
+func shortDigest(d string) string {
+	_, hex, _ := strings.Cut(d, ":")
+	if len(hex) > 12 {
+		return hex[:12]
+	}
+	return hex
+}
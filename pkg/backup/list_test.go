@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"bocker.software-services.dev/pkg/docker"
+)
+
+func TestListPlain(t *testing.T) {
+	at := time.Date(2024, 3, 12, 2, 0, 0, 0, time.UTC)
+	tags := []docker.Tag{
+		{
+			Name: "2024-03-12_02-00-00", Digest: "sha256:aaa", Size: 2048, LastPushed: at, Compression: "zstd",
+			Metadata: docker.Metadata{
+				Engine: "mysql", Database: "shop", Format: "custom", FileName: "shop.sql",
+				Encryption: "age", Verified: "2024-03-13T08:00:00Z",
+			},
+		},
+		// Backups from before engines were recorded are PostgreSQL.
+		{
+			Name: "2024-03-11_02-00-00", Digest: "sha256:bbb", Size: 1024, LastPushed: at.AddDate(0, 0, -1), Compression: "gzip",
+			Metadata: docker.Metadata{Database: "wiki", Format: "custom", FileName: "wiki.dump"},
+		},
+		// An image bocker didn't push.
+		{Name: "latest", Digest: "sha256:ccc", Size: 10, LastPushed: at},
+	}
+	var b strings.Builder
+	if err := listPlain(&b, tags); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"2024-03-12_02-00-00", "sha256:aaa", "2048", "2024-03-12T02:00:00Z", "mysql", "shop", "custom", "zstd", "age", "2024-03-13T08:00:00Z"},
+		{"2024-03-11_02-00-00", "sha256:bbb", "1024", "2024-03-11T02:00:00Z", "postgres", "wiki", "custom", "gzip", "-", "-"},
+		{"latest", "sha256:ccc", "10", "2024-03-12T02:00:00Z", "-", "-", "-", "-", "-", "-"},
+	}
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d:\n%s", len(lines), len(want), b.String())
+	}
+	for i, line := range lines {
+		if got := strings.Fields(line); strings.Join(got, " ") != strings.Join(want[i], " ") {
+			t.Errorf("line %d = %q, want %q", i, got, want[i])
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"bocker.software-services.dev/pkg/backup/tui"
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/docker"
+	tea "charm.land/bubbletea/v2"
+	"github.com/mattn/go-isatty"
+)
+
+// ErrNoSelection is returned by Pick when the user leaves the picker without
+// confirming a backup.
+var ErrNoSelection = errors.New("no backup selected")
+
+// PickLimit is how many of the newest backups the picker offers unless
+// restore --limit says otherwise. Describing them costs a manifest fetch
+// each, which Docker Hub counts as a pull.
+const PickLimit = 50
+
+// Pick shows the repository's newest backups and lets the user choose one to
+// restore into the database, data directory or volume app names. opts
+// narrows the backups down as for List; the picker says how many opts.Limit
+// left out. It returns the chosen tag.
+func Pick(ctx context.Context, app *config.Application, opts ListOptions) (string, error) {
+	if !isatty.IsTerminal(os.Stdout.Fd()) {
+		return "", errors.New("--tag is required when not running in a terminal")
+	}
+
+	reg, err := docker.NewRegistry(app)
+	if err != nil {
+		return "", err
+	}
+	tags, err := reg.Tags(ctx)
+	if err != nil {
+		return "", err
+	}
+	limit := opts.Limit
+	opts.Limit = 0
+	if tags, err = Select(tags, opts); err != nil {
+		return "", err
+	}
+	if len(tags) == 0 {
+		return "", fmt.Errorf("no backups found in %s", docker.RepositoryName(app))
+	}
+	note := ""
+	if limit > 0 && len(tags) > limit {
+		note = omittedNote(len(tags)-limit, len(tags))
+		tags = tags[:limit]
+	}
+	if tags, err = reg.Describe(ctx, tags); err != nil {
+		return "", err
+	}
+
+	columns, rows := tableRows(tags)
+	details := make([]string, len(tags))
+	for i, t := range tags {
+		details[i] = describeTag(t)
+	}
+	target := fmt.Sprintf("database %q on %s", app.Config.DB.TargetName, app.Config.DB.Host)
+	switch {
+	case app.Config.DB.DataDir != "":
+		target = "data directory " + app.Config.DB.DataDir
+	case app.Config.Docker.Volume != "":
+		target = "volume " + app.Config.Docker.Volume
+	}
+	prompt := func(row int) string {
+		return fmt.Sprintf("Restore %s into %s?", tags[row].Name, target)
+	}
+
+	picker := tui.NewPicker(columns, rows, details, prompt)
+	picker.Note = note
+	final, err := tea.NewProgram(picker, tea.WithContext(ctx)).Run()
+	if err != nil {
+		return "", fmt.Errorf("could not start restore picker: %w", err)
+	}
+	picker = final.(tui.Picker)
+	if picker.Selected < 0 {
+		return "", ErrNoSelection
+	}
+	return tags[picker.Selected].Name, nil
+}
+
+// omittedNote tells the user that older backups are not in the picker and
+// how to get at them.
+func omittedNote(omitted, total int) string {
+	backups := "backups"
+	if omitted == 1 {
+		backups = "backup"
+	}
+	return fmt.Sprintf("%d older %s of %d not shown; use --limit or --since, or pass --tag.", omitted, backups, total)
+}
+
+// describeTag renders the detail pane for one backup.
+func describeTag(t docker.Tag) string {
+	var sb strings.Builder
+	line := func(k, v string) {
+		if v != "" {
+			fmt.Fprintf(&sb, "%-13s %s\n", k+":", v)
+		}
+	}
+	m := t.Metadata
+	line("Tag", t.Name)
+	line("Digest", shortDigest(t.Digest))
+	line("Pushed", t.LastPushed.Format("02 Jan 2006 15:04 MST"))
+	line("Size", mib(t.Size))
+	if m.FileName == "" {
+		sb.WriteString("\nNo bocker metadata; pass --db-source.\n")
+		return sb.String()
+	}
+	if m.LogicalSize > 0 {
+		line("Logical", mib(m.LogicalSize))
+		line("Uploaded", mib(m.Uploaded))
+	}
+	line("Engine", m.Engine)
+	line("Database", m.Database)
+	line("Server", m.ServerVersion)
+	line("Dump tool", m.DumpVersion)
+	line("Format", m.Format)
+	line("Roles", fmt.Sprintf("%t", m.Roles))
+	line("Encryption", m.Encryption)
+	line("Bocker", m.BockerVersion)
+	line("Verified", m.Verified)
+	return strings.TrimRight(sb.String(), "\n")
+}
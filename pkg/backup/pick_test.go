@@ -0,0 +1,17 @@
+package backup
+
+import "testing"
+
+func TestOmittedNote(t *testing.T) {
+	for _, tt := range []struct {
+		omitted, total int
+		want           string
+	}{
+		{1, 51, "1 older backup of 51 not shown; use --limit or --since, or pass --tag."},
+		{70, 120, "70 older backups of 120 not shown; use --limit or --since, or pass --tag."},
+	} {
+		if got := omittedNote(tt.omitted, tt.total); got != tt.want {
+			t.Errorf("omittedNote(%d, %d) = %q, want %q", tt.omitted, tt.total, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/docker"
+)
+
+// Policy is a grandfather-father-son retention policy. A backup is kept if
+// any rule selects it:
+//
+//   - Last keeps the N most recent backups.
+//   - Daily keeps the newest backup of each of the last D calendar days.
+//   - Weekly keeps the newest backup of each of the last W ISO weeks.
+//   - Monthly keeps the newest backup of each of the last M calendar months.
+//
+// The windows are counted back from now and include the current day, week or
+// month.
+type Policy struct {
+	Last, Daily, Weekly, Monthly int
+}
+
+// PolicyFromConfig returns the retention policy configured on app.
+func PolicyFromConfig(app *config.Application) Policy {
+	r := app.Config.Retention
+	return Policy{Last: r.KeepLast, Daily: r.KeepDaily, Weekly: r.KeepWeekly, Monthly: r.KeepMonthly}
+}
+
+// Empty reports whether the policy has no rules at all.
+func (p Policy) Empty() bool {
+	return p.Last <= 0 && p.Daily <= 0 && p.Weekly <= 0 && p.Monthly <= 0
+}
+
+// Apply splits tags into those the policy keeps and those it removes. Only
+// tags in bocker's timestamp format are considered; anything else (manually
+// pushed tags, "latest", ...) is always kept.
+func (p Policy) Apply(tags []docker.Tag, now time.Time) (keep, remove []docker.Tag) {
+	type dated struct {
+		tag docker.Tag
+		at  time.Time
+	}
+	var backups []dated
+	for _, t := range tags {
+		at, err := time.ParseInLocation(config.DateTimeFormat, t.Name, now.Location())
+		if err != nil {
+			keep = append(keep, t)
+			continue
+		}
+		backups = append(backups, dated{t, at})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].at.After(backups[j].at) })
+
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	weekday := (int(day.Weekday()) + 6) % 7 // ISO weeks start on Monday
+	week := day.AddDate(0, 0, -weekday)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+
+	rules := []struct {
+		n      int
+		cutoff time.Time
+		bucket func(time.Time) string
+	}{
+		{p.Daily, day.AddDate(0, 0, -(p.Daily - 1)), func(t time.Time) string { return t.Format("2006-01-02") }},
+		{p.Weekly, week.AddDate(0, 0, -7*(p.Weekly-1)), func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", y, w)
+		}},
+		{p.Monthly, month.AddDate(0, -(p.Monthly - 1), 0), func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	seen := make([]map[string]bool, len(rules))
+	for i := range seen {
+		seen[i] = map[string]bool{}
+	}
+
+	for i, b := range backups {
+		kept := i < p.Last
+		for r, rule := range rules {
+			if rule.n <= 0 || b.at.Before(rule.cutoff) {
+				continue
+			}
+			key := rule.bucket(b.at)
+			if !seen[r][key] {
+				seen[r][key] = true
+				kept = true
+			}
+		}
+		if kept {
+			keep = append(keep, b.tag)
+		} else {
+			remove = append(remove, b.tag)
+		}
+	}
+	return keep, remove
+}
+
+// Prune deletes the backups the configured retention policy doesn't keep and
+// reports each decision to w, followed by the WAL files no remaining physical
+// backup needs (see obsoleteWAL). With dryRun nothing is deleted.
+func Prune(ctx context.Context, app *config.Application, dryRun bool, w io.Writer) error {
+	policy := PolicyFromConfig(app)
+	if policy.Empty() {
+		return errors.New("no retention rules given; refusing to delete every backup")
+	}
+
+	reg, err := docker.NewRegistry(app)
+	if err != nil {
+		return err
+	}
+	tags, err := reg.Tags(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	keep, remove := policy.Apply(tags, now)
+	for _, t := range keep {
+		fmt.Fprintf(w, "keep    %s\n", t.Name)
+	}
+	wal, err := reg.WALTags(ctx)
+	if err != nil {
+		return err
+	}
+	if len(wal) > 0 {
+		// Only the kept backups' formats matter here, so only their
+		// manifests are fetched.
+		if keep, err = reg.Describe(ctx, keep); err != nil {
+			return err
+		}
+		obsolete := obsoleteWAL(wal, keep, timelineParents(ctx, app, wal, keep))
+		fmt.Fprintf(w, "keep    %d WAL files\n", len(wal)-len(obsolete))
+		remove = append(remove, obsolete...)
+	}
+	for _, t := range remove {
+		if dryRun {
+			fmt.Fprintf(w, "would remove %s\n", t.Name)
+			continue
+		}
+		if err := reg.Delete(ctx, t); err != nil {
+			return fmt.Errorf("delete %s: %w", t.Name, err)
+		}
+		fmt.Fprintf(w, "removed %s\n", t.Name)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/docker"
+)
+
+func TestPolicyApply(t *testing.T) {
+	// A Friday; its ISO week started on Monday 2024-03-11.
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	tags := []docker.Tag{{Name: "latest"}}
+	for d := range 60 {
+		day := now.AddDate(0, 0, -d)
+		at := time.Date(day.Year(), day.Month(), day.Day(), 2, 0, 0, 0, time.UTC)
+		tags = append(tags, docker.Tag{Name: at.Format(config.DateTimeFormat)})
+	}
+	tags = append(tags, docker.Tag{Name: "2024-03-15_11-00-00"})
+
+	tests := []struct {
+		name   string
+		policy Policy
+		keep   []string
+	}{
+		{"none", Policy{}, []string{"latest"}},
+		{"last", Policy{Last: 3}, []string{"latest", "2024-03-15_11-00-00", "2024-03-15_02-00-00", "2024-03-14_02-00-00"}},
+		{"daily", Policy{Daily: 3}, []string{"latest", "2024-03-15_11-00-00", "2024-03-14_02-00-00", "2024-03-13_02-00-00"}},
+		{"weekly", Policy{Weekly: 2}, []string{"latest", "2024-03-15_11-00-00", "2024-03-10_02-00-00"}},
+		{"monthly", Policy{Monthly: 3}, []string{"latest", "2024-03-15_11-00-00", "2024-02-29_02-00-00", "2024-01-31_02-00-00"}},
+		// Rules overlap: the newest backup counts for all of them.
+		{"combined", Policy{Last: 1, Daily: 2, Weekly: 2, Monthly: 2}, []string{
+			"latest", "2024-03-15_11-00-00", "2024-03-14_02-00-00", "2024-03-10_02-00-00", "2024-02-29_02-00-00",
+		}},
+		// The windows end where the backups do.
+		{"longer than history", Policy{Monthly: 12}, []string{
+			"latest", "2024-03-15_11-00-00", "2024-02-29_02-00-00", "2024-01-31_02-00-00",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keep, remove := tt.policy.Apply(tags, now)
+			if got := names(keep); !reflect.DeepEqual(got, tt.keep) {
+				t.Errorf("keep = %v, want %v", got, tt.keep)
+			}
+			if len(keep)+len(remove) != len(tags) {
+				t.Errorf("kept %d and removed %d of %d tags", len(keep), len(remove), len(tags))
+			}
+		})
+	}
+}
+
+// The windows count back from now, so backups older than the last D days
+// aren't kept by Daily even if there were no backups in between.
+func TestPolicyApplyWindow(t *testing.T) {
+	now := time.Date(2024, 3, 15, 12, 0, 0, 0, time.UTC)
+	tags := []docker.Tag{{Name: "2024-03-01_02-00-00"}, {Name: "2024-02-01_02-00-00"}}
+	keep, remove := Policy{Daily: 7, Weekly: 2}.Apply(tags, now)
+	if len(keep) != 0 || len(remove) != 2 {
+		t.Fatalf("keep = %v, remove = %v; want everything removed", names(keep), names(remove))
+	}
+}
+
+func names(tags []docker.Tag) []string {
+	out := []string{}
+	for _, t := range tags {
+		out = append(out, t.Name)
+	}
+	return out
+}
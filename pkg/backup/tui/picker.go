@@ -0,0 +1,95 @@
+package tui
+
+import (
+	"charm.land/bubbles/v2/table"
+	tea "charm.land/bubbletea/v2"
+	"charm.land/lipgloss/v2"
+)
+
+var (
+	detailStyle = lipgloss.NewStyle().
+			BorderStyle(lipgloss.NormalBorder()).
+			BorderForeground(lipgloss.Color("240")).
+			Padding(0, 1).
+			Width(48)
+	promptStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("229")).Bold(true)
+	helpStyle   = lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+)
+
+// Picker is the backup table with a detail pane for the highlighted row.
+// Pressing enter asks for confirmation; once the user confirms, Selected holds
+// the chosen row index. Selected stays -1 when the user quits instead.
+type Picker struct {
+	table      table.Model
+	details    []string
+	prompt     func(row int) string
+	confirming bool
+	Selected   int
+	// Note, if set, is shown under the table, e.g. to say that older
+	// backups were left out.
+	Note string
+}
+
+// NewPicker builds a Picker. details[i] is shown next to the table while row
+// i is highlighted; prompt returns the confirmation question for a row.
+func NewPicker(columns []table.Column, rows []table.Row, details []string, prompt func(row int) string) Picker {
+	return Picker{
+		table:    NewModel(columns, rows).table,
+		details:  details,
+		prompt:   prompt,
+		Selected: -1,
+	}
+}
+
+func (p Picker) Init() tea.Cmd { return nil }
+
+func (p Picker) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if msg, ok := msg.(tea.KeyPressMsg); ok {
+		if p.confirming {
+			switch msg.String() {
+			case "y", "Y":
+				p.Selected = p.table.Cursor()
+				return p, tea.Quit
+			case "ctrl+c":
+				return p, tea.Quit
+			default:
+				p.confirming = false
+			}
+			return p, nil
+		}
+
+		switch msg.String() {
+		case "q", "esc", "ctrl+c":
+			return p, tea.Quit
+		case "enter":
+			if len(p.table.Rows()) > 0 {
+				p.confirming = true
+			}
+			return p, nil
+		}
+	}
+
+	var cmd tea.Cmd
+	p.table, cmd = p.table.Update(msg)
+	return p, cmd
+}
+
+func (p Picker) View() tea.View {
+	detail := ""
+	if c := p.table.Cursor(); c >= 0 && c < len(p.details) {
+		detail = p.details[c]
+	}
+	body := lipgloss.JoinHorizontal(lipgloss.Top,
+		baseStyle.Render(p.table.View()),
+		detailStyle.Render(detail),
+	)
+
+	footer := helpStyle.Render("↑/↓ select • enter restore • q quit")
+	if p.confirming {
+		footer = promptStyle.Render(p.prompt(p.table.Cursor()) + " [y/N]")
+	}
+	if p.Note != "" {
+		footer = helpStyle.Render(p.Note) + "\n" + footer
+	}
+	return tea.NewView(body + "\n" + footer + "\n")
+}
@@ -0,0 +1,296 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/crypt"
+	"bocker.software-services.dev/pkg/db"
+	"bocker.software-services.dev/pkg/docker"
+	"bocker.software-services.dev/pkg/logger"
+)
+
+// walFileRE matches the files PostgreSQL archives: WAL segments, timeline
+// history files, backup history files and partial segments.
+var walFileRE = regexp.MustCompile(`^[0-9A-F]{8}(\.history|[0-9A-F]{16}(\.[0-9A-F]{8}\.backup|\.partial)?)$`)
+
+func checkWALName(name string) error {
+	if !walFileRE.MatchString(name) {
+		return fmt.Errorf("%q is not a WAL file name", name)
+	}
+	return nil
+}
+
+// WALPush archives the WAL file at path under the tag wal-<name>. It is meant
+// to be PostgreSQL's archive_command, so pushing a file that is already
+// archived with the same contents succeeds; different contents are refused.
+// Encrypted WAL is compared by the checksum of its plaintext, which the push
+// records.
+func WALPush(ctx context.Context, app *config.Application, path, name string) error {
+	if err := checkWALName(name); err != nil {
+		return err
+	}
+	app.Config.Docker.Tag = docker.WALTagPrefix + name
+	app.Config.Docker.ImagePath = docker.ImagePath(app)
+	app.Config.DB.Engine = db.EnginePostgres
+	app.Config.DB.BackupFileName = name
+
+	_, manifest, _, err := docker.NewRegistryClient(app).GetManifest(ctx, app.Config.Docker.Tag)
+	switch {
+	case err == nil:
+		meta := docker.MetadataFromAnnotations(manifest.Annotations)
+		want := meta.SHA256
+		if meta.Encryption != "" {
+			want = meta.PlainSHA256
+		}
+		if want == "" {
+			return fmt.Errorf("%s is already archived without a checksum to compare it with", name)
+		}
+		sum, err := fileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if sum != want {
+			return fmt.Errorf("%s is already archived with different contents", name)
+		}
+		return nil
+	case !errors.Is(err, docker.ErrNotFound):
+		return err
+	}
+
+	return docker.PushStream(ctx, app, []docker.StreamFile{{Name: name, Write: func(ctx context.Context, w io.Writer) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}}})
+}
+
+// WALFetch restores the archived WAL file name to dest. It is meant to be
+// PostgreSQL's restore_command, which also asks for files that were never
+// archived; those fail with an error wrapping docker.ErrNotFound.
+func WALFetch(ctx context.Context, app *config.Application, name, dest string) error {
+	if err := checkWALName(name); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return fmt.Errorf("create tmp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	app.Config.TmpDir = tmpDir
+	app.Config.Docker.Tag = docker.WALTagPrefix + name
+	app.Config.Docker.ImagePath = docker.ImagePath(app)
+
+	if err := docker.Unpack(ctx, app); err != nil {
+		return err
+	}
+	if app.Config.Encryption.Mode != "" {
+		ids, err := crypt.Identities(app)
+		if err != nil {
+			return err
+		}
+		if err := crypt.DecryptFiles(ids, tmpDir, app.Config.DB.BackupFileName); err != nil {
+			return err
+		}
+	}
+	return copyFile(filepath.Join(tmpDir, app.Config.DB.BackupFileName), dest)
+}
+
+// walSegment is the position of a WAL file: the timeline it was written on
+// and the log and segment number of its segment. Partial segments and backup
+// history files count as the segment their name starts with.
+type walSegment struct {
+	timeline, log, seg uint32
+}
+
+// parseWALSegment parses the segment a WAL file name starts with. Timeline
+// history files name no segment and are reported as not ok.
+func parseWALSegment(name string) (walSegment, bool) {
+	if !walFileRE.MatchString(name) || strings.HasSuffix(name, ".history") {
+		return walSegment{}, false
+	}
+	var s walSegment
+	for i, p := range []*uint32{&s.timeline, &s.log, &s.seg} {
+		v, err := strconv.ParseUint(name[8*i:8*i+8], 16, 32)
+		if err != nil {
+			return walSegment{}, false
+		}
+		*p = uint32(v)
+	}
+	return s, true
+}
+
+// before reports whether s comes before o on the same timeline.
+func (s walSegment) before(o walSegment) bool {
+	return s.log < o.log || s.log == o.log && s.seg < o.seg
+}
+
+// historyName is the name of the history file of timeline tli.
+func historyName(tli uint32) string {
+	return fmt.Sprintf("%08X.history", tli)
+}
+
+// parseTimelineHistory returns the ancestors listed in a timeline history
+// file. Each line holds a parent timeline, in decimal, the position it was
+// left at and the reason; '#' starts a comment.
+func parseTimelineHistory(r io.Reader) ([]uint32, error) {
+	var parents []uint32
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tli, err := strconv.ParseUint(strings.Fields(line)[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeline history line %q", line)
+		}
+		parents = append(parents, uint32(tli))
+	}
+	return parents, sc.Err()
+}
+
+// timelineParents fetches the history files of the timelines the physical
+// backups in keep are on, keyed by timeline. A history file that is missing
+// or cannot be read leaves its timeline out, which only makes obsoleteWAL
+// keep more.
+func timelineParents(ctx context.Context, app *config.Application, wal, keep []docker.Tag) map[uint32][]uint32 {
+	archived := map[string]bool{}
+	for _, t := range wal {
+		archived[strings.TrimPrefix(t.Name, docker.WALTagPrefix)] = true
+	}
+	parents := map[uint32][]uint32{}
+	for _, t := range keep {
+		start, ok := parseWALSegment(t.Metadata.WALStart)
+		if !ok || start.timeline == 1 {
+			continue
+		}
+		name := historyName(start.timeline)
+		if _, done := parents[start.timeline]; done || !archived[name] {
+			continue
+		}
+		tli, err := fetchTimelineHistory(ctx, app, name)
+		if err != nil {
+			logger.LogCommand(fmt.Sprintf("reading %s failed, keeping the WAL of older timelines: %v", name, err))
+			continue
+		}
+		parents[start.timeline] = tli
+	}
+	return parents
+}
+
+func fetchTimelineHistory(ctx context.Context, app *config.Application, name string) ([]uint32, error) {
+	dir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return nil, fmt.Errorf("create tmp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// WALFetch points app at the WAL tag; the caller's app stays as it was.
+	fetch := *app
+	dest := filepath.Join(dir, name)
+	if err := WALFetch(ctx, &fetch, name, dest); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(dest)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseTimelineHistory(f)
+}
+
+// obsoleteWAL returns the WAL files no physical backup in keep can need
+// anymore: those from before the segment a backup starts in, on the
+// backup's timeline or one of its ancestors in parents, for every such
+// backup. WAL on other timelines, which a restore may follow, is kept, and
+// so are timeline history files. Without a physical backup, or with one that
+// doesn't record its start, every WAL file is kept.
+func obsoleteWAL(wal, keep []docker.Tag, parents map[uint32][]uint32) []docker.Tag {
+	type line struct {
+		start     walSegment
+		timelines map[uint32]bool
+	}
+	var backups []line
+	for _, t := range keep {
+		if t.Metadata.Format != db.FormatBaseBackup {
+			continue
+		}
+		start, ok := parseWALSegment(t.Metadata.WALStart)
+		if !ok {
+			return nil
+		}
+		l := line{start: start, timelines: map[uint32]bool{start.timeline: true}}
+		for _, p := range parents[start.timeline] {
+			l.timelines[p] = true
+		}
+		backups = append(backups, l)
+	}
+	if len(backups) == 0 {
+		return nil
+	}
+
+	var out []docker.Tag
+	for _, t := range wal {
+		seg, ok := parseWALSegment(strings.TrimPrefix(t.Name, docker.WALTagPrefix))
+		if !ok {
+			continue
+		}
+		obsolete := true
+		for _, b := range backups {
+			if !b.timelines[seg.timeline] || !seg.before(b.start) {
+				obsolete = false
+				break
+			}
+		}
+		if obsolete {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
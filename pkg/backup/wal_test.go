@@ -0,0 +1,142 @@
+package backup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"bocker.software-services.dev/pkg/db"
+	"bocker.software-services.dev/pkg/docker"
+)
+
+func physical(walStart string) docker.Tag {
+	return docker.Tag{Name: "2024-03-15_02-00-00", Metadata: docker.Metadata{Format: db.FormatBaseBackup, WALStart: walStart}}
+}
+
+func walTags(names ...string) []docker.Tag {
+	tags := make([]docker.Tag, len(names))
+	for i, n := range names {
+		tags[i] = docker.Tag{Name: docker.WALTagPrefix + n}
+	}
+	return tags
+}
+
+func TestObsoleteWAL(t *testing.T) {
+	tests := []struct {
+		name     string
+		keep     []docker.Tag
+		parents  map[uint32][]uint32
+		wal      []string
+		obsolete []string
+	}{
+		{
+			name: "no physical backup kept",
+			keep: []docker.Tag{{Name: "2024-03-15_02-00-00", Metadata: docker.Metadata{Format: "custom"}}},
+			wal:  []string{"000000010000000000000001", "000000010000000000000002"},
+		},
+		{
+			name: "start not recorded",
+			keep: []docker.Tag{physical("000000010000000000000010"), physical("")},
+			wal:  []string{"000000010000000000000001"},
+		},
+		{
+			name: "same timeline",
+			keep: []docker.Tag{physical("000000010000000100000002")},
+			wal: []string{
+				"000000010000000100000001", "000000010000000100000002", "000000010000000100000003",
+				// The log number counts before the segment.
+				"0000000100000000000000FF", "000000010000000200000000",
+			},
+			obsolete: []string{"000000010000000100000001", "0000000100000000000000FF"},
+		},
+		{
+			name:     "oldest backup decides",
+			keep:     []docker.Tag{physical("000000010000000000000030"), physical("000000010000000000000010")},
+			wal:      []string{"000000010000000000000005", "000000010000000000000020"},
+			obsolete: []string{"000000010000000000000005"},
+		},
+		{
+			name: "partial and backup history files",
+			keep: []docker.Tag{physical("000000010000000000000010")},
+			wal: []string{
+				"00000001000000000000000F.partial", "000000010000000000000010.partial",
+				"00000001000000000000000E.00000028.backup", "000000010000000000000010.00000028.backup",
+			},
+			obsolete: []string{"00000001000000000000000F.partial", "00000001000000000000000E.00000028.backup"},
+		},
+		{
+			name:     "history files are kept",
+			keep:     []docker.Tag{physical("000000020000000000000040")},
+			parents:  map[uint32][]uint32{2: {1}},
+			wal:      []string{"00000002.history", "00000001000000000000003F"},
+			obsolete: []string{"00000001000000000000003F"},
+		},
+		{
+			name:    "timeline switch",
+			keep:    []docker.Tag{physical("000000020000000000000040")},
+			parents: map[uint32][]uint32{2: {1}},
+			wal: []string{
+				// Timeline 1 before the backup started can go, but not its
+				// segments from after that position.
+				"000000010000000000000030", "000000010000000000000050",
+				"00000002000000000000003F", "000000020000000000000040",
+				// Timeline 3 isn't an ancestor; a recovery may follow it.
+				"000000030000000000000010",
+			},
+			obsolete: []string{"000000010000000000000030", "00000002000000000000003F"},
+		},
+		{
+			name:     "unknown ancestors",
+			keep:     []docker.Tag{physical("000000020000000000000040")},
+			wal:      []string{"000000010000000000000010", "000000020000000000000010"},
+			obsolete: []string{"000000020000000000000010"},
+		},
+		{
+			name:    "backups on different timelines",
+			keep:    []docker.Tag{physical("000000010000000000000010"), physical("000000020000000000000040")},
+			parents: map[uint32][]uint32{2: {1}},
+			wal: []string{
+				"000000010000000000000005", "000000010000000000000020",
+				// Timeline 2 branched off after the older backup, whose
+				// recovery can follow it.
+				"000000020000000000000020",
+			},
+			obsolete: []string{"000000010000000000000005"},
+		},
+		{
+			name:     "not WAL file names",
+			keep:     []docker.Tag{physical("000000010000000000000010")},
+			wal:      []string{"latest", "0000000100000000000000", "00000001000000000000000g"},
+			obsolete: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := names(obsoleteWAL(walTags(tt.wal...), tt.keep, tt.parents))
+			want := names(walTags(tt.obsolete...))
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("obsolete = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseTimelineHistory(t *testing.T) {
+	history := `1	0/3000158	no recovery target specified
+
+# promoted by hand
+2	0/5000000	before 2024-03-15 02:00:00+00
+10	1/A0000000	at restore point "x"
+`
+	got, err := parseTimelineHistory(strings.NewReader(history))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{1, 2, 10}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("parents = %v, want %v", got, want)
+	}
+
+	if _, err := parseTimelineHistory(strings.NewReader("A\t0/3000158\tx\n")); err == nil {
+		t.Fatal("hexadecimal timeline accepted")
+	}
+}
@@ -1,34 +1,66 @@
 package config
 
 import (
-	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
 	"time"
 
 	tui "bocker.software-services.dev/pkg/config/tui/setup"
+	"bocker.software-services.dev/pkg/logger"
 	tea "charm.land/bubbletea/v2"
-	"github.com/adrg/xdg"
 	"github.com/zalando/go-keyring"
-	"gopkg.in/yaml.v3"
 )
 
 const AppName = "bocker"
 const cfgFile = "config.yaml"
 
+// DateTimeFormat is the layout of the timestamp bocker tags backups with.
+const DateTimeFormat = "2006-01-02_15-04-05"
+
+// EncryptionService is the keyring service holding the backup encryption key:
+// either an age identity (AGE-SECRET-KEY-...) or a passphrase.
+const EncryptionService = AppName + "-encryption"
+
+// Compression algorithms for backup layers.
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
 type config struct {
 	Docker struct {
-		Namespace   string
-		Repository  string
-		Tag         string
-		Username    string
-		Password    string
-		Host        string
-		ImagePath   string
-		ContainerID string
+		Namespace  string
+		Repository string
+		Tag        string
+		Username   string
+		Password   string
+		Registry   string
+		MountFrom  string
+		// ChunkSize is the uncompressed size of each backup layer in bytes;
+		// zero means docker.DefaultChunkSize.
+		ChunkSize int64
+		// Dedup splits backups at content-defined boundaries so unchanged
+		// data maps to blobs the registry already has.
+		Dedup bool
+		// Compression is one of the Compression* algorithms, empty meaning
+		// gzip; CompressionLevel 0 is the algorithm's default level.
+		Compression      string
+		CompressionLevel int
+		ImagePath        string
+		ContainerID      string
+		// Volume receives the data directory of a physical restore.
+		Volume string
 	}
 	DB struct {
+		// Engine selects the database engine from pkg/db, e.g. "postgres".
+		Engine string
+		// Mode is db.ModeLogical or db.ModePhysical for backups.
+		Mode string
+		// Format is the dump format, e.g. "custom" or "directory" for
+		// postgres; Jobs the number of parallel dump or restore workers.
+		Format         string
+		Jobs           int
 		SourceName     string
 		TargetName     string
 		User           string
@@ -37,46 +69,81 @@ type config struct {
 		DateTime       string
 		BackupFileName string
 		RolesFileName  string
+		ServerVersion  string
+		DumpVersion    string
 		ExportRoles    bool
 		ImportRoles    bool
-	}
+		// ExitOnError restores into a fresh database and fails on the first
+		// error instead of cleaning the target and ignoring errors.
+		ExitOnError bool
+		// Schemas, Tables and their Exclude* counterparts limit a dump to part
+		// of the database; on restore only Schemas and Tables apply.
+		Schemas          []string
+		ExcludeSchemas   []string
+		Tables           []string
+		ExcludeTables    []string
+		ExcludeTableData []string
+		// UseList is a pg_restore list file (pg_restore -l) selecting and
+		// ordering the items to restore.
+		UseList string
+		// DataDir receives the data directory of a physical restore.
+		DataDir string
+		// TargetTime, if set, makes a physical restore recover up to this
+		// point in time from the archived WAL.
+		TargetTime time.Time
+		// WALStart is the WAL file a physical backup starts in.
+		WALStart string
+	}
+	Encryption struct {
+		// Recipients are age X25519 public keys to encrypt backups to.
+		Recipients []string
+		// Passphrase encrypts with the stored encryption key via scrypt.
+		Passphrase bool
+		// IdentityFile holds the age identities used to decrypt on restore.
+		IdentityFile string
+		// Mode is set once a backup has been encrypted (see package crypt).
+		Mode string
+	}
+	Retention struct {
+		KeepLast    int
+		KeepDaily   int
+		KeepWeekly  int
+		KeepMonthly int
+	}
+	// Profile is the config.yaml profile in use, if any.
+	Profile string
+	// Stream pipes the dump straight into the registry upload instead of
+	// going through files in TmpDir.
+	Stream     bool
 	TmpDir     string
 	DaemonMode bool
 }
 
 type Application struct {
 	Config config
+	// Version is the bocker release, recorded in the metadata of new backups.
+	Version string
 }
 
 type Username struct {
 	Username string `yaml:"username,omitempty"`
 }
 
-// Setup populates runtime fields (credentials, Docker host, timestamp) on the
-// Application. It mutates the receiver; call on a *Application shared with the
-// rest of the program.
+// Setup populates runtime fields (credentials for the configured registry,
+// timestamp) on the Application. It mutates the receiver; call on
+// a *Application shared with the rest of the program.
 func (app *Application) Setup() error {
-	cfg, err := GetUsername()
+	cred, err := RegistryCredential(app.Config.Docker.Registry)
 	if err != nil {
-		return fmt.Errorf("read config: %w (try running `bocker config` to fix)", err)
-	}
-	if cfg.Username == "" {
-		return errors.New("username not set; run `bocker config` first")
-	}
-	app.Config.Docker.Username = cfg.Username
-
-	app.Config.Docker.Password, err = GetKey(AppName)
-	if err != nil {
-		return fmt.Errorf("read keyring: %w", err)
+		return err
 	}
-
-	if host, ok := os.LookupEnv("DOCKER_HOST"); ok {
-		app.Config.Docker.Host = host
-	} else {
-		app.Config.Docker.Host = "https://hub.docker.com"
+	if cred.DockerError != nil {
+		logger.LogCommand(fmt.Sprintf("%v; using %s credentials instead", cred.DockerError, cred.Source))
 	}
+	app.Config.Docker.Username = cred.Username
+	app.Config.Docker.Password = cred.Secret
 
-	app.Config.DB.DateTime = time.Now().Format("2006-01-02_15-04-05")
+	app.Config.DB.DateTime = time.Now().Format(DateTimeFormat)
 	return nil
 }
 
@@ -101,74 +168,42 @@ func GetKey(service string) (string, error) {
 	return secret, nil
 }
 
-// GetUsername from configuration stored on the disk
-func GetUsername() (*Username, error) {
-	var username Username
-
-	if os.Getenv("DOCKER_USERNAME") != "" {
-		return &Username{Username: os.Getenv("DOCKER_USERNAME")}, nil
+// GetEncryptionKey returns the backup encryption key from
+// BOCKER_ENCRYPTION_KEY or the OS keyring.
+func GetEncryptionKey() (string, error) {
+	if key := os.Getenv("BOCKER_ENCRYPTION_KEY"); key != "" {
+		return key, nil
 	}
 
-	dir, err := xdg.ConfigFile(AppName)
+	secret, err := keyring.Get(EncryptionService, AppName)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("keyring get: %w", err)
 	}
-	fullPath := filepath.Join(dir, cfgFile)
+	return secret, nil
+}
 
-	data, err := os.ReadFile(fullPath)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return &Username{}, nil
-		}
-		return nil, err
+// GetUsername from configuration stored on the disk. Unknown keys in
+// config.yaml are tolerated here; LoadFile reports them where profiles are
+// used.
+func GetUsername() (*Username, error) {
+	if os.Getenv("DOCKER_USERNAME") != "" {
+		return &Username{Username: os.Getenv("DOCKER_USERNAME")}, nil
 	}
 
-	err = yaml.Unmarshal(data, &username)
+	f, err := loadFile(false)
 	if err != nil {
 		return nil, err
 	}
-
-	return &username, nil
+	return &Username{Username: f.Username}, nil
 }
 
-// SetUsername writes the docker username to the disk
+// SetUsername writes the docker username to the disk, keeping the profiles
+// and other settings in the file.
 func SetUsername(username string) error {
-	creds, err := GetUsername()
-	if err != nil {
-		return err
-	}
-	if username != "" {
-		creds.Username = username
-	}
-
-	fullPath, err := xdg.ConfigFile(AppName)
-	if err != nil {
-		return err
-	}
-	err = os.MkdirAll(fullPath, 0700)
-	if err != nil {
-		return err
-	}
-
-	f, err := os.OpenFile(filepath.Join(fullPath, cfgFile), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		return err
-	}
-
-	data, err := yaml.Marshal(&creds)
-	if err != nil {
-		return err
-	}
-
-	if _, err := f.Write(data); err != nil {
-		f.Close() // ignore error; SetUsername error takes precedence
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
+	if username == "" {
+		return nil
 	}
-
-	return nil
+	return setFileKey("username", username)
 }
 
 // ConfigTui starts the Bubbletea Configuration TUI
@@ -0,0 +1,248 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dockerHubServer is the key `docker login` stores Docker Hub credentials
+// under.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// credentialHelperTimeout bounds a docker-credential helper run, so one
+// waiting for input that never comes cannot hang bocker.
+const credentialHelperTimeout = 30 * time.Second
+
+// credentialsNotFound is what the docker-credential-helpers print when they
+// hold nothing for a server.
+const credentialsNotFound = "credentials not found in native keychain"
+
+// Sources of registry credentials, see RegistryCredential.
+const (
+	CredentialEnv     = "env"
+	CredentialDocker  = "docker config"
+	CredentialKeyring = "keyring"
+)
+
+// Credential is a registry login and where it was found.
+type Credential struct {
+	Username string
+	Secret   string
+	// Source is one of the Credential* sources or the name of the
+	// docker-credential helper that returned it.
+	Source string
+	// DockerError says why the credentials `docker login` saved could not
+	// be used, if they were passed over for bocker's own.
+	DockerError error
+}
+
+// dockerConfig is the part of the Docker CLI's config.json holding
+// credentials.
+type dockerConfig struct {
+	Auths map[string]struct {
+		Auth          string `json:"auth"`
+		Username      string `json:"username"`
+		Password      string `json:"password"`
+		IdentityToken string `json:"identitytoken"`
+	} `json:"auths"`
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// RegistryCredential finds the login for registry. DOCKER_USERNAME and
+// DOCKER_PASSWORD win if either is set; otherwise the credentials `docker
+// login` saved for registry are used, and without those, or if they cannot
+// be read, the username from config.yaml with the password from the keyring.
+// In the last case DockerError of the result tells why docker's credentials
+// were passed over; should bocker have none either, it is part of the error.
+func RegistryCredential(registry string) (*Credential, error) {
+	_, user := os.LookupEnv("DOCKER_USERNAME")
+	_, pw := os.LookupEnv("DOCKER_PASSWORD")
+	var dockerErr error
+	if !user && !pw {
+		// A broken helper or a config.json copied from another machine
+		// shouldn't stop bocker from using its own credentials.
+		cred, err := DockerCredential(registry)
+		if cred != nil {
+			return cred, nil
+		}
+		if err != nil {
+			dockerErr = fmt.Errorf("read docker credentials: %w", err)
+		}
+	}
+	fail := func(err error) (*Credential, error) {
+		return nil, errors.Join(dockerErr, err)
+	}
+
+	cfg, err := GetUsername()
+	if err != nil {
+		return fail(fmt.Errorf("read config: %w (try running `bocker config` to fix)", err))
+	}
+	if cfg.Username == "" {
+		return fail(errors.New("username not set; run `bocker config` or `docker login` first"))
+	}
+	cred := &Credential{Username: cfg.Username, Source: CredentialKeyring, DockerError: dockerErr}
+	if user || pw {
+		cred.Source = CredentialEnv
+	}
+	cred.Secret, err = GetKey(AppName)
+	if err != nil {
+		return fail(fmt.Errorf("read keyring: %w", err))
+	}
+	return cred, nil
+}
+
+// DockerCredential returns the credentials the Docker CLI has for registry,
+// or nil if it has none. Like docker, it asks the credHelpers entry for the
+// registry or else the credsStore helper, and falls back to the auths saved
+// in config.json; should neither yield credentials, the helper's error is
+// returned.
+func DockerCredential(registry string) (*Credential, error) {
+	path, err := dockerConfigPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfg dockerConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	server := dockerServer(registry)
+	helper := cfg.CredsStore
+	if h, ok := lookupServer(cfg.CredHelpers, server); ok {
+		helper = h
+	}
+	var helperErr error
+	if helper != "" {
+		cred, err := credentialHelper(helper, server)
+		if cred != nil {
+			return cred, nil
+		}
+		helperErr = err
+	}
+
+	a, ok := lookupServer(cfg.Auths, server)
+	if !ok {
+		return nil, helperErr
+	}
+	cred := &Credential{Username: a.Username, Secret: a.Password, Source: CredentialDocker}
+	if a.Auth != "" {
+		b, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid auth for %s: %w", path, server, err)
+		}
+		var found bool
+		cred.Username, cred.Secret, found = strings.Cut(string(b), ":")
+		if !found {
+			return nil, fmt.Errorf("%s: invalid auth for %s", path, server)
+		}
+	}
+	if cred.Secret == "" {
+		if a.IdentityToken != "" {
+			return nil, fmt.Errorf("%s holds an identity token for %s, which bocker cannot use; log in with a username and access token instead", path, server)
+		}
+		return nil, helperErr
+	}
+	return cred, nil
+}
+
+// credentialHelper runs docker-credential-<helper> get for server. It
+// returns nil if the helper holds no credentials for it.
+func credentialHelper(helper, server string) (*Credential, error) {
+	name := "docker-credential-" + helper
+	ctx, cancel := context.WithTimeout(context.Background(), credentialHelperTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, name, "get")
+	cmd.Stdin = strings.NewReader(server)
+	out, err := cmd.Output()
+	if err != nil {
+		// The helpers report errors on stdout.
+		msg := strings.TrimSpace(string(out))
+		if msg == credentialsNotFound {
+			return nil, nil
+		}
+		var exitErr *exec.ExitError
+		if msg == "" && errors.As(err, &exitErr) {
+			msg = strings.TrimSpace(string(exitErr.Stderr))
+		}
+		if msg != "" {
+			return nil, fmt.Errorf("%s get: %w: %s", name, err, msg)
+		}
+		return nil, fmt.Errorf("%s get: %w", name, err)
+	}
+
+	var resp struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("%s get: %w", name, err)
+	}
+	if resp.Username == "<token>" {
+		return nil, fmt.Errorf("%s returned an identity token for %s, which bocker cannot use; log in with a username and access token instead", name, server)
+	}
+	return &Credential{Username: resp.Username, Secret: resp.Secret, Source: name}, nil
+}
+
+// dockerConfigPath is config.json in $DOCKER_CONFIG or ~/.docker.
+func dockerConfigPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// dockerServer maps a registry host to the server address `docker login`
+// keys its credentials by.
+func dockerServer(registry string) string {
+	switch host := serverHost(registry); host {
+	case "", "docker.io", "index.docker.io", "registry-1.docker.io", "hub.docker.com":
+		return dockerHubServer
+	default:
+		return host
+	}
+}
+
+// serverHost strips the scheme and path from a server address; older
+// versions of docker saved URLs rather than hosts.
+func serverHost(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	host, _, _ := strings.Cut(server, "/")
+	return host
+}
+
+// lookupServer returns the entry of m for server, matching keys by host if
+// there is none under server itself.
+func lookupServer[T any](m map[string]T, server string) (T, bool) {
+	if v, ok := m[server]; ok {
+		return v, true
+	}
+	host := serverHost(server)
+	for k, v := range m {
+		if serverHost(k) == host {
+			return v, true
+		}
+	}
+	var zero T
+	return zero, false
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/adrg/xdg"
+	"github.com/zalando/go-keyring"
+)
+
+// fakeHelper is docker-credential-fake, answering by server address.
+const fakeHelper = `#!/bin/sh
+read -r server
+case "$server" in
+https://index.docker.io/v1/) echo '{"Username":"hubuser","Secret":"hubpw"}' ;;
+ghcr.io) echo '{"Username":"<token>","Secret":"refresh"}' ;;
+broken.example) echo 'helper crashed' >&2; exit 2 ;;
+*) echo 'credentials not found in native keychain'; exit 1 ;;
+esac
+`
+
+// fakeDocker points DOCKER_CONFIG at a config.json holding cfg and puts
+// docker-credential-fake on PATH.
+func fakeDocker(t *testing.T, cfg string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(cfg), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-fake"), []byte(fakeHelper), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DOCKER_CONFIG", dir)
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// configHome gives the test its own, empty config directory.
+func configHome(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Cleanup(xdg.Reload)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	xdg.Reload()
+	return filepath.Join(dir, AppName, cfgFile)
+}
+
+func TestDockerCredential(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("authuser:authpw"))
+	helpers := `{
+		"credsStore": "fake",
+		"credHelpers": {"plain.example": "missing"},
+		"auths": {
+			"http://old.example/v2/": {"username": "olduser", "password": "oldpw"},
+			"tok.example": {"identitytoken": "refresh"}
+		}
+	}`
+	auths := `{"auths": {
+		"https://index.docker.io/v1/": {"auth": "` + auth + `"},
+		"registry.example:5000": {"username": "user", "password": "pw"},
+		"bad.example": {"auth": "not base64"}
+	}}`
+
+	tests := []struct {
+		name, config, registry string
+		user, secret, source   string
+		err                    string
+	}{
+		{"helper", helpers, "docker.io", "hubuser", "hubpw", "docker-credential-fake", ""},
+		{"hub aliases", helpers, "registry-1.docker.io", "hubuser", "hubpw", "docker-credential-fake", ""},
+		{"helper has none", helpers, "other.example", "", "", "", ""},
+		{"auths after helper", helpers, "old.example", "olduser", "oldpw", CredentialDocker, ""},
+		{"identity token from helper", helpers, "ghcr.io", "", "", "", "identity token"},
+		{"identity token in auths", helpers, "tok.example", "", "", "", "identity token"},
+		{"failing helper", helpers, "broken.example", "", "", "", "helper crashed"},
+		{"missing helper", helpers, "plain.example", "", "", "", "docker-credential-missing"},
+		{"auth field", auths, "docker.io", "authuser", "authpw", CredentialDocker, ""},
+		{"host with port", auths, "registry.example:5000", "user", "pw", CredentialDocker, ""},
+		{"invalid auth", auths, "bad.example", "", "", "", "invalid auth"},
+		{"no entry", auths, "ghcr.io", "", "", "", ""},
+		{"invalid json", `{"auths":`, "docker.io", "", "", "", "parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeDocker(t, tt.config)
+			cred, err := DockerCredential(tt.registry)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want one mentioning %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.user == "" {
+				if cred != nil {
+					t.Fatalf("got %+v, want no credentials", cred)
+				}
+				return
+			}
+			if cred == nil || cred.Username != tt.user || cred.Secret != tt.secret || cred.Source != tt.source {
+				t.Fatalf("got %+v, want %s:%s from %s", cred, tt.user, tt.secret, tt.source)
+			}
+		})
+	}
+}
+
+func TestDockerCredentialNoConfig(t *testing.T) {
+	t.Setenv("DOCKER_CONFIG", t.TempDir())
+	cred, err := DockerCredential("docker.io")
+	if cred != nil || err != nil {
+		t.Fatalf("got %+v, %v; want nothing", cred, err)
+	}
+}
+
+func TestRegistryCredential(t *testing.T) {
+	keyring.MockInit()
+	path := configHome(t)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("username: bockeruser\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetKey(AppName, "bockerpw"); err != nil {
+		t.Fatal(err)
+	}
+	fakeDocker(t, `{"credsStore": "fake"}`)
+
+	cred, err := RegistryCredential("docker.io")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Username != "hubuser" || cred.DockerError != nil {
+		t.Fatalf("got %+v, want docker's credentials", cred)
+	}
+
+	// A failing helper falls back to bocker's own, saying why.
+	cred, err = RegistryCredential("broken.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Username != "bockeruser" || cred.Secret != "bockerpw" || cred.Source != CredentialKeyring {
+		t.Fatalf("got %+v, want the keyring credentials", cred)
+	}
+	if cred.DockerError == nil || !strings.Contains(cred.DockerError.Error(), "helper crashed") {
+		t.Fatalf("DockerError = %v, want the helper's error", cred.DockerError)
+	}
+
+	// The environment wins without asking docker at all.
+	t.Setenv("DOCKER_USERNAME", "envuser")
+	t.Setenv("DOCKER_PASSWORD", "envpw")
+	cred, err = RegistryCredential("broken.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Username != "envuser" || cred.Secret != "envpw" || cred.Source != CredentialEnv || cred.DockerError != nil {
+		t.Fatalf("got %+v, want the environment's credentials", cred)
+	}
+}
+
+func TestRegistryCredentialNone(t *testing.T) {
+	keyring.MockInit()
+	configHome(t)
+	fakeDocker(t, `{"credsStore": "fake"}`)
+	_, err := RegistryCredential("broken.example")
+	if err == nil || !strings.Contains(err.Error(), "helper crashed") || !strings.Contains(err.Error(), "username not set") {
+		t.Fatalf("err = %v, want both the docker and the bocker error", err)
+	}
+}
+
+func TestLookupServer(t *testing.T) {
+	m := map[string]string{
+		"https://index.docker.io/v1/": "hub",
+		"http://old.example/v2/":      "old",
+		"registry.example:5000":       "port",
+	}
+	tests := []struct {
+		server, want string
+	}{
+		{"https://index.docker.io/v1/", "hub"},
+		{"old.example", "old"},
+		{"https://old.example", "old"},
+		{"registry.example:5000", "port"},
+		{"registry.example", ""},
+		{"other.example", ""},
+	}
+	for _, tt := range tests {
+		got, ok := lookupServer(m, tt.server)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("lookupServer(%q) = %q, %v; want %q", tt.server, got, ok, tt.want)
+		}
+	}
+
+	for registry, want := range map[string]string{
+		"":                     dockerHubServer,
+		"docker.io":            dockerHubServer,
+		"registry-1.docker.io": dockerHubServer,
+		"ghcr.io":              "ghcr.io",
+		"https://ghcr.io/v2/":  "ghcr.io",
+		"localhost:5000":       "localhost:5000",
+	} {
+		if got := dockerServer(registry); got != want {
+			t.Errorf("dockerServer(%q) = %q, want %q", registry, got, want)
+		}
+	}
+}
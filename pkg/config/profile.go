@@ -0,0 +1,254 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/adrg/xdg"
+	"gopkg.in/yaml.v3"
+)
+
+// File is the content of config.yaml: the registry username and named
+// profiles of settings, one of which may be used when --profile is not given.
+type File struct {
+	Username       string             `yaml:"username,omitempty"`
+	DefaultProfile string             `yaml:"default-profile,omitempty"`
+	Profiles       map[string]Profile `yaml:"profiles,omitempty"`
+}
+
+// Profile is a named set of settings. Its keys are the names of the flags
+// they stand in for, and each can be overridden by the flag or by the
+// environment variable EnvName(key).
+type Profile struct {
+	Registry    string   `yaml:"registry,omitempty"`
+	Namespace   string   `yaml:"namespace,omitempty"`
+	Repository  string   `yaml:"repository,omitempty"`
+	Engine      string   `yaml:"engine,omitempty"`
+	DBHost      string   `yaml:"db-host,omitempty"`
+	DBUser      string   `yaml:"db-user,omitempty"`
+	DBSource    string   `yaml:"db-source,omitempty"`
+	ContainerID string   `yaml:"container-id,omitempty"`
+	Recipients  []string `yaml:"recipient,omitempty"`
+	Passphrase  bool     `yaml:"passphrase,omitempty"`
+	Identity    string   `yaml:"identity,omitempty"`
+	KeepLast    int      `yaml:"keep-last,omitempty"`
+	KeepDaily   int      `yaml:"keep-daily,omitempty"`
+	KeepWeekly  int      `yaml:"keep-weekly,omitempty"`
+	KeepMonthly int      `yaml:"keep-monthly,omitempty"`
+}
+
+// Setting is one profile key with its value from the profile, if any.
+type Setting struct {
+	Key string
+	// Flags are the flags the setting fills in: the one named Key, and
+	// db-owner for db-user since restore calls the database user that.
+	Flags  []string
+	Values []string
+}
+
+// Settings lists every key a profile can hold, in a fixed order, with p's
+// values.
+func (p Profile) Settings() []Setting {
+	str := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return []string{s}
+	}
+	num := func(n int) []string {
+		if n == 0 {
+			return nil
+		}
+		return []string{strconv.Itoa(n)}
+	}
+	flag := func(b bool) []string {
+		if !b {
+			return nil
+		}
+		return []string{"true"}
+	}
+	settings := []Setting{
+		{Key: "registry", Values: str(p.Registry)},
+		{Key: "namespace", Values: str(p.Namespace)},
+		{Key: "repository", Values: str(p.Repository)},
+		{Key: "engine", Values: str(p.Engine)},
+		{Key: "db-host", Values: str(p.DBHost)},
+		{Key: "db-user", Flags: []string{"db-user", "db-owner"}, Values: str(p.DBUser)},
+		{Key: "db-source", Values: str(p.DBSource)},
+		{Key: "container-id", Values: str(p.ContainerID)},
+		{Key: "recipient", Values: p.Recipients},
+		{Key: "passphrase", Values: flag(p.Passphrase)},
+		{Key: "identity", Values: str(p.Identity)},
+		{Key: "keep-last", Values: num(p.KeepLast)},
+		{Key: "keep-daily", Values: num(p.KeepDaily)},
+		{Key: "keep-weekly", Values: num(p.KeepWeekly)},
+		{Key: "keep-monthly", Values: num(p.KeepMonthly)},
+	}
+	for i := range settings {
+		if settings[i].Flags == nil {
+			settings[i].Flags = []string{settings[i].Key}
+		}
+	}
+	return settings
+}
+
+// EnvName is the environment variable overriding the setting key, e.g.
+// BOCKER_DB_HOST for db-host. Lists such as recipient are comma-separated.
+func EnvName(key string) string {
+	return "BOCKER_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// Profile returns the profile called name, or the default profile if name is
+// empty. Without either it returns an empty profile and name.
+func (f *File) Profile(name string) (string, Profile, error) {
+	if name == "" {
+		name = f.DefaultProfile
+	}
+	if name == "" {
+		return "", Profile{}, nil
+	}
+	p, ok := f.Profiles[name]
+	if !ok {
+		return "", Profile{}, fmt.Errorf("profile %q not found in %s", name, cfgFile)
+	}
+	return name, p, nil
+}
+
+// filePath is where config.yaml lives.
+func filePath() (string, error) {
+	dir, err := xdg.ConfigFile(AppName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, cfgFile), nil
+}
+
+// LoadFile reads config.yaml. A missing file is an empty one; unknown keys
+// are errors so a misspelt setting is not silently ignored. Only commands
+// that take settings from profiles load it this way, so a typo cannot lock
+// the user out of `bocker config set`.
+func LoadFile() (*File, error) {
+	return loadFile(true)
+}
+
+func loadFile(strict bool) (*File, error) {
+	path, data, err := readFile()
+	if err != nil {
+		return nil, err
+	}
+	var f File
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(strict)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &f, nil
+}
+
+// readFile returns the path and contents of config.yaml; a missing file has
+// none.
+func readFile() (string, []byte, error) {
+	path, err := filePath()
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", nil, err
+	}
+	return path, data, nil
+}
+
+// setFileKey sets the top-level key of config.yaml to value. The file is
+// edited as a YAML document rather than decoded into File, so profiles,
+// comments and keys bocker doesn't know all survive. It is written readable
+// by the owner only.
+func setFileKey(key, value string) error {
+	path, data, err := readFile()
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if doc.Kind == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: expected a mapping at the top level", path)
+	}
+	var node *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == key {
+			node = root.Content[i+1]
+		}
+	}
+	if node == nil {
+		node = &yaml.Node{}
+		root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, node)
+	}
+	// Updating the node in place keeps a comment next to the value.
+	node.Kind, node.Tag, node.Style, node.Value, node.Content = yaml.ScalarNode, "!!str", 0, value, nil
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0600)
+}
+
+// Sources of an effective setting, see Resolve.
+const (
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+	SourceProfile = "profile"
+)
+
+// Resolved is the effective value of a setting and where it came from.
+type Resolved struct {
+	Setting
+	Source string
+}
+
+// Resolve picks the effective value of each setting: its environment
+// variable wins over a flag given on the command line, reported by changed,
+// which wins over the profile p. Settings with none of the three are left
+// out.
+func Resolve(p Profile, changed func(flags []string) ([]string, bool)) []Resolved {
+	var out []Resolved
+	for _, s := range p.Settings() {
+		if env := os.Getenv(EnvName(s.Key)); env != "" {
+			s.Values = []string{env}
+			if s.Key == "recipient" {
+				s.Values = strings.Split(env, ",")
+			}
+			out = append(out, Resolved{s, SourceEnv})
+			continue
+		}
+		if v, ok := changed(s.Flags); ok {
+			s.Values = v
+			out = append(out, Resolved{s, SourceFlag})
+			continue
+		}
+		if len(s.Values) > 0 {
+			out = append(out, Resolved{s, SourceProfile})
+		}
+	}
+	return out
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	p := Profile{Repository: "from-profile", DBHost: "db.profile", DBUser: "profileuser", KeepLast: 3}
+	tests := []struct {
+		name    string
+		env     map[string]string
+		changed map[string][]string
+		want    map[string]Resolved
+	}{
+		{
+			name: "profile",
+			want: map[string]Resolved{
+				"repository": {Setting{"repository", []string{"repository"}, []string{"from-profile"}}, SourceProfile},
+				"db-host":    {Setting{"db-host", []string{"db-host"}, []string{"db.profile"}}, SourceProfile},
+				"db-user":    {Setting{"db-user", []string{"db-user", "db-owner"}, []string{"profileuser"}}, SourceProfile},
+				"keep-last":  {Setting{"keep-last", []string{"keep-last"}, []string{"3"}}, SourceProfile},
+			},
+		},
+		{
+			name:    "flag over profile",
+			changed: map[string][]string{"repository": {"from-flag"}, "engine": {"mysql"}},
+			want: map[string]Resolved{
+				"repository": {Setting{"repository", []string{"repository"}, []string{"from-flag"}}, SourceFlag},
+				"engine":     {Setting{"engine", []string{"engine"}, []string{"mysql"}}, SourceFlag},
+			},
+		},
+		{
+			name:    "env over flag",
+			env:     map[string]string{"BOCKER_REPOSITORY": "from-env", "BOCKER_RECIPIENT": "age1a,age1b"},
+			changed: map[string][]string{"repository": {"from-flag"}},
+			want: map[string]Resolved{
+				"repository": {Setting{"repository", []string{"repository"}, []string{"from-env"}}, SourceEnv},
+				"recipient":  {Setting{"recipient", []string{"recipient"}, []string{"age1a", "age1b"}}, SourceEnv},
+			},
+		},
+		{
+			// restore names the database user --db-owner.
+			name:    "alias flag",
+			changed: map[string][]string{"db-owner": {"owner"}},
+			want: map[string]Resolved{
+				"db-user": {Setting{"db-user", []string{"db-user", "db-owner"}, []string{"owner"}}, SourceFlag},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			got := map[string]Resolved{}
+			for _, r := range Resolve(p, func(flags []string) ([]string, bool) {
+				for _, f := range flags {
+					if v, ok := tt.changed[f]; ok {
+						return v, true
+					}
+				}
+				return nil, false
+			}) {
+				got[r.Key] = r
+			}
+			for key, want := range tt.want {
+				if !reflect.DeepEqual(got[key], want) {
+					t.Errorf("%s = %+v, want %+v", key, got[key], want)
+				}
+			}
+			if _, ok := got["namespace"]; ok {
+				t.Error("namespace resolved without a value anywhere")
+			}
+		})
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	for key, want := range map[string]string{"db-host": "BOCKER_DB_HOST", "repository": "BOCKER_REPOSITORY", "keep-last": "BOCKER_KEEP_LAST"} {
+		if got := EnvName(key); got != want {
+			t.Errorf("EnvName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestFileProfile(t *testing.T) {
+	f := &File{
+		DefaultProfile: "prod",
+		Profiles:       map[string]Profile{"prod": {Repository: "prod"}, "staging": {Repository: "staging"}},
+	}
+	for _, tt := range []struct{ name, want string }{{"", "prod"}, {"staging", "staging"}} {
+		name, p, err := f.Profile(tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != tt.want || p.Repository != tt.want {
+			t.Errorf("Profile(%q) = %s, %+v; want %s", tt.name, name, p, tt.want)
+		}
+	}
+	if _, _, err := f.Profile("prdo"); err == nil || !strings.Contains(err.Error(), `"prdo" not found`) {
+		t.Errorf("unknown profile: err = %v", err)
+	}
+	if name, _, err := (&File{}).Profile(""); name != "" || err != nil {
+		t.Errorf("no profiles: got %q, %v", name, err)
+	}
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := configHome(t)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	writeConfig(t, "username: alice\nprofiles:\n  prod:\n    repositry: typo\n")
+	if _, err := LoadFile(); err == nil || !strings.Contains(err.Error(), "repositry") {
+		t.Fatalf("LoadFile with a misspelt key: err = %v", err)
+	}
+	// Only profile users are strict; the username can still be read.
+	u, err := GetUsername()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "alice" {
+		t.Fatalf("username = %q, want alice", u.Username)
+	}
+}
+
+func TestLoadFileMissing(t *testing.T) {
+	configHome(t)
+	f, err := LoadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*f, File{}) {
+		t.Fatalf("got %+v, want an empty file", f)
+	}
+}
+
+func TestSetUsername(t *testing.T) {
+	path := writeConfig(t, "# bocker settings\nusername: alice # me\nunknown: kept\nprofiles:\n  prod:\n    repository: r\n")
+	if err := SetUsername("bob"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# bocker settings\nusername: bob # me\nunknown: kept\nprofiles:\n  prod:\n    repository: r\n"
+	if string(data) != want {
+		t.Fatalf("config.yaml =\n%s\nwant\n%s", data, want)
+	}
+
+	configHome(t)
+	if err := SetUsername("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if u, err := GetUsername(); err != nil || u.Username != "carol" {
+		t.Fatalf("new file: got %+v, %v", u, err)
+	}
+}
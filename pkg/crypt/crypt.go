@@ -0,0 +1,196 @@
+// Package crypt encrypts backup files with age before they are packed into
+// an image and decrypts them again on restore.
+package crypt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"bocker.software-services.dev/pkg/config"
+	"filippo.io/age"
+)
+
+// Encryption modes recorded in the backup metadata.
+const (
+	ModeX25519 = "age-x25519"
+	ModeScrypt = "age-scrypt"
+)
+
+// Enabled reports whether the backup should be encrypted.
+func Enabled(app *config.Application) bool {
+	return len(app.Config.Encryption.Recipients) > 0 || app.Config.Encryption.Passphrase
+}
+
+// recipients builds the age recipients for a backup and records the mode and
+// public keys on app so they can be written into the image metadata.
+func recipients(app *config.Application) ([]age.Recipient, error) {
+	enc := &app.Config.Encryption
+	if enc.Passphrase {
+		if len(enc.Recipients) > 0 {
+			return nil, errors.New("--passphrase cannot be combined with --recipient")
+		}
+		pass, err := config.GetEncryptionKey()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(pass, "AGE-SECRET-KEY-") {
+			return nil, errors.New("the stored encryption key is an age identity, not a passphrase; use --recipient instead")
+		}
+		r, err := age.NewScryptRecipient(pass)
+		if err != nil {
+			return nil, err
+		}
+		enc.Mode = ModeScrypt
+		return []age.Recipient{r}, nil
+	}
+
+	rs := make([]age.Recipient, 0, len(enc.Recipients))
+	for _, s := range enc.Recipients {
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %w", s, err)
+		}
+		rs = append(rs, r)
+	}
+	enc.Mode = ModeX25519
+	return rs, nil
+}
+
+// EncryptFiles encrypts the named files in dir in place.
+func EncryptFiles(app *config.Application, dir string, names ...string) error {
+	rs, err := recipients(app)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := transform(filepath.Join(dir, name), func(dst io.Writer, src io.Reader) error {
+			w, err := age.Encrypt(dst, rs...)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(w, src); err != nil {
+				return err
+			}
+			return w.Close()
+		}); err != nil {
+			return fmt.Errorf("encrypt %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Encrypt returns a writer that encrypts everything written to it into dst.
+// The caller must Close it to flush the final chunk.
+func Encrypt(app *config.Application, dst io.Writer) (io.WriteCloser, error) {
+	rs, err := recipients(app)
+	if err != nil {
+		return nil, err
+	}
+	return age.Encrypt(dst, rs...)
+}
+
+// Identities loads the keys used to decrypt a backup: the --identity file if
+// given, otherwise the encryption key stored with `bocker config set`, which
+// may be either an age identity or a passphrase.
+func Identities(app *config.Application) ([]age.Identity, error) {
+	if path := app.Config.Encryption.IdentityFile; path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("open identity file: %w", err)
+		}
+		defer f.Close()
+		ids, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("parse identity file %s: %w", path, err)
+		}
+		return ids, nil
+	}
+
+	key, err := config.GetEncryptionKey()
+	if err != nil {
+		return nil, fmt.Errorf("backup is encrypted but no key is available (pass --identity or run `bocker config set --encryption-key`): %w", err)
+	}
+	if strings.HasPrefix(key, "AGE-SECRET-KEY-") {
+		return age.ParseIdentities(strings.NewReader(key))
+	}
+	id, err := age.NewScryptIdentity(key)
+	if err != nil {
+		return nil, err
+	}
+	return []age.Identity{id}, nil
+}
+
+// CheckIdentities fails early when none of ids can decrypt a backup that was
+// encrypted in the given mode to the given recipients, so a restore stops
+// before anything is downloaded.
+func CheckIdentities(ids []age.Identity, mode string, recipients []string) error {
+	switch mode {
+	case ModeScrypt:
+		for _, id := range ids {
+			if _, ok := id.(*age.ScryptIdentity); ok {
+				return nil
+			}
+		}
+		return errors.New("backup is encrypted with a passphrase but the supplied key is an age identity")
+	case ModeX25519:
+		for _, id := range ids {
+			x, ok := id.(*age.X25519Identity)
+			if !ok {
+				continue
+			}
+			for _, r := range recipients {
+				if x.Recipient().String() == r {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("none of the supplied identities matches the backup's recipients (%s)", strings.Join(recipients, ", "))
+	}
+	return fmt.Errorf("unsupported encryption mode %q", mode)
+}
+
+// DecryptFiles decrypts the named files in dir in place.
+func DecryptFiles(ids []age.Identity, dir string, names ...string) error {
+	for _, name := range names {
+		if err := transform(filepath.Join(dir, name), func(dst io.Writer, src io.Reader) error {
+			r, err := age.Decrypt(src, ids...)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(dst, r)
+			return err
+		}); err != nil {
+			return fmt.Errorf("decrypt %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// transform rewrites path through fn via a temporary file next to it, so the
+// original is only replaced once fn has succeeded.
+func transform(path string, fn func(dst io.Writer, src io.Reader) error) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	if err := fn(dst, src); err != nil {
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(dst.Name(), path)
+}
@@ -0,0 +1,101 @@
+// Package daemon runs scheduled backups (`bocker daemon`).
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"bocker.software-services.dev/pkg/backup"
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/tui"
+	"github.com/robfig/cron/v3"
+)
+
+// daemon holds what the scheduled runs share.
+type daemon struct {
+	ctx  context.Context
+	base *config.Application
+	log  *log.Logger
+	// running allows one backup at a time; the TUI stages and the command
+	// log they write to are not meant to be used concurrently.
+	running sync.Mutex
+}
+
+// Run schedules jobs and blocks until ctx is cancelled, e.g. by SIGTERM. A
+// backup in progress at that point is cancelled as well, and Run waits for it
+// to clean up before returning. Progress is logged to w.
+func Run(ctx context.Context, base *config.Application, jobs []Job, w io.Writer) error {
+	for _, j := range jobs {
+		if j.Repository == "" && base.Config.Docker.Repository == "" {
+			return fmt.Errorf("job %s: repository is required unless --repository is given", j.Name)
+		}
+	}
+	d := &daemon{ctx: ctx, base: base, log: log.New(w, "", log.LstdFlags)}
+
+	// A job still running (or waiting for another one) when it is due again
+	// skips that run rather than queueing up behind itself.
+	c := cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.PrintfLogger(d.log))))
+	names := map[cron.EntryID]string{}
+	for _, j := range jobs {
+		id, err := c.AddFunc(j.Schedule, func() { d.run(j) })
+		if err != nil {
+			return err
+		}
+		names[id] = j.Name
+	}
+	c.Start()
+	for _, e := range c.Entries() {
+		d.log.Printf("%s: next run at %s", names[e.ID], e.Next.Format(time.RFC3339))
+	}
+
+	<-ctx.Done()
+	d.log.Print("shutting down")
+	<-c.Stop().Done()
+	return nil
+}
+
+// run takes one backup for j and applies its retention policy.
+func (d *daemon) run(j Job) {
+	if j.Jitter > 0 {
+		delay := rand.N(j.Jitter)
+		select {
+		case <-time.After(delay):
+		case <-d.ctx.Done():
+			return
+		}
+	}
+	d.running.Lock()
+	defer d.running.Unlock()
+	if d.ctx.Err() != nil {
+		return
+	}
+
+	app := j.application(d.base)
+	start := time.Now()
+	d.log.Printf("%s: backup of %s started", j.Name, j.DBSource)
+	if err := tui.InitBackupTui(d.ctx, app); err != nil {
+		d.log.Printf("%s: %v", j.Name, err)
+		return
+	}
+	d.log.Printf("%s: pushed %s in %s", j.Name, app.Config.Docker.ImagePath, time.Since(start).Round(time.Second))
+
+	if backup.PolicyFromConfig(app).Empty() {
+		return
+	}
+	var out bytes.Buffer
+	err := backup.Prune(d.ctx, app, false, &out)
+	sc := bufio.NewScanner(&out)
+	for sc.Scan() {
+		d.log.Printf("%s: %s", j.Name, sc.Text())
+	}
+	if err != nil {
+		d.log.Printf("%s: prune: %v", j.Name, err)
+	}
+}
@@ -0,0 +1,163 @@
+package daemon
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/db"
+	"github.com/adrg/xdg"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// jobsFile is the name of the jobs file in bocker's config directory.
+const jobsFile = "jobs.yaml"
+
+// Job is one scheduled backup. Its keys are the names of the `bocker backup`
+// flags they stand in for, singular for the repeatable ones like in
+// config.yaml profiles; registry, namespace and repository default to the
+// daemon's own flags.
+type Job struct {
+	Name string `yaml:"name"`
+	// Schedule is a standard five-field cron expression or a descriptor such
+	// as @daily, in local time unless prefixed with CRON_TZ=<zone>.
+	Schedule string `yaml:"schedule"`
+	// Jitter delays each run by a random duration up to this long, so jobs
+	// sharing a schedule don't all hit the registry at once.
+	Jitter time.Duration `yaml:"jitter"`
+
+	Registry    string `yaml:"registry"`
+	Namespace   string `yaml:"namespace"`
+	Repository  string `yaml:"repository"`
+	Engine      string `yaml:"engine"`
+	DBSource    string `yaml:"db-source"`
+	DBUser      string `yaml:"db-user"`
+	DBHost      string `yaml:"db-host"`
+	ContainerID string `yaml:"container-id"`
+
+	Mode             string   `yaml:"mode"`
+	Format           string   `yaml:"format"`
+	Jobs             int      `yaml:"jobs"`
+	Schemas          []string `yaml:"schema"`
+	ExcludeSchemas   []string `yaml:"exclude-schema"`
+	Tables           []string `yaml:"table"`
+	ExcludeTables    []string `yaml:"exclude-table"`
+	ExcludeTableData []string `yaml:"exclude-table-data"`
+	ExportRoles      bool     `yaml:"export-roles"`
+
+	Compression      string `yaml:"compression"`
+	CompressionLevel int    `yaml:"compression-level"`
+	ChunkSize        int64  `yaml:"chunk-size"` // MiB
+	Dedup            bool   `yaml:"dedup"`
+	Stream           bool   `yaml:"stream"`
+	MountFrom        string `yaml:"mount-from"`
+
+	Recipients []string `yaml:"recipient"`
+	Passphrase bool     `yaml:"passphrase"`
+
+	// Retention is applied to the repository after each successful run.
+	Retention struct {
+		KeepLast    int `yaml:"keep-last"`
+		KeepDaily   int `yaml:"keep-daily"`
+		KeepWeekly  int `yaml:"keep-weekly"`
+		KeepMonthly int `yaml:"keep-monthly"`
+	} `yaml:"retention"`
+}
+
+// DefaultJobsFile is where the daemon looks for its jobs without --jobs-file.
+func DefaultJobsFile() (string, error) {
+	dir, err := xdg.ConfigFile(config.AppName)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, jobsFile), nil
+}
+
+// LoadJobs reads and checks the jobs file at path. Unknown keys are errors,
+// so a misspelt setting doesn't silently fall back to its default.
+func LoadJobs(path string) ([]Job, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read jobs file: %w", err)
+	}
+	var file struct {
+		Jobs []Job `yaml:"jobs"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if len(file.Jobs) == 0 {
+		return nil, fmt.Errorf("%s has no jobs", path)
+	}
+
+	names := map[string]bool{}
+	for _, j := range file.Jobs {
+		switch {
+		case j.Name == "":
+			return nil, errors.New("every job needs a name")
+		case names[j.Name]:
+			return nil, fmt.Errorf("job %s is defined twice", j.Name)
+		case j.DBSource == "":
+			return nil, fmt.Errorf("job %s: db-source is required", j.Name)
+		case j.Jitter < 0:
+			return nil, fmt.Errorf("job %s: jitter must not be negative", j.Name)
+		case j.Dedup && (len(j.Recipients) > 0 || j.Passphrase):
+			return nil, fmt.Errorf("job %s: encrypted backups cannot be deduplicated; drop dedup or the encryption settings", j.Name)
+		}
+		if _, err := cron.ParseStandard(j.Schedule); err != nil {
+			return nil, fmt.Errorf("job %s: invalid schedule %q: %w", j.Name, j.Schedule, err)
+		}
+		names[j.Name] = true
+	}
+	return file.Jobs, nil
+}
+
+// application builds the configuration of one run of j. Every run gets its
+// own, since a backup fills in tags, file names and temp dirs as it goes.
+func (j Job) application(base *config.Application) *config.Application {
+	app := &config.Application{Version: base.Version}
+	c := &app.Config
+
+	c.Docker.Registry = cmp.Or(j.Registry, base.Config.Docker.Registry)
+	c.Docker.Namespace = cmp.Or(j.Namespace, base.Config.Docker.Namespace)
+	c.Docker.Repository = cmp.Or(j.Repository, base.Config.Docker.Repository)
+	c.Docker.ContainerID = j.ContainerID
+	c.Docker.Compression = cmp.Or(j.Compression, config.CompressionGzip)
+	c.Docker.CompressionLevel = j.CompressionLevel
+	c.Docker.ChunkSize = j.ChunkSize << 20
+	c.Docker.Dedup = j.Dedup
+	c.Docker.MountFrom = j.MountFrom
+
+	c.DB.Engine = cmp.Or(j.Engine, db.EnginePostgres)
+	c.DB.SourceName = j.DBSource
+	c.DB.User = j.DBUser
+	c.DB.Host = cmp.Or(j.DBHost, "localhost")
+	c.DB.Mode = j.Mode
+	c.DB.Format = j.Format
+	c.DB.Jobs = j.Jobs
+	c.DB.Schemas = j.Schemas
+	c.DB.ExcludeSchemas = j.ExcludeSchemas
+	c.DB.Tables = j.Tables
+	c.DB.ExcludeTables = j.ExcludeTables
+	c.DB.ExcludeTableData = j.ExcludeTableData
+	c.DB.ExportRoles = j.ExportRoles
+
+	c.Encryption.Recipients = j.Recipients
+	c.Encryption.Passphrase = j.Passphrase
+	c.Retention.KeepLast = j.Retention.KeepLast
+	c.Retention.KeepDaily = j.Retention.KeepDaily
+	c.Retention.KeepWeekly = j.Retention.KeepWeekly
+	c.Retention.KeepMonthly = j.Retention.KeepMonthly
+
+	c.Stream = j.Stream
+	c.DaemonMode = true
+	return app
+}
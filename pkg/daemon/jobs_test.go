@@ -0,0 +1,177 @@
+package daemon
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/db"
+)
+
+func writeJobs(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), jobsFile)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadJobs(t *testing.T) {
+	jobs, err := LoadJobs(writeJobs(t, `
+jobs:
+  - name: shop
+    schedule: "CRON_TZ=Europe/Zurich 0 2 * * *"
+    jitter: 10m
+    db-source: shop
+    schema: [public, sales]
+    exclude-table: [public.sessions]
+    recipient: [age1abc]
+    retention:
+      keep-daily: 7
+  - name: wiki
+    schedule: "@hourly"
+    repository: wiki_backup
+    db-source: wiki
+    dedup: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("got %d jobs, want 2", len(jobs))
+	}
+	shop := jobs[0]
+	if shop.Jitter != 10*time.Minute || !reflect.DeepEqual(shop.Schemas, []string{"public", "sales"}) ||
+		!reflect.DeepEqual(shop.ExcludeTables, []string{"public.sessions"}) ||
+		!reflect.DeepEqual(shop.Recipients, []string{"age1abc"}) || shop.Retention.KeepDaily != 7 {
+		t.Errorf("shop = %+v", shop)
+	}
+	if wiki := jobs[1]; wiki.Repository != "wiki_backup" || !wiki.Dedup {
+		t.Errorf("wiki = %+v", wiki)
+	}
+}
+
+func TestLoadJobsErrors(t *testing.T) {
+	tests := map[string]struct {
+		jobs string
+		err  string
+	}{
+		"no jobs":          {"jobs: []\n", "has no jobs"},
+		"empty file":       {"", "parse"},
+		"no name":          {"jobs:\n  - schedule: '@daily'\n    db-source: a\n", "needs a name"},
+		"duplicate name":   {"jobs:\n  - {name: a, schedule: '@daily', db-source: a}\n  - {name: a, schedule: '@hourly', db-source: b}\n", "defined twice"},
+		"no db-source":     {"jobs:\n  - {name: a, schedule: '@daily'}\n", "db-source is required"},
+		"no schedule":      {"jobs:\n  - {name: a, db-source: a}\n", "invalid schedule"},
+		"bad schedule":     {"jobs:\n  - {name: a, schedule: '0 25 * * *', db-source: a}\n", "invalid schedule"},
+		"seconds field":    {"jobs:\n  - {name: a, schedule: '0 0 2 * * *', db-source: a}\n", "invalid schedule"},
+		"negative jitter":  {"jobs:\n  - {name: a, schedule: '@daily', db-source: a, jitter: -1m}\n", "jitter"},
+		"dedup encrypted":  {"jobs:\n  - {name: a, schedule: '@daily', db-source: a, dedup: true, passphrase: true}\n", "cannot be deduplicated"},
+		"misspelt key":     {"jobs:\n  - {name: a, schedule: '@daily', db-source: a, schemas: [public]}\n", "schemas"},
+		"old plural key":   {"jobs:\n  - {name: a, schedule: '@daily', db-source: a, recipients: [age1abc]}\n", "recipients"},
+		"unknown top key":  {"job:\n  - {name: a, schedule: '@daily', db-source: a}\n", "job"},
+		"invalid duration": {"jobs:\n  - {name: a, schedule: '@daily', db-source: a, jitter: soon}\n", "parse"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadJobs(writeJobs(t, tt.jobs))
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("err = %v, want one mentioning %q", err, tt.err)
+			}
+		})
+	}
+
+	if _, err := LoadJobs(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+func TestJobApplication(t *testing.T) {
+	// base holds the daemon's flags, filled in from its profile.
+	base := &config.Application{Version: "1.2.3"}
+	base.Config.Docker.Registry = "ghcr.io"
+	base.Config.Docker.Namespace = "acme"
+	base.Config.Docker.Repository = "default_backup"
+	base.Config.DB.TargetName = "not copied"
+
+	tests := []struct {
+		name string
+		job  Job
+		want func(c *config.Application)
+	}{
+		{
+			name: "defaults",
+			job:  Job{Name: "a", DBSource: "shop"},
+			want: func(app *config.Application) {
+				c := &app.Config
+				c.Docker.Registry, c.Docker.Namespace, c.Docker.Repository = "ghcr.io", "acme", "default_backup"
+				c.Docker.Compression = config.CompressionGzip
+				c.DB.Engine, c.DB.SourceName, c.DB.Host = db.EnginePostgres, "shop", "localhost"
+			},
+		},
+		{
+			name: "job settings",
+			job: func() Job {
+				j := Job{
+					Name: "b", Registry: "localhost:5000", Namespace: "team", Repository: "wiki_backup",
+					Engine: "mysql", DBSource: "wiki", DBUser: "root", DBHost: "db", ContainerID: "c1",
+					Mode: "logical", Format: "directory", Jobs: 4,
+					Schemas: []string{"public"}, ExcludeTableData: []string{"logs"}, ExportRoles: true,
+					Compression: config.CompressionZstd, CompressionLevel: 9, ChunkSize: 64, MountFrom: "team/base",
+					Recipients: []string{"age1abc"}, Stream: true,
+				}
+				j.Retention.KeepLast, j.Retention.KeepMonthly = 3, 12
+				return j
+			}(),
+			want: func(app *config.Application) {
+				c := &app.Config
+				c.Docker.Registry, c.Docker.Namespace, c.Docker.Repository = "localhost:5000", "team", "wiki_backup"
+				c.Docker.ContainerID, c.Docker.MountFrom = "c1", "team/base"
+				c.Docker.Compression, c.Docker.CompressionLevel, c.Docker.ChunkSize = config.CompressionZstd, 9, 64<<20
+				c.DB.Engine, c.DB.SourceName, c.DB.User, c.DB.Host = "mysql", "wiki", "root", "db"
+				c.DB.Mode, c.DB.Format, c.DB.Jobs = "logical", "directory", 4
+				c.DB.Schemas, c.DB.ExcludeTableData, c.DB.ExportRoles = []string{"public"}, []string{"logs"}, true
+				c.Encryption.Recipients = []string{"age1abc"}
+				c.Retention.KeepLast, c.Retention.KeepMonthly = 3, 12
+				c.Stream = true
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := &config.Application{Version: "1.2.3"}
+			want.Config.DaemonMode = true
+			tt.want(want)
+			got := tt.job.application(base)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("application =\n%+v\nwant\n%+v", got.Config, want.Config)
+			}
+			if got == tt.job.application(base) {
+				t.Error("runs share an Application")
+			}
+		})
+	}
+}
+
+func TestRunRequiresRepository(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	jobs := []Job{{Name: "a", Schedule: "@daily", DBSource: "a"}}
+
+	err := Run(ctx, &config.Application{}, jobs, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "job a: repository is required") {
+		t.Fatalf("err = %v, want the missing repository reported", err)
+	}
+
+	base := &config.Application{}
+	base.Config.Docker.Repository = "default_backup"
+	if err := Run(ctx, base, jobs, io.Discard); err != nil {
+		t.Fatalf("with --repository: %v", err)
+	}
+}
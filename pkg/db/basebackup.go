@@ -0,0 +1,221 @@
+package db
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// baseBackup copies the server's data directory with pg_basebackup in tar
+// format, streaming the WAL needed to make it consistent alongside. The
+// resulting base.tar and pg_wal.tar are packed into the backup file.
+func baseBackup(ctx context.Context, app *config.Application) error {
+	if err := validateIdent("db-user", app.Config.DB.User); err != nil {
+		return err
+	}
+	dir := dumpDir(app)
+	args := []string{
+		"-D", dir,
+		"-F", "t",
+		"-X", "stream",
+		"--checkpoint=fast",
+		"-U", app.Config.DB.User,
+		"-h", app.Config.DB.Host,
+	}
+	if err := runTool(ctx, app, "pg_basebackup", args...); err != nil {
+		return err
+	}
+	return packDir(ctx, app, dir)
+}
+
+// WalkBaseBackup calls fn with the contents of each tar archive in the base
+// backup at file, together with the directory, relative to the data
+// directory, it belongs in: "" for base.tar and "pg_wal" for pg_wal.tar.
+func WalkBaseBackup(file string, fn func(dir string, r io.Reader) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	found := false
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read base backup: %w", err)
+		}
+		switch name := path.Clean(hdr.Name); name {
+		case ".", "backup_manifest":
+		case "base.tar":
+			found = true
+			if err := fn("", tr); err != nil {
+				return err
+			}
+		case "pg_wal.tar":
+			if err := fn("pg_wal", tr); err != nil {
+				return err
+			}
+		default:
+			if strings.HasSuffix(name, ".tar") {
+				return fmt.Errorf("base backup has tablespace %s, which bocker cannot restore", strings.TrimSuffix(name, ".tar"))
+			}
+			return fmt.Errorf("unexpected file %s in base backup", name)
+		}
+	}
+	if !found {
+		return errors.New("base.tar not found; not a base backup")
+	}
+	return nil
+}
+
+// walStartRE finds the WAL file a base backup starts in in its backup_label.
+var walStartRE = regexp.MustCompile(`(?m)^START WAL LOCATION: \S+ \(file ([0-9A-F]{24})\)$`)
+
+// errLabelRead stops WalkBaseBackup once the backup_label has been read.
+var errLabelRead = errors.New("backup_label read")
+
+// BaseBackupWALStart returns the name of the WAL file the base backup at file
+// starts in, from the backup_label pg_basebackup puts at the start of
+// base.tar.
+func BaseBackupWALStart(file string) (string, error) {
+	var start string
+	err := WalkBaseBackup(file, func(dir string, r io.Reader) error {
+		if dir != "" {
+			return nil
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if path.Clean(hdr.Name) != "backup_label" {
+				continue
+			}
+			label, err := io.ReadAll(io.LimitReader(tr, 64<<10))
+			if err != nil {
+				return err
+			}
+			if m := walStartRE.FindSubmatch(label); m != nil {
+				start = string(m[1])
+			}
+			return errLabelRead
+		}
+	})
+	if err != nil && !errors.Is(err, errLabelRead) {
+		return "", err
+	}
+	if start == "" {
+		return "", errors.New("no WAL start location found in the base backup's backup_label")
+	}
+	return start, nil
+}
+
+// LayoutDataDir unpacks the base backup at file into dir, which must not
+// exist yet or be empty. A server of the same major version can start on
+// the result.
+func LayoutDataDir(file, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("data directory %s is not empty", dir)
+	}
+	return WalkBaseBackup(file, func(sub string, r io.Reader) error {
+		return extractTar(r, filepath.Join(dir, sub))
+	})
+}
+
+// RecoverySettings returns the lines to append to postgresql.auto.conf so the
+// server replays archived WAL with restoreCommand up to target and then
+// promotes. Recovery only starts with a recovery.signal file next to it.
+func RecoverySettings(restoreCommand string, target time.Time) string {
+	quote := func(s string) string { return "'" + strings.ReplaceAll(s, "'", "''") + "'" }
+	return fmt.Sprintf("\n# Point-in-time recovery set up by bocker restore\nrestore_command = %s\nrecovery_target_time = %s\nrecovery_target_action = 'promote'\n",
+		quote(restoreCommand), quote(target.UTC().Format("2006-01-02 15:04:05.999999")+"+00"))
+}
+
+// WriteRecovery appends settings to the postgresql.auto.conf of the data
+// directory dir and creates its recovery.signal.
+func WriteRecovery(dir, settings string) error {
+	f, err := os.OpenFile(filepath.Join(dir, "postgresql.auto.conf"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(settings)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, "recovery.signal"), nil, 0600)
+}
+
+// extractTar writes the directories and regular files of the tar archive r
+// below dir. Entries may not point outside dir, and links are refused since
+// the data directory of a base backup has none without tablespaces.
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(path.Clean(hdr.Name))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("refusing to extract %s outside the data directory", hdr.Name)
+		}
+		target := filepath.Join(dir, name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s: unsupported entry type %q in base backup", hdr.Name, hdr.Typeflag)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -19,6 +20,7 @@ import (
 var identRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
 
 // validateIdent rejects anything that isn't a plain PostgreSQL identifier.
+// The same subset is also valid unquoted in MySQL and MariaDB.
 // We stay within the safe subset rather than supporting double-quoted names
 // so operator mistakes (--db-target 'foo;drop...') can't reach psql.
 func validateIdent(field, v string) error {
@@ -28,19 +30,46 @@ func validateIdent(field, v string) error {
 	return nil
 }
 
+// patternRE matches the table and schema patterns pg_dump accepts that stay
+// within identRE: an optionally schema-qualified name whose parts may use the
+// wildcards * and ?.
+var patternRE = regexp.MustCompile(`^[A-Za-z_*?][A-Za-z0-9_*?]{0,62}(\.[A-Za-z_*?][A-Za-z0-9_*?]{0,62})?$`)
+
+// validatePattern is validateIdent for pg_dump's --schema and --table style
+// patterns, e.g. "public.order_*".
+func validatePattern(field, v string) error {
+	if !patternRE.MatchString(v) {
+		return fmt.Errorf("invalid %s %q: must match %s", field, v, patternRE.String())
+	}
+	return nil
+}
+
+// passwordEnv lists the variables the client tools read passwords from.
+var passwordEnv = []string{"PGPASSWORD", "MYSQL_PWD"}
+
 // buildCmd resolves the binary and prepends `docker exec -- <container>` when
-// a container ID is configured. When PGPASSWORD is set in the caller's env,
-// it is forwarded into the container via `docker exec -e PGPASSWORD` (value
-// not on argv); on the host path, children inherit the env automatically.
+// a container ID is configured. Password variables from passwordEnv that are
+// set in the caller's env are forwarded into the container via
+// `docker exec -e NAME` (value not on argv); on the host path, children
+// inherit the env automatically.
 // ctx is propagated to exec.CommandContext so Ctrl+C cancels child processes.
 func buildCmd(ctx context.Context, containerID, tool string, args []string) (*exec.Cmd, error) {
+	return buildCmdStdin(ctx, containerID, tool, args, nil)
+}
+
+// buildCmdStdin is buildCmd for tools that read from stdin, such as a
+// password prompt. stdin is attached with `docker exec -i` in the container
+// case.
+func buildCmdStdin(ctx context.Context, containerID, tool string, args []string, stdin io.Reader) (*exec.Cmd, error) {
 	if containerID == "" {
 		bin, err := exec.LookPath(tool)
 		if err != nil {
 			return nil, fmt.Errorf("%s not found: %w", tool, err)
 		}
 		bin, _ = filepath.Abs(bin)
-		return exec.CommandContext(ctx, bin, args...), nil
+		cmd := exec.CommandContext(ctx, bin, args...)
+		cmd.Stdin = stdin
+		return cmd, nil
 	}
 
 	dockerBin, err := exec.LookPath("docker")
@@ -50,29 +79,44 @@ func buildCmd(ctx context.Context, containerID, tool string, args []string) (*ex
 	dockerBin, _ = filepath.Abs(dockerBin)
 
 	dockerArgs := []string{"exec"}
-	if _, ok := os.LookupEnv("PGPASSWORD"); ok {
-		dockerArgs = append(dockerArgs, "-e", "PGPASSWORD")
+	if stdin != nil {
+		dockerArgs = append(dockerArgs, "-i")
+	}
+	for _, name := range passwordEnv {
+		if _, ok := os.LookupEnv(name); ok {
+			dockerArgs = append(dockerArgs, "-e", name)
+		}
 	}
 	dockerArgs = append(dockerArgs, "--", containerID, tool)
 	dockerArgs = append(dockerArgs, args...)
-	return exec.CommandContext(ctx, dockerBin, dockerArgs...), nil
+	cmd := exec.CommandContext(ctx, dockerBin, dockerArgs...)
+	cmd.Stdin = stdin
+	return cmd, nil
 }
 
 // runCmd captures stderr, runs cmd, and wraps any non-zero exit with the
 // underlying *exec.ExitError plus trimmed stderr.
 func runCmd(cmd *exec.Cmd, tool string) (string, error) {
-	var outb, errb bytes.Buffer
-	cmd.Stdout = &outb
+	var outb bytes.Buffer
+	err := streamCmd(cmd, tool, &outb)
+	return outb.String(), err
+}
+
+// streamCmd is runCmd for commands whose output is too large to buffer: the
+// child's stdout is written to w as it is produced.
+func streamCmd(cmd *exec.Cmd, tool string, w io.Writer) error {
+	var errb bytes.Buffer
+	cmd.Stdout = w
 	cmd.Stderr = &errb
 	logger.LogCommand(cmd.Path + " " + strings.Join(cmd.Args[1:], " "))
 	if err := cmd.Run(); err != nil {
 		stderr := strings.TrimSpace(errb.String())
 		if stderr == "" {
-			return outb.String(), fmt.Errorf("%s failed: %w", tool, err)
+			return fmt.Errorf("%s failed: %w", tool, err)
 		}
-		return outb.String(), fmt.Errorf("%s failed: %w: %s", tool, err, stderr)
+		return fmt.Errorf("%s failed: %w: %s", tool, err, stderr)
 	}
-	return outb.String(), nil
+	return nil
 }
 
 // backupPath returns where the backup file lives: /var/tmp inside the
@@ -84,111 +128,59 @@ func backupPath(app *config.Application) string {
 	return filepath.Join(app.Config.TmpDir, app.Config.DB.BackupFileName)
 }
 
-func rolesPath(app *config.Application) string {
-	if app.Config.Docker.ContainerID != "" {
-		return filepath.Join("/var/tmp", app.Config.DB.RolesFileName)
-	}
-	return filepath.Join(app.Config.TmpDir, app.Config.DB.RolesFileName)
+// dumpDir is where directory-format dumps are written to and unpacked: the
+// backup file's path without its extension.
+func dumpDir(app *config.Application) string {
+	path := backupPath(app)
+	return strings.TrimSuffix(path, filepath.Ext(path))
 }
 
-func Dump(ctx context.Context, app *config.Application) error {
-	if err := validateIdent("db-source", app.Config.DB.SourceName); err != nil {
-		return err
-	}
-	if err := validateIdent("db-user", app.Config.DB.User); err != nil {
+// packDir packs dir into the backup file as a tar archive and removes it.
+func packDir(ctx context.Context, app *config.Application, dir string) error {
+	if err := runTool(ctx, app, "tar", "-cf", backupPath(app), "-C", dir, "."); err != nil {
 		return err
 	}
-
-	args := []string{
-		"-F", "c",
-		"-U", app.Config.DB.User,
-		"-h", app.Config.DB.Host,
-		app.Config.DB.SourceName,
-		"-f", backupPath(app),
-	}
-	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_dump", args)
-	if err != nil {
-		return err
-	}
-	_, err = runCmd(cmd, "pg_dump")
-	return err
+	return removeAll(ctx, app, dir)
 }
 
-func ExportRoles(ctx context.Context, app *config.Application) error {
-	if err := validateIdent("db-user", app.Config.DB.User); err != nil {
-		return err
-	}
-
-	args := []string{
-		"-U", app.Config.DB.User,
-		"--clean", "--if-exists", "--no-comments", "--globals-only",
-		"--file=" + rolesPath(app),
-	}
-	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_dumpall", args)
+// runTool runs tool with args on the host or in the container.
+func runTool(ctx context.Context, app *config.Application, tool string, args ...string) error {
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, tool, args)
 	if err != nil {
 		return err
 	}
-	_, err = runCmd(cmd, "pg_dumpall")
+	_, err = runCmd(cmd, tool)
 	return err
 }
 
-func CreateDB(ctx context.Context, app *config.Application) error {
-	if err := validateIdent("db-target", app.Config.DB.TargetName); err != nil {
-		return err
-	}
-	if err := validateIdent("db-owner", app.Config.DB.Owner); err != nil {
-		return err
-	}
-
-	// Identifiers are validated above, but we still double-quote to defeat any
-	// future validator regression and to match PG's own escaping conventions.
-	stmt := fmt.Sprintf(`CREATE DATABASE "%s" OWNER "%s" ENCODING UTF8`,
-		app.Config.DB.TargetName, app.Config.DB.Owner)
-	args := []string{"-U", app.Config.DB.Owner, "-d", "postgres", "-c", stmt}
-
-	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "psql", args)
-	if err != nil {
-		return err
+// mkdirAll and removeAll create and delete a directory on the host or in
+// the container.
+func mkdirAll(ctx context.Context, app *config.Application, dir string) error {
+	if app.Config.Docker.ContainerID == "" {
+		return os.MkdirAll(dir, 0700)
 	}
-	if _, err := runCmd(cmd, "psql"); err != nil {
-		if strings.Contains(err.Error(), "already exists") {
-			logger.LogCommand("Database already exists, skipping creation...")
-			return nil
-		}
-		return err
-	}
-	return nil
+	return runTool(ctx, app, "mkdir", "-p", "--", dir)
 }
 
-func Restore(ctx context.Context, app *config.Application) error {
-	if err := validateIdent("db-source", app.Config.DB.SourceName); err != nil {
-		return err
-	}
-	if err := validateIdent("db-target", app.Config.DB.TargetName); err != nil {
-		return err
-	}
-	if err := validateIdent("db-owner", app.Config.DB.Owner); err != nil {
-		return err
+func removeAll(ctx context.Context, app *config.Application, dir string) error {
+	if app.Config.Docker.ContainerID == "" {
+		return os.RemoveAll(dir)
 	}
+	return runTool(ctx, app, "rm", "-rf", "--", dir)
+}
 
-	args := []string{
-		"-U", app.Config.DB.Owner, "-F", "c", "-c", "-v",
-		"--dbname=" + app.Config.DB.TargetName,
-		"-h", app.Config.DB.Host,
-		backupPath(app),
+// listPath returns where restore reads the --use-list file from: the copy
+// in the container's /var/tmp, or the file itself on the host.
+func listPath(app *config.Application) string {
+	if app.Config.Docker.ContainerID != "" {
+		return filepath.Join("/var/tmp", filepath.Base(app.Config.DB.UseList))
 	}
+	return app.Config.DB.UseList
+}
 
-	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_restore", args)
-	if err != nil {
-		return err
-	}
-	if _, err := runCmd(cmd, "pg_restore"); err != nil {
-		if strings.Contains(err.Error(), "errors ignored on restore") {
-			logger.LogCommand("Some errors during restore where ignored.")
-			logger.LogCommand(err.Error())
-			return nil
-		}
-		return err
+func rolesPath(app *config.Application) string {
+	if app.Config.Docker.ContainerID != "" {
+		return filepath.Join("/var/tmp", app.Config.DB.RolesFileName)
 	}
-	return nil
+	return filepath.Join(app.Config.TmpDir, app.Config.DB.RolesFileName)
 }
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+const (
+	EnginePostgres = "postgres"
+	EngineMySQL    = "mysql"
+	EngineMariaDB  = "mariadb"
+	EngineSQLite   = "sqlite"
+	EngineMongoDB  = "mongodb"
+)
+
+// Engine is a kind of database bocker can back up and restore. Every method
+// honours app.Config.Docker.ContainerID, so the client tools may run either on
+// the host or inside the database container.
+type Engine interface {
+	// Name is the value of --engine and is recorded in the backup metadata.
+	Name() string
+	// Format names the default dump format, e.g. "custom" for pg_dump -F c.
+	Format() string
+	// Extension is the file extension of dumps, without the leading dot.
+	Extension() string
+
+	ServerVersion(ctx context.Context, app *config.Application) (string, error)
+	DumpVersion(ctx context.Context, app *config.Application) (string, error)
+	Dump(ctx context.Context, app *config.Application) error
+	ExportRoles(ctx context.Context, app *config.Application) error
+	CreateDB(ctx context.Context, app *config.Application) error
+	Restore(ctx context.Context, app *config.Application) error
+}
+
+// Dump formats of engines that support more than one; see MultiFormat.
+const (
+	FormatCustom    = "custom"
+	FormatDirectory = "directory"
+	// FormatBaseBackup is a physical backup of a whole PostgreSQL cluster
+	// taken with pg_basebackup (--mode physical).
+	FormatBaseBackup = "basebackup"
+)
+
+// Backup modes: a dump of one database, or a copy of the server's data
+// directory.
+const (
+	ModeLogical  = "logical"
+	ModePhysical = "physical"
+)
+
+// Physical is implemented by engines that can back up the data directory of
+// the server as a whole (--mode physical).
+type Physical interface {
+	// PhysicalFormat is the Format such backups are recorded with.
+	PhysicalFormat() string
+}
+
+// ResolveMode returns the format to back up in for mode and the requested
+// format.
+func ResolveMode(e Engine, mode, format string) (string, error) {
+	switch mode {
+	case "", ModeLogical:
+		return ResolveFormat(e, format)
+	case ModePhysical:
+		p, ok := e.(Physical)
+		if !ok {
+			return "", fmt.Errorf("the %s engine has no physical backups", e.Name())
+		}
+		if format != "" {
+			return "", errors.New("--format only applies to logical backups")
+		}
+		return p.PhysicalFormat(), nil
+	}
+	return "", fmt.Errorf("unknown mode %q (want %s or %s)", mode, ModeLogical, ModePhysical)
+}
+
+// MultiFormat is implemented by engines that can dump in more than one format
+// (--format) and run their tools with several workers (--jobs).
+type MultiFormat interface {
+	// Formats lists the accepted formats, the default (Format) first.
+	Formats() []string
+	// Parallel reports whether dumps in format can be taken, or restored,
+	// with more than one job.
+	Parallel(format string, restore bool) bool
+}
+
+// ResolveFormat returns the format e dumps in when format is requested; an
+// empty format is the engine's default.
+func ResolveFormat(e Engine, format string) (string, error) {
+	if format == "" {
+		return e.Format(), nil
+	}
+	formats := []string{e.Format()}
+	if mf, ok := e.(MultiFormat); ok {
+		formats = mf.Formats()
+	}
+	for _, f := range formats {
+		if f == format {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("the %s engine has no %s format: must be one of %s", e.Name(), format, strings.Join(formats, ", "))
+}
+
+// CheckJobs reports whether e can dump (or restore) format with jobs
+// workers. Zero or one job always works.
+func CheckJobs(e Engine, format string, jobs int, restore bool) error {
+	if jobs <= 1 {
+		return nil
+	}
+	if mf, ok := e.(MultiFormat); ok && mf.Parallel(format, restore) {
+		return nil
+	}
+	what := "dump"
+	if restore {
+		what = "restore"
+	}
+	return fmt.Errorf("the %s engine cannot %s the %s format with --jobs", e.Name(), what, format)
+}
+
+// FileExtension is the extension of the backup file e writes in format.
+// Directory dumps and base backups are packed into a tar archive.
+func FileExtension(e Engine, format string) string {
+	if format == FormatDirectory || format == FormatBaseBackup {
+		return "tar"
+	}
+	return e.Extension()
+}
+
+// Selective is implemented by engines that can back up or restore part of a
+// database (--schema, --table and friends).
+type Selective interface {
+	// CheckSelection validates the selection options in app.
+	CheckSelection(app *config.Application, restore bool) error
+}
+
+// Selection reports whether app limits the backup or restore to part of the
+// database.
+func Selection(app *config.Application) bool {
+	d := app.Config.DB
+	return len(d.Schemas)+len(d.ExcludeSchemas)+len(d.Tables)+len(d.ExcludeTables)+len(d.ExcludeTableData) > 0 || d.UseList != ""
+}
+
+// CheckSelection makes sure e supports the selection options in app, if
+// any, and that they are valid.
+func CheckSelection(e Engine, app *config.Application, restore bool) error {
+	if !Selection(app) {
+		return nil
+	}
+	s, ok := e.(Selective)
+	if !ok {
+		return fmt.Errorf("the %s engine cannot select schemas or tables", e.Name())
+	}
+	return s.CheckSelection(app, restore)
+}
+
+// Streamer is implemented by engines whose dump tool can write to stdout.
+// `backup --stream` uses it to upload the dump while it is being produced,
+// without a temporary file or a copy out of the container.
+type Streamer interface {
+	DumpTo(ctx context.Context, app *config.Application, w io.Writer) error
+	ExportRolesTo(ctx context.Context, app *config.Application, w io.Writer) error
+}
+
+var engines = map[string]Engine{
+	EnginePostgres: Postgres{},
+	EngineMySQL:    MySQL{dump: "mysqldump", client: "mysql", name: EngineMySQL},
+	EngineMariaDB:  MySQL{dump: "mariadb-dump", client: "mariadb", name: EngineMariaDB},
+	EngineSQLite:   SQLite{},
+	EngineMongoDB:  MongoDB{},
+}
+
+// Engines returns the names accepted by Lookup, sorted.
+func Engines() []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the engine called name. An empty name means PostgreSQL,
+// the only engine bocker supported before --engine existed.
+func Lookup(name string) (Engine, error) {
+	if name == "" {
+		name = EnginePostgres
+	}
+	e, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown engine %q: must be one of %s", name, strings.Join(Engines(), ", "))
+	}
+	return e, nil
+}
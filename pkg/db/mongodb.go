@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/logger"
+)
+
+// mongoPasswordEnv holds the password for --db-user/--db-owner. The mongo
+// tools have no environment variable of their own, so bocker answers their
+// password prompt on stdin, which keeps the value off argv.
+const mongoPasswordEnv = "MONGODB_PASSWORD"
+
+// MongoDB backs up a single database with `mongodump --archive` and
+// restores it with mongorestore, renaming the namespaces from --db-source to
+// --db-target the way pg_restore --dbname does for PostgreSQL.
+type MongoDB struct{}
+
+func (MongoDB) Name() string      { return EngineMongoDB }
+func (MongoDB) Format() string    { return "archive" }
+func (MongoDB) Extension() string { return "archive" }
+
+// gzipArgs returns --gzip unless the layers are compressed anyway, as for
+// pg_dump -Z 0: compressing twice only costs time, and with --dedup a gzip
+// stream would defeat the chunking.
+func gzipArgs(app *config.Application) []string {
+	if app.Config.Docker.Dedup || app.Config.Docker.Compression != config.CompressionNone {
+		return nil
+	}
+	return []string{"--gzip"}
+}
+
+// isGzip reports whether the file at path starts with the gzip magic number.
+// Archives are dumped with or without --gzip depending on the layer
+// compression, and mongorestore has to be told which.
+func isGzip(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// mongoCmd builds a mongo tool invocation that connects to host as user.
+func mongoCmd(ctx context.Context, app *config.Application, tool, user string, args []string) (*exec.Cmd, error) {
+	conn := []string{"--host", app.Config.DB.Host}
+	var stdin io.Reader
+	if user != "" {
+		if err := validateIdent("db-user", user); err != nil {
+			return nil, err
+		}
+		conn = append(conn, "--username", user, "--authenticationDatabase", "admin")
+		if pw, ok := os.LookupEnv(mongoPasswordEnv); ok {
+			stdin = strings.NewReader(pw + "\n")
+		}
+	}
+	return buildCmdStdin(ctx, app.Config.Docker.ContainerID, tool, append(conn, args...), stdin)
+}
+
+// ServerVersion asks the server for its version with mongosh. The version is
+// only informational for MongoDB, so a missing mongosh is logged rather than
+// failing the backup.
+func (MongoDB) ServerVersion(ctx context.Context, app *config.Application) (string, error) {
+	cmd, err := mongoCmd(ctx, app, "mongosh", app.Config.DB.User, []string{"--quiet", "--eval", "db.version()"})
+	if err != nil {
+		return "", err
+	}
+	out, err := runCmd(cmd, "mongosh")
+	if err != nil {
+		logger.LogCommand("could not read the server version: " + err.Error())
+		return "", nil
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// DumpVersion returns the version line of mongodump.
+func (MongoDB) DumpVersion(ctx context.Context, app *config.Application) (string, error) {
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "mongodump", []string{"--version"})
+	if err != nil {
+		return "", err
+	}
+	out, err := runCmd(cmd, "mongodump")
+	version, _, _ := strings.Cut(strings.TrimSpace(out), "\n")
+	return version, err
+}
+
+func (MongoDB) Dump(ctx context.Context, app *config.Application) error {
+	if err := validateIdent("db-source", app.Config.DB.SourceName); err != nil {
+		return err
+	}
+
+	args := []string{
+		"--db", app.Config.DB.SourceName,
+		"--archive=" + backupPath(app),
+	}
+	args = append(args, gzipArgs(app)...)
+	cmd, err := mongoCmd(ctx, app, "mongodump", app.Config.DB.User, args)
+	if err != nil {
+		return err
+	}
+	_, err = runCmd(cmd, "mongodump")
+	return err
+}
+
+// DumpTo streams the archive to w; mongodump writes it to stdout when
+// --archive has no file name.
+func (MongoDB) DumpTo(ctx context.Context, app *config.Application, w io.Writer) error {
+	if err := validateIdent("db-source", app.Config.DB.SourceName); err != nil {
+		return err
+	}
+
+	args := append([]string{"--db", app.Config.DB.SourceName, "--archive"}, gzipArgs(app)...)
+	cmd, err := mongoCmd(ctx, app, "mongodump", app.Config.DB.User, args)
+	if err != nil {
+		return err
+	}
+	return streamCmd(cmd, "mongodump", w)
+}
+
+// ExportRoles is not supported; users and roles are defined per database in
+// MongoDB and would need mongodump --dumpDbUsersAndRoles inside the archive.
+func (MongoDB) ExportRoles(ctx context.Context, app *config.Application) error {
+	return fmt.Errorf("--export-roles is not supported by the %s engine", EngineMongoDB)
+}
+
+func (e MongoDB) ExportRolesTo(ctx context.Context, app *config.Application, w io.Writer) error {
+	return e.ExportRoles(ctx, app)
+}
+
+// CreateDB only validates the name: MongoDB creates databases on first write.
+func (MongoDB) CreateDB(ctx context.Context, app *config.Application) error {
+	return validateIdent("db-target", app.Config.DB.TargetName)
+}
+
+// Restore loads the archive into --db-target. Collections that already exist
+// there are dropped first, matching pg_restore -c.
+func (MongoDB) Restore(ctx context.Context, app *config.Application) error {
+	if err := validateIdent("db-source", app.Config.DB.SourceName); err != nil {
+		return err
+	}
+	if err := validateIdent("db-target", app.Config.DB.TargetName); err != nil {
+		return err
+	}
+
+	// The host keeps a copy of the archive even when it has been copied into
+	// the container.
+	gz, err := isGzip(filepath.Join(app.Config.TmpDir, app.Config.DB.BackupFileName))
+	if err != nil {
+		return err
+	}
+	args := []string{
+		"--archive=" + backupPath(app), "--drop",
+		"--nsInclude", app.Config.DB.SourceName + ".*",
+		"--nsFrom", app.Config.DB.SourceName + ".*",
+		"--nsTo", app.Config.DB.TargetName + ".*",
+	}
+	if gz {
+		args = append(args, "--gzip")
+	}
+	cmd, err := mongoCmd(ctx, app, "mongorestore", app.Config.DB.Owner, args)
+	if err != nil {
+		return err
+	}
+	_, err = runCmd(cmd, "mongorestore")
+	return err
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// mongodump only compresses when bocker doesn't.
+func TestGzipArgs(t *testing.T) {
+	tests := []struct {
+		compression string
+		dedup       bool
+		want        []string
+	}{
+		{"", false, nil},
+		{config.CompressionGzip, false, nil},
+		{config.CompressionZstd, false, nil},
+		{config.CompressionNone, true, nil},
+		{config.CompressionNone, false, []string{"--gzip"}},
+	}
+	for _, tt := range tests {
+		app := &config.Application{}
+		app.Config.Docker.Compression = tt.compression
+		app.Config.Docker.Dedup = tt.dedup
+		if got := gzipArgs(app); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("gzipArgs(%q, dedup %v) = %q, want %q", tt.compression, tt.dedup, got, tt.want)
+		}
+	}
+}
+
+func TestIsGzip(t *testing.T) {
+	dir := t.TempDir()
+	for name, tt := range map[string]struct {
+		content []byte
+		want    bool
+	}{
+		"gzip":    {[]byte{0x1f, 0x8b, 0x08, 0x00}, true},
+		"archive": {[]byte{0x6d, 0xe2, 0x99, 0x81}, false},
+		"short":   {[]byte{0x1f}, false},
+		"empty":   {nil, false},
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, tt.content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := isGzip(path); err != nil || got != tt.want {
+			t.Errorf("isGzip(%s) = %v, %v; want %v", name, got, err, tt.want)
+		}
+	}
+	if _, err := isGzip(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
@@ -0,0 +1,438 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/logger"
+)
+
+// Postgres backs up PostgreSQL with pg_dump's custom or directory format and
+// restores with pg_restore.
+type Postgres struct{}
+
+func (Postgres) Name() string      { return EnginePostgres }
+func (Postgres) Format() string    { return FormatCustom }
+func (Postgres) Extension() string { return "psql" }
+func (Postgres) Formats() []string { return []string{FormatCustom, FormatDirectory} }
+
+func (Postgres) PhysicalFormat() string { return FormatBaseBackup }
+
+// Parallel reports what --jobs works with: pg_dump only runs workers for the
+// directory format, pg_restore for both.
+func (Postgres) Parallel(format string, restore bool) bool {
+	return format == FormatDirectory || restore
+}
+
+// CheckSelection validates --schema, --table and the exclusions. pg_dump
+// takes patterns, pg_restore only plain names and a --use-list file.
+func (Postgres) CheckSelection(app *config.Application, restore bool) error {
+	d := app.Config.DB
+	if restore {
+		if len(d.ExcludeSchemas)+len(d.ExcludeTables)+len(d.ExcludeTableData) > 0 {
+			return errors.New("restore cannot exclude schemas or tables; use --use-list")
+		}
+		for _, v := range d.Schemas {
+			if err := validateIdent("schema", v); err != nil {
+				return err
+			}
+		}
+		for _, v := range d.Tables {
+			if err := validateIdent("table", v); err != nil {
+				return err
+			}
+		}
+		if d.UseList != "" {
+			if _, err := os.Stat(d.UseList); err != nil {
+				return fmt.Errorf("use-list: %w", err)
+			}
+		}
+		return nil
+	}
+
+	if d.UseList != "" {
+		return errors.New("--use-list only applies to restore")
+	}
+	for _, opt := range []struct {
+		field  string
+		values []string
+	}{
+		{"schema", d.Schemas},
+		{"exclude-schema", d.ExcludeSchemas},
+		{"table", d.Tables},
+		{"exclude-table", d.ExcludeTables},
+		{"exclude-table-data", d.ExcludeTableData},
+	} {
+		for _, v := range opt.values {
+			if err := validatePattern(opt.field, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// selectionArgs returns the pg_dump or pg_restore arguments for the
+// selection options. They are passed in --name=value form so a value can
+// never be read as another option.
+func selectionArgs(app *config.Application, restore bool) []string {
+	d := app.Config.DB
+	var args []string
+	add := func(flag string, values []string) {
+		for _, v := range values {
+			args = append(args, flag+"="+v)
+		}
+	}
+	add("--schema", d.Schemas)
+	add("--table", d.Tables)
+	if restore {
+		if d.UseList != "" {
+			args = append(args, "--use-list="+listPath(app))
+		}
+		return args
+	}
+	add("--exclude-schema", d.ExcludeSchemas)
+	add("--exclude-table", d.ExcludeTables)
+	add("--exclude-table-data", d.ExcludeTableData)
+	return args
+}
+
+// formatFlag is the pg_dump/pg_restore -F value for format.
+func formatFlag(format string) string {
+	if format == FormatDirectory {
+		return "d"
+	}
+	return "c"
+}
+
+// jobsArgs returns the -j argument for more than one job.
+func jobsArgs(app *config.Application) []string {
+	if app.Config.DB.Jobs > 1 {
+		return []string{"-j", strconv.Itoa(app.Config.DB.Jobs)}
+	}
+	return nil
+}
+
+// ServerVersion asks the source server for its version, e.g. "16.2".
+func (Postgres) ServerVersion(ctx context.Context, app *config.Application) (string, error) {
+	if err := validateIdent("db-source", app.Config.DB.SourceName); err != nil {
+		return "", err
+	}
+	if err := validateIdent("db-user", app.Config.DB.User); err != nil {
+		return "", err
+	}
+
+	args := []string{
+		"-U", app.Config.DB.User,
+		"-h", app.Config.DB.Host,
+		"-d", app.Config.DB.SourceName,
+		"-At", "-c", "SHOW server_version",
+	}
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "psql", args)
+	if err != nil {
+		return "", err
+	}
+	out, err := runCmd(cmd, "psql")
+	return strings.TrimSpace(out), err
+}
+
+// DumpVersion returns the version of the pg_dump that Dump will run, e.g.
+// "pg_dump (PostgreSQL) 16.2".
+func (Postgres) DumpVersion(ctx context.Context, app *config.Application) (string, error) {
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_dump", []string{"--version"})
+	if err != nil {
+		return "", err
+	}
+	out, err := runCmd(cmd, "pg_dump")
+	return strings.TrimSpace(out), err
+}
+
+// dumpArgs returns the pg_dump arguments shared by Dump and DumpTo.
+func (Postgres) dumpArgs(app *config.Application) ([]string, error) {
+	if err := validateIdent("db-source", app.Config.DB.SourceName); err != nil {
+		return nil, err
+	}
+	if err := validateIdent("db-user", app.Config.DB.User); err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-F", formatFlag(app.Config.DB.Format),
+		"-U", app.Config.DB.User,
+		"-h", app.Config.DB.Host,
+	}
+	// The layers are compressed (see --compression), so pg_dump's own
+	// compression would only cost time; with --dedup it would also turn a
+	// small change into a different byte stream from there on. Only
+	// uncompressed layers leave compression to pg_dump.
+	if app.Config.Docker.Dedup || app.Config.Docker.Compression != config.CompressionNone {
+		args = append(args, "-Z", "0")
+	}
+	args = append(args, selectionArgs(app, false)...)
+	return append(args, app.Config.DB.SourceName), nil
+}
+
+func (p Postgres) Dump(ctx context.Context, app *config.Application) error {
+	if app.Config.DB.Format == FormatBaseBackup {
+		return baseBackup(ctx, app)
+	}
+	args, err := p.dumpArgs(app)
+	if err != nil {
+		return err
+	}
+	if app.Config.DB.Format != FormatDirectory {
+		return runTool(ctx, app, "pg_dump", append(args, "-f", backupPath(app))...)
+	}
+
+	// The directory format writes one file per table, so several jobs can
+	// dump at once. The directory is packed into the backup file.
+	dir := dumpDir(app)
+	args = append(append(args, "-f", dir), jobsArgs(app)...)
+	if err := runTool(ctx, app, "pg_dump", args...); err != nil {
+		return err
+	}
+	return packDir(ctx, app, dir)
+}
+
+// DumpTo streams the dump to w instead of writing a file.
+func (p Postgres) DumpTo(ctx context.Context, app *config.Application, w io.Writer) error {
+	if app.Config.DB.Format == FormatDirectory {
+		return fmt.Errorf("the %s format cannot be streamed", FormatDirectory)
+	}
+	args, err := p.dumpArgs(app)
+	if err != nil {
+		return err
+	}
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_dump", args)
+	if err != nil {
+		return err
+	}
+	return streamCmd(cmd, "pg_dump", w)
+}
+
+// rolesArgs returns the pg_dumpall arguments shared by ExportRoles and
+// ExportRolesTo.
+func (Postgres) rolesArgs(app *config.Application) ([]string, error) {
+	if err := validateIdent("db-user", app.Config.DB.User); err != nil {
+		return nil, err
+	}
+
+	return []string{
+		"-U", app.Config.DB.User,
+		"--clean", "--if-exists", "--no-comments", "--globals-only",
+	}, nil
+}
+
+func (p Postgres) ExportRoles(ctx context.Context, app *config.Application) error {
+	args, err := p.rolesArgs(app)
+	if err != nil {
+		return err
+	}
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_dumpall", append(args, "--file="+rolesPath(app)))
+	if err != nil {
+		return err
+	}
+	_, err = runCmd(cmd, "pg_dumpall")
+	return err
+}
+
+// ExportRolesTo streams the roles to w instead of writing a file.
+func (p Postgres) ExportRolesTo(ctx context.Context, app *config.Application, w io.Writer) error {
+	args, err := p.rolesArgs(app)
+	if err != nil {
+		return err
+	}
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_dumpall", args)
+	if err != nil {
+		return err
+	}
+	return streamCmd(cmd, "pg_dumpall", w)
+}
+
+func (Postgres) CreateDB(ctx context.Context, app *config.Application) error {
+	if err := validateIdent("db-target", app.Config.DB.TargetName); err != nil {
+		return err
+	}
+	if err := validateIdent("db-owner", app.Config.DB.Owner); err != nil {
+		return err
+	}
+
+	// Identifiers are validated above, but we still double-quote to defeat any
+	// future validator regression and to match PG's own escaping conventions.
+	stmt := fmt.Sprintf(`CREATE DATABASE "%s" OWNER "%s" ENCODING UTF8`,
+		app.Config.DB.TargetName, app.Config.DB.Owner)
+	args := []string{"-U", app.Config.DB.Owner, "-d", "postgres", "-c", stmt}
+
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "psql", args)
+	if err != nil {
+		return err
+	}
+	if _, err := runCmd(cmd, "psql"); err != nil {
+		if strings.Contains(err.Error(), "already exists") {
+			logger.LogCommand("Database already exists, skipping creation...")
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (Postgres) Restore(ctx context.Context, app *config.Application) error {
+	if err := validateIdent("db-source", app.Config.DB.SourceName); err != nil {
+		return err
+	}
+	if err := validateIdent("db-target", app.Config.DB.TargetName); err != nil {
+		return err
+	}
+	if err := validateIdent("db-owner", app.Config.DB.Owner); err != nil {
+		return err
+	}
+
+	src, cleanup, err := archivePath(ctx, app)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	args := []string{
+		"-U", app.Config.DB.Owner, "-F", formatFlag(app.Config.DB.Format), "-v",
+		"--dbname=" + app.Config.DB.TargetName,
+		"-h", app.Config.DB.Host,
+	}
+	if app.Config.DB.ExitOnError {
+		args = append(args, "--exit-on-error")
+		// Without the roles file the owners and grantees in the dump don't
+		// exist, which would fail every restore.
+		if !app.Config.DB.ImportRoles {
+			args = append(args, "--no-owner", "--no-privileges")
+		}
+	} else {
+		args = append(args, "-c")
+	}
+	args = append(append(args, jobsArgs(app)...), selectionArgs(app, true)...)
+	args = append(args, src)
+
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_restore", args)
+	if err != nil {
+		return err
+	}
+	if _, err := runCmd(cmd, "pg_restore"); err != nil {
+		if !app.Config.DB.ExitOnError && strings.Contains(err.Error(), "errors ignored on restore") {
+			logger.LogCommand("Some errors during restore where ignored.")
+			logger.LogCommand(err.Error())
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// archivePath returns what pg_restore reads the backup from: the backup file
+// itself, or for the directory format the directory unpacked from it, which
+// cleanup removes again.
+func archivePath(ctx context.Context, app *config.Application) (path string, cleanup func(), err error) {
+	path = backupPath(app)
+	if app.Config.DB.Format != FormatDirectory {
+		return path, func() {}, nil
+	}
+	dir := dumpDir(app)
+	if err := mkdirAll(ctx, app, dir); err != nil {
+		return "", nil, err
+	}
+	cleanup = func() { removeAll(context.WithoutCancel(ctx), app, dir) }
+	if err := runTool(ctx, app, "tar", "-xf", path, "-C", dir); err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return dir, cleanup, nil
+}
+
+// WaitReady polls the server with pg_isready until it accepts TCP connections
+// or ctx ends. TCP is checked on purpose: the postgres image's init phase runs
+// a temporary server that only listens on the Unix socket.
+func WaitReady(ctx context.Context, app *config.Application) error {
+	for {
+		cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_isready", []string{"-h", app.Config.DB.Host, "-U", app.Config.DB.Owner})
+		if err != nil {
+			return err
+		}
+		if _, err := runCmd(cmd, "pg_isready"); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for postgres: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// ApplyRoles runs the exported roles file against the server.
+func ApplyRoles(ctx context.Context, app *config.Application) error {
+	if err := validateIdent("db-owner", app.Config.DB.Owner); err != nil {
+		return err
+	}
+
+	args := []string{"-U", app.Config.DB.Owner, "-h", app.Config.DB.Host, "-d", "postgres", "-f", rolesPath(app)}
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "psql", args)
+	if err != nil {
+		return err
+	}
+	_, err = runCmd(cmd, "psql")
+	return err
+}
+
+// Query runs a single SQL statement against the target database and returns
+// its unaligned, tuples-only output.
+func Query(ctx context.Context, app *config.Application, sql string) (string, error) {
+	if err := validateIdent("db-target", app.Config.DB.TargetName); err != nil {
+		return "", err
+	}
+	if err := validateIdent("db-owner", app.Config.DB.Owner); err != nil {
+		return "", err
+	}
+
+	args := []string{
+		"-U", app.Config.DB.Owner,
+		"-h", app.Config.DB.Host,
+		"-d", app.Config.DB.TargetName,
+		"-v", "ON_ERROR_STOP=1", "-At", "-c", sql,
+	}
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "psql", args)
+	if err != nil {
+		return "", err
+	}
+	out, err := runCmd(cmd, "psql")
+	return strings.TrimSpace(out), err
+}
+
+// RunFile executes a SQL file against the target database, stopping at the
+// first error. path is resolved inside the container when one is configured.
+func RunFile(ctx context.Context, app *config.Application, path string) (string, error) {
+	if err := validateIdent("db-target", app.Config.DB.TargetName); err != nil {
+		return "", err
+	}
+	if err := validateIdent("db-owner", app.Config.DB.Owner); err != nil {
+		return "", err
+	}
+
+	args := []string{
+		"-U", app.Config.DB.Owner,
+		"-h", app.Config.DB.Host,
+		"-d", app.Config.DB.TargetName,
+		"-v", "ON_ERROR_STOP=1", "-At", "-f", path,
+	}
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "psql", args)
+	if err != nil {
+		return "", err
+	}
+	out, err := runCmd(cmd, "psql")
+	return strings.TrimSpace(out), err
+}
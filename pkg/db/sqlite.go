@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// SQLite snapshots a database file with VACUUM INTO, which reads the source in
+// a single transaction and so yields a consistent copy even while other
+// processes write to it. --db-source and --db-target are file paths; there is
+// no server, user or host.
+type SQLite struct{}
+
+func (SQLite) Name() string      { return EngineSQLite }
+func (SQLite) Format() string    { return "sqlite" }
+func (SQLite) Extension() string { return "db" }
+
+// validatePath rejects paths sqlite3 would misread as an option or that can't
+// be embedded in a SQL string literal.
+func validatePath(field, v string) error {
+	if v == "" || strings.HasPrefix(v, "-") || strings.ContainsAny(v, "\x00\n\r") {
+		return fmt.Errorf("invalid %s %q: must be a file path", field, v)
+	}
+	return nil
+}
+
+// sqlString quotes s as a SQL string literal.
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// ServerVersion returns the version of the sqlite3 library, e.g. "3.45.1".
+// Unlike the server engines this describes the tool doing the snapshot, but
+// it is what decides which file format features the snapshot may use.
+func (e SQLite) ServerVersion(ctx context.Context, app *config.Application) (string, error) {
+	out, err := e.DumpVersion(ctx, app)
+	if err != nil {
+		return "", err
+	}
+	version, _, _ := strings.Cut(out, " ")
+	return version, nil
+}
+
+// DumpVersion returns the output of `sqlite3 --version`.
+func (SQLite) DumpVersion(ctx context.Context, app *config.Application) (string, error) {
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "sqlite3", []string{"--version"})
+	if err != nil {
+		return "", err
+	}
+	out, err := runCmd(cmd, "sqlite3")
+	return strings.TrimSpace(out), err
+}
+
+func (SQLite) Dump(ctx context.Context, app *config.Application) error {
+	if err := validatePath("db-source", app.Config.DB.SourceName); err != nil {
+		return err
+	}
+
+	args := []string{
+		"-readonly", "-bail", app.Config.DB.SourceName,
+		"VACUUM INTO " + sqlString(backupPath(app)),
+	}
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "sqlite3", args)
+	if err != nil {
+		return err
+	}
+	_, err = runCmd(cmd, "sqlite3")
+	return err
+}
+
+// ExportRoles is not supported: SQLite has no users.
+func (SQLite) ExportRoles(ctx context.Context, app *config.Application) error {
+	return fmt.Errorf("--export-roles is not supported by the %s engine", EngineSQLite)
+}
+
+// CreateDB does nothing; Restore creates the target file and refuses to
+// overwrite an existing one.
+func (SQLite) CreateDB(ctx context.Context, app *config.Application) error {
+	return validatePath("db-target", app.Config.DB.TargetName)
+}
+
+// Restore copies the snapshot to the target path with VACUUM INTO and runs
+// an integrity check on the result.
+func (SQLite) Restore(ctx context.Context, app *config.Application) error {
+	if err := validatePath("db-target", app.Config.DB.TargetName); err != nil {
+		return err
+	}
+
+	args := []string{
+		"-readonly", "-bail", backupPath(app),
+		"VACUUM INTO " + sqlString(app.Config.DB.TargetName),
+	}
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "sqlite3", args)
+	if err != nil {
+		return err
+	}
+	if _, err := runCmd(cmd, "sqlite3"); err != nil {
+		return err
+	}
+
+	args = []string{"-readonly", app.Config.DB.TargetName, "PRAGMA integrity_check"}
+	cmd, err = buildCmd(ctx, app.Config.Docker.ContainerID, "sqlite3", args)
+	if err != nil {
+		return err
+	}
+	out, err := runCmd(cmd, "sqlite3")
+	if err != nil {
+		return err
+	}
+	if out = strings.TrimSpace(out); out != "ok" {
+		return fmt.Errorf("integrity check of %s failed: %s", app.Config.DB.TargetName, out)
+	}
+	return nil
+}
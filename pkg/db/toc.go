@@ -0,0 +1,196 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// TOCEntry is one item in the table of contents of a pg_dump archive, as
+// printed by pg_restore --list.
+type TOCEntry struct {
+	ID     int    `json:"id"`
+	Type   string `json:"type"`
+	Schema string `json:"schema,omitempty"`
+	Name   string `json:"name"`
+	Owner  string `json:"owner,omitempty"`
+	// Size is the size of a TABLE DATA entry's rows in COPY text form. It is
+	// only filled in by DataSizes.
+	Size int64 `json:"size,omitempty"`
+}
+
+// tocTypes are the object descriptions pg_dump writes into its TOC. Some
+// span several words, so they can't be told apart from the schema by
+// splitting on spaces alone.
+var tocTypes = func() []string {
+	t := []string{
+		"ACCESS METHOD", "ACL", "AGGREGATE", "BLOB", "BLOB METADATA", "BLOBS",
+		"CAST", "CHECK CONSTRAINT", "COLLATION", "COMMENT", "CONSTRAINT",
+		"CONVERSION", "DATABASE", "DATABASE PROPERTIES", "DEFAULT", "DEFAULT ACL",
+		"DOMAIN", "ENCODING", "EVENT TRIGGER", "EXTENSION", "FK CONSTRAINT",
+		"FOREIGN DATA WRAPPER", "FOREIGN SERVER", "FOREIGN TABLE", "FUNCTION",
+		"INDEX", "INDEX ATTACH", "LARGE OBJECT", "MATERIALIZED VIEW",
+		"MATERIALIZED VIEW DATA", "OPERATOR", "OPERATOR CLASS", "OPERATOR FAMILY",
+		"POLICY", "PROCEDURAL LANGUAGE", "PROCEDURE", "PUBLICATION",
+		"PUBLICATION TABLE", "PUBLICATION TABLES IN SCHEMA", "ROW SECURITY",
+		"RULE", "SCHEMA", "SEARCHPATH", "SECURITY LABEL", "SEQUENCE",
+		"SEQUENCE OWNED BY", "SEQUENCE SET", "SERVER", "SHELL TYPE", "STATISTICS",
+		"STATISTICS DATA", "STDSTRINGS", "SUBSCRIPTION", "SUBSCRIPTION TABLE",
+		"TABLE", "TABLE ATTACH", "TABLE DATA", "TEXT SEARCH CONFIGURATION",
+		"TEXT SEARCH DICTIONARY", "TEXT SEARCH PARSER", "TEXT SEARCH TEMPLATE",
+		"TRANSFORM", "TRIGGER", "TYPE", "USER MAPPING", "VIEW",
+	}
+	// Longest first, so "TABLE DATA" wins over "TABLE".
+	sort.Slice(t, func(i, j int) bool { return len(t[i]) > len(t[j]) })
+	return t
+}()
+
+// ParseTOC parses pg_restore --list output. Each item line reads
+// "<id>; <tableoid> <oid> <type> <schema> <name> <owner>", with "-" for no
+// schema and an empty owner for objects that have none; lines starting with
+// ';' are comments.
+func ParseTOC(list string) ([]TOCEntry, error) {
+	var entries []TOCEntry
+	for n, line := range strings.Split(list, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+		bad := func() error { return fmt.Errorf("toc line %d: unexpected format %q", n+1, line) }
+
+		id, rest, ok := strings.Cut(line, "; ")
+		if !ok {
+			return nil, bad()
+		}
+		var e TOCEntry
+		var err error
+		if e.ID, err = strconv.Atoi(id); err != nil {
+			return nil, bad()
+		}
+		// Skip the catalog OIDs.
+		f := strings.SplitN(rest, " ", 3)
+		if len(f) < 3 {
+			return nil, bad()
+		}
+		rest = f[2]
+
+		for _, t := range tocTypes {
+			if strings.HasPrefix(rest, t+" ") {
+				e.Type, rest = t, rest[len(t)+1:]
+				break
+			}
+		}
+		if e.Type == "" {
+			e.Type, rest, _ = strings.Cut(rest, " ")
+		}
+		e.Schema, rest, ok = strings.Cut(rest, " ")
+		if !ok {
+			return nil, bad()
+		}
+		if e.Schema == "-" {
+			e.Schema = ""
+		}
+		if i := strings.LastIndex(rest, " "); i >= 0 {
+			e.Name, e.Owner = rest[:i], rest[i+1:]
+		} else {
+			e.Name = rest
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// ListTOC returns the pg_restore --list output for the backup in TmpDir (or
+// the container's /var/tmp).
+func ListTOC(ctx context.Context, app *config.Application) (string, error) {
+	src, cleanup, err := archivePath(ctx, app)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_restore", []string{"--list", src})
+	if err != nil {
+		return "", err
+	}
+	return runCmd(cmd, "pg_restore")
+}
+
+// DataSizes measures the table data in the backup by having pg_restore write
+// it out as a script and counting the rows between each COPY and its
+// terminating "\.". The result is keyed by "schema.table". This reads the
+// whole backup.
+func DataSizes(ctx context.Context, app *config.Application) (map[string]int64, error) {
+	src, cleanup, err := archivePath(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	cmd, err := buildCmd(ctx, app.Config.Docker.ContainerID, "pg_restore", []string{"--data-only", "-f", "-", src})
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := streamCmd(cmd, "pg_restore", pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	sizes, err := copySizes(pr)
+	pr.CloseWithError(err)
+	if werr := <-done; err == nil {
+		err = werr
+	}
+	return sizes, err
+}
+
+// copySizes adds up the COPY data per table in a SQL script read from r.
+// Rows can be far longer than any buffer, so the script is read in slices
+// and only the start of each line is looked at.
+func copySizes(r io.Reader) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	br := bufio.NewReaderSize(r, 64<<10)
+	table := ""
+	lineStart := true
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(chunk) > 0 {
+			switch {
+			case table != "" && lineStart && string(chunk) == "\\.\n":
+				table = ""
+			case table != "":
+				sizes[table] += int64(len(chunk))
+			case lineStart && bytes.HasPrefix(chunk, []byte("COPY ")):
+				table = copyTable(string(chunk))
+			}
+			lineStart = chunk[len(chunk)-1] == '\n'
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case io.EOF:
+			return sizes, nil
+		default:
+			return nil, err
+		}
+	}
+}
+
+// copyTable returns the unquoted "schema.table" a COPY statement loads, e.g.
+// public.users for `COPY public.users (id, name) FROM stdin;`.
+func copyTable(stmt string) string {
+	name := strings.TrimPrefix(stmt, "COPY ")
+	if i := strings.IndexAny(name, " ("); i >= 0 {
+		name = name[:i]
+	}
+	return strings.ReplaceAll(name, `"`, "")
+}
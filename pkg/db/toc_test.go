@@ -0,0 +1,60 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tocList is pg_restore --list output; objects without an owner end in a space.
+const tocList = `;
+; Archive created at 2024-03-15 02:00:00 UTC
+;     dbname: shop
+;     TOC Entries: 9
+;
+; Selected TOC Entries:
+;
+4; 2615 2200 SCHEMA - public pg_database_owner
+3346; 0 0 COMMENT - SCHEMA public pg_database_owner
+2; 3079 16384 EXTENSION - pgcrypto 
+215; 1259 16386 TABLE public users alice
+216; 1259 16390 TABLE sales order items alice
+220; 1259 16395 MATERIALIZED VIEW public monthly_totals alice
+3345; 0 16386 TABLE DATA public users alice
+3350; 0 16395 MATERIALIZED VIEW DATA public monthly_totals alice
+3201; 2606 16400 FK CONSTRAINT public users users_team_fkey alice
+`
+
+func TestParseTOC(t *testing.T) {
+	entries, err := ParseTOC(strings.ReplaceAll(tocList, "\n", "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TOCEntry{
+		{ID: 4, Type: "SCHEMA", Name: "public", Owner: "pg_database_owner"},
+		{ID: 3346, Type: "COMMENT", Name: "SCHEMA public", Owner: "pg_database_owner"},
+		{ID: 2, Type: "EXTENSION", Name: "pgcrypto"},
+		{ID: 215, Type: "TABLE", Schema: "public", Name: "users", Owner: "alice"},
+		{ID: 216, Type: "TABLE", Schema: "sales", Name: "order items", Owner: "alice"},
+		{ID: 220, Type: "MATERIALIZED VIEW", Schema: "public", Name: "monthly_totals", Owner: "alice"},
+		{ID: 3345, Type: "TABLE DATA", Schema: "public", Name: "users", Owner: "alice"},
+		{ID: 3350, Type: "MATERIALIZED VIEW DATA", Schema: "public", Name: "monthly_totals", Owner: "alice"},
+		{ID: 3201, Type: "FK CONSTRAINT", Schema: "public", Name: "users users_team_fkey", Owner: "alice"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("ParseTOC =\n%+v\nwant\n%+v", entries, want)
+	}
+}
+
+func TestParseTOCErrors(t *testing.T) {
+	for _, line := range []string{
+		"garbage",
+		"x; 1259 16386 TABLE public users alice",
+		"215; 1259",
+		"215; 1259 16386 TABLE",
+	} {
+		if _, err := ParseTOC(line + "\n"); err == nil {
+			t.Errorf("ParseTOC(%q): no error", line)
+		}
+	}
+}
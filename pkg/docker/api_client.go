@@ -30,11 +30,13 @@ func NewClient() (*APIClient, error) {
 	return &APIClient{docker: c}, nil
 }
 
-// Authentication returns a base64 encoded string of the docker username and password
+// Authentication returns a base64 encoded string of the credentials Setup
+// resolved for the configured registry
 func (c *APIClient) Authentication(app *config.Application) (string, error) {
 	authConfig := registry.AuthConfig{
-		Username: app.Config.Docker.Username,
-		Password: app.Config.Docker.Password,
+		Username:      app.Config.Docker.Username,
+		Password:      app.Config.Docker.Password,
+		ServerAddress: app.Config.Docker.Registry,
 	}
 	encodedJSON, err := json.Marshal(authConfig)
 	if err != nil {
@@ -0,0 +1,167 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+)
+
+// MediaTypeChunkGzip marks the layers of a deduplicated backup. Each one is a
+// gzip-compressed, content-defined chunk (see MediaTypeChunkZstd and
+// MediaTypeChunk for the other compressions); the order the chunks make up the
+// files in is kept in the image config (ImageConfig.Files), since a chunk
+// that occurs several times is stored only once.
+const MediaTypeChunkGzip = "application/vnd.dev.software-services.bocker.chunk.v1+gzip"
+
+// Content-defined chunk boundaries: no cut before cdcMin bytes, then a cut
+// with probability 2^-23 per byte (chunks average about 12 MiB), and a forced
+// cut at cdcMax. Chunks this large keep the manifest of a
+// multi-hundred-gigabyte dump within registry size limits.
+const (
+	cdcMin = 4 << 20
+	cdcMax = 64 << 20
+	// cdcMask takes its bits from the top of the gear hash, which depend on
+	// the last 64 bytes read.
+	cdcMask = uint64(1<<23-1) << 41
+)
+
+// gear maps each byte to a pseudo-random value for the rolling hash. It is
+// derived from a fixed seed: changing it would move every chunk boundary and
+// defeat deduplication against existing backups.
+var gear = func() (t [256]uint64) {
+	x := uint64(0x62_6f_63_6b_65_72) // "bocker"
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// chunker cuts a stream at content-defined boundaries, so an insertion or
+// deletion only changes the chunks around it and the rest of a dump maps to
+// the same chunks as the night before.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	n   int // valid bytes in buf
+	cut int // length of the chunk last returned, still at the start of buf
+	eof bool
+}
+
+func newChunker(r io.Reader) *chunker {
+	return &chunker{r: r, buf: make([]byte, cdcMax)}
+}
+
+// Next returns the next chunk, which is only valid until the following call,
+// or io.EOF once the stream is exhausted.
+func (c *chunker) Next() ([]byte, error) {
+	copy(c.buf, c.buf[c.cut:c.n])
+	c.n -= c.cut
+	c.cut = 0
+
+	if !c.eof {
+		m, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += m
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	c.cut = c.n
+	if c.n > cdcMin {
+		var h uint64
+		for i := cdcMin - 64; i < c.n; i++ {
+			h = h<<1 + gear[c.buf[i]]
+			if i >= cdcMin && h&cdcMask == 0 {
+				c.cut = i + 1
+				break
+			}
+		}
+	}
+	return c.buf[:c.cut], nil
+}
+
+// ChunkedFile lists the chunks a file of a deduplicated backup is made of.
+type ChunkedFile struct {
+	Name   string   `json:"name"`
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"`
+}
+
+// dedupFile cuts src into content-defined chunks and compresses each one
+// with comp.
+// put is called once per chunk digest not in seen, which it is responsible
+// for storing; seen is updated so chunks shared between files or repeated
+// within one are only stored once. The layers of the result are the new
+// chunks in order of first appearance.
+func dedupFile(src io.Reader, name string, comp compression, seen map[string]bool, put func(desc Descriptor, data []byte) error) (storedFile, error) {
+	whole := sha256.New()
+	ch := newChunker(io.TeeReader(src, whole))
+	file := ChunkedFile{Name: name, Chunks: []string{}}
+	var layers []Descriptor
+	var diffIDs []string
+	var compressed bytes.Buffer
+	for {
+		data, err := ch.Next()
+		if err == io.EOF {
+			if len(file.Chunks) > 0 {
+				break
+			}
+			// An empty file still gets one (empty) chunk, so the image
+			// has a layer and the file can be restored.
+			data, err = nil, nil
+		}
+		if err != nil {
+			return storedFile{}, err
+		}
+
+		// The compressed output is deterministic for equal input, which is
+		// what makes an unchanged chunk an identical blob.
+		compressed.Reset()
+		zw, err := comp.writer(&compressed)
+		if err != nil {
+			return storedFile{}, err
+		}
+		if _, err := zw.Write(data); err != nil {
+			return storedFile{}, err
+		}
+		if err := zw.Close(); err != nil {
+			return storedFile{}, err
+		}
+		desc := Descriptor{
+			MediaType: comp.chunkMediaType(),
+			Digest:    digestOf(compressed.Bytes()),
+			Size:      int64(compressed.Len()),
+		}
+		file.Size += int64(len(data))
+		file.Chunks = append(file.Chunks, desc.Digest)
+		if seen[desc.Digest] {
+			continue
+		}
+		if err := put(desc, compressed.Bytes()); err != nil {
+			return storedFile{}, err
+		}
+		seen[desc.Digest] = true
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, digestOf(data))
+	}
+	return storedFile{
+		layers:  layers,
+		diffIDs: diffIDs,
+		sha256:  hex.EncodeToString(whole.Sum(nil)),
+		size:    file.Size,
+		chunks:  &file,
+	}, nil
+}
@@ -0,0 +1,173 @@
+package docker
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// chunks returns copies of all the chunks newChunker cuts data into.
+func chunks(t *testing.T, data []byte) [][]byte {
+	t.Helper()
+	c := newChunker(bytes.NewReader(data))
+	var out [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return out
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, bytes.Clone(chunk))
+	}
+}
+
+func checkChunks(t *testing.T, data []byte, got [][]byte) {
+	t.Helper()
+	if joined := bytes.Join(got, nil); !bytes.Equal(joined, data) {
+		t.Fatalf("chunks add up to %d bytes, want the %d input bytes", len(joined), len(data))
+	}
+	for i, c := range got {
+		if len(c) > cdcMax || (len(c) < cdcMin && i < len(got)-1) {
+			t.Errorf("chunk %d of %d is %d bytes, outside [%d, %d]", i, len(got), len(c), cdcMin, cdcMax)
+		}
+	}
+}
+
+func TestChunker(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":     nil,
+		"small":     []byte("short file"),
+		"random":    randomBytes(1, 40<<20),
+		"zeros":     make([]byte, 2*cdcMax+5),
+		"min":       randomBytes(2, cdcMin),
+		"min+1":     randomBytes(3, cdcMin+1),
+		"exact max": randomBytes(4, cdcMax),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := chunks(t, data)
+			checkChunks(t, data, got)
+			if len(data) == 0 && len(got) != 0 {
+				t.Fatalf("empty input gave %d chunks", len(got))
+			}
+		})
+	}
+}
+
+// An insertion only changes the chunk it falls into; the boundaries after
+// it are found again.
+func TestChunkerResynchronises(t *testing.T) {
+	data := randomBytes(1, 40<<20)
+	before := chunks(t, data)
+	if len(before) < 3 {
+		t.Fatalf("only %d chunks; the test needs a few", len(before))
+	}
+
+	at := len(before[0]) / 2
+	edited := append(append(bytes.Clone(data[:at]), "inserted"...), data[at:]...)
+	after := chunks(t, edited)
+	checkChunks(t, edited, after)
+
+	old := map[string]bool{}
+	for _, c := range before {
+		old[digestOf(c)] = true
+	}
+	changed := 0
+	for _, c := range after {
+		if !old[digestOf(c)] {
+			changed++
+		}
+	}
+	if changed != 1 {
+		t.Fatalf("%d of %d chunks changed, want only the edited one", changed, len(after))
+	}
+}
+
+func TestDedupFile(t *testing.T) {
+	comp := compression{algorithm: config.CompressionGzip}
+	blobs := memoryBlobs{}
+	seen := map[string]bool{}
+	puts := 0
+	put := func(desc Descriptor, data []byte) error {
+		puts++
+		return blobs.putBlob(desc, data)
+	}
+
+	// restore reassembles a file from its chunk list, as Unpack does.
+	restore := func(f storedFile) []byte {
+		t.Helper()
+		var out bytes.Buffer
+		for _, d := range f.chunks.Chunks {
+			desc := Descriptor{MediaType: comp.chunkMediaType(), Digest: d}
+			if err := extractPart(bytes.NewReader(blobs[d]), desc, &out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return out.Bytes()
+	}
+
+	data := randomBytes(1, 40<<20)
+	first, err := dedupFile(bytes.NewReader(data), "db.dump", comp, seen, put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first.layers) != len(first.chunks.Chunks) || puts != len(first.layers) {
+		t.Fatalf("%d layers, %d chunks, %d puts; want one of each per chunk", len(first.layers), len(first.chunks.Chunks), puts)
+	}
+	if first.sha256 != sha256Hex(data) || first.size != int64(len(data)) || first.chunks.Size != int64(len(data)) {
+		t.Fatalf("sha256 %s, size %d; want %s, %d", first.sha256, first.size, sha256Hex(data), len(data))
+	}
+	if !bytes.Equal(restore(first), data) {
+		t.Fatal("restored file differs")
+	}
+
+	// The same content again needs no new chunks at all.
+	puts = 0
+	again, err := dedupFile(bytes.NewReader(data), "copy.dump", comp, seen, put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if puts != 0 || len(again.layers) != 0 {
+		t.Fatalf("stored %d chunks again, want none", puts)
+	}
+	if again.chunks.Name != "copy.dump" || len(again.chunks.Chunks) != len(first.chunks.Chunks) {
+		t.Fatalf("chunk list %s with %d chunks, want copy.dump with %d", again.chunks.Name, len(again.chunks.Chunks), len(first.chunks.Chunks))
+	}
+
+	// An edit only stores the chunk it changed.
+	puts = 0
+	edited := append(append(bytes.Clone(data[:100]), "edit"...), data[100:]...)
+	changed, err := dedupFile(bytes.NewReader(edited), "db.dump", comp, seen, put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if puts != 1 || len(changed.layers) != 1 {
+		t.Fatalf("stored %d chunks for a small edit, want 1", puts)
+	}
+	if !bytes.Equal(restore(changed), edited) {
+		t.Fatal("restored edited file differs")
+	}
+}
+
+func TestDedupFileEmpty(t *testing.T) {
+	comp := compression{algorithm: config.CompressionGzip}
+	blobs := memoryBlobs{}
+	f, err := dedupFile(bytes.NewReader(nil), "empty.sql", comp, map[string]bool{}, blobs.putBlob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.layers) != 1 || len(f.chunks.Chunks) != 1 || f.size != 0 {
+		t.Fatalf("%d layers, %d chunks, size %d; want one empty chunk", len(f.layers), len(f.chunks.Chunks), f.size)
+	}
+	var out bytes.Buffer
+	if err := extractPart(bytes.NewReader(blobs[f.layers[0].Digest]), f.layers[0], &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("empty chunk holds %d bytes", out.Len())
+	}
+}
@@ -0,0 +1,226 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"bocker.software-services.dev/pkg/logger"
+)
+
+// DefaultChunkSize is the amount of uncompressed backup data per layer. It
+// keeps layers well below registry size limits and bounds how much has to be
+// sent again when a transfer fails.
+const DefaultChunkSize = 512 << 20
+
+// AnnotationPart and AnnotationParts number the layers a file was split into:
+// part is the zero-based index of the layer, parts the total for the file.
+const (
+	AnnotationPart  = annotationPrefix + "part"
+	AnnotationParts = annotationPrefix + "parts"
+)
+
+// retryAttempts bounds how often a single chunk transfer is tried.
+const retryAttempts = 4
+
+// retry runs fn until it succeeds, ctx ends or retryAttempts is reached,
+// backing off exponentially between attempts.
+func retry(ctx context.Context, what string, fn func() error) error {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt == retryAttempts || ctx.Err() != nil {
+			return err
+		}
+		logger.LogCommand(fmt.Sprintf("%s failed (attempt %d/%d), retrying in %s: %v", what, attempt, retryAttempts, delay, err))
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// splitFile cuts src into parts of partSize bytes and hands each part,
+// compressed with comp, to put, which stores it and returns its descriptor.
+// Every part is a complete gzip member or zstd frame, so the concatenated
+// layers are still one valid stream of the whole file.
+func splitFile(src io.Reader, name string, partSize int64, comp compression, put func(io.Reader) (Descriptor, error)) (storedFile, error) {
+	whole := sha256.New()
+	size := newDigestWriter()
+	br := bufio.NewReader(io.TeeReader(src, io.MultiWriter(whole, size)))
+
+	var layers []Descriptor
+	var diffIDs []string
+	for {
+		// An empty file still gets one (empty) part, so it can be restored.
+		if _, err := br.Peek(1); err == io.EOF && len(layers) > 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return storedFile{}, err
+		}
+
+		pr, pw := io.Pipe()
+		uncompressed := newDigestWriter()
+		done := make(chan error, 1)
+		go func() {
+			zw, err := comp.writer(pw)
+			if err == nil {
+				_, err = io.CopyN(io.MultiWriter(zw, uncompressed), br, partSize)
+				if err == io.EOF {
+					err = nil
+				}
+				if err == nil {
+					err = zw.Close()
+				}
+			}
+			pw.CloseWithError(err)
+			done <- err
+		}()
+
+		desc, err := put(pr)
+		pr.CloseWithError(errors.New("part upload aborted"))
+		if werr := <-done; err == nil {
+			err = werr
+		}
+		if err != nil {
+			return storedFile{}, fmt.Errorf("%s part %d: %w", name, len(layers), err)
+		}
+		desc.Annotations = map[string]string{
+			AnnotationTitle: name,
+			AnnotationPart:  strconv.Itoa(len(layers)),
+		}
+		layers = append(layers, desc)
+		diffIDs = append(diffIDs, uncompressed.Digest())
+	}
+
+	for i := range layers {
+		layers[i].Annotations[AnnotationParts] = strconv.Itoa(len(layers))
+	}
+	return storedFile{
+		layers:  layers,
+		diffIDs: diffIDs,
+		sha256:  hex.EncodeToString(whole.Sum(nil)),
+		size:    size.n,
+	}, nil
+}
+
+// fileParts groups file layers by file name, each group sorted
+// by part index. Layers without part annotations, as pushed before files were
+// split, count as the single part of their file.
+func fileParts(layers []Descriptor) (map[string][]Descriptor, error) {
+	files := map[string][]Descriptor{}
+	for _, l := range layers {
+		if !isFileLayer(l.MediaType) {
+			return nil, fmt.Errorf("unsupported layer media type %q", l.MediaType)
+		}
+		name := l.Annotations[AnnotationTitle]
+		if name == "" {
+			return nil, fmt.Errorf("layer %s has no file name", l.Digest)
+		}
+		files[name] = append(files[name], l)
+	}
+
+	for name, parts := range files {
+		index := func(l Descriptor) int {
+			i, _ := strconv.Atoi(l.Annotations[AnnotationPart])
+			return i
+		}
+		sort.SliceStable(parts, func(i, j int) bool { return index(parts[i]) < index(parts[j]) })
+		for i, p := range parts {
+			if index(p) != i {
+				return nil, fmt.Errorf("%s: part %d is missing", name, i)
+			}
+			if n := p.Annotations[AnnotationParts]; n != "" && n != strconv.Itoa(len(parts)) {
+				return nil, fmt.Errorf("%s: expected %s parts, found %d", name, n, len(parts))
+			}
+		}
+	}
+	return files, nil
+}
+
+// joinParts downloads parts in order into dir/name and returns the SHA-256
+// of the reassembled file. Each part's digest is verified, and a part whose
+// transfer fails is fetched again without starting over.
+func joinParts(ctx context.Context, c *RegistryClient, parts []Descriptor, dir, name string) (string, error) {
+	path := filepath.Join(dir, filepath.Base(name))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	whole := sha256.New()
+	var offset int64
+	for i, part := range parts {
+		// Remember where the part starts, in the file and in the running
+		// hash, so a retry can roll both back.
+		state, err := whole.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return "", err
+		}
+		err = retry(ctx, fmt.Sprintf("fetching part %d of %s", i, name), func() error {
+			if err := whole.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+				return err
+			}
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			logger.LogCommand("fetching blob " + part.Digest)
+			body, err := c.GetBlob(ctx, part.Digest)
+			if err != nil {
+				return err
+			}
+			defer body.Close()
+			return extractPart(body, part, io.MultiWriter(f, whole))
+		})
+		if err != nil {
+			os.Remove(path)
+			return "", err
+		}
+		if offset, err = f.Seek(0, io.SeekCurrent); err != nil {
+			return "", err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(whole.Sum(nil)), nil
+}
+
+// extractPart decompresses one part read from r into w, according to its
+// media type, and verifies the blob's digest against desc.
+func extractPart(r io.Reader, desc Descriptor, w io.Writer) error {
+	verifier := newDigestWriter()
+	tee := io.TeeReader(r, verifier)
+	zr, err := decompress(desc.MediaType, tee)
+	if err != nil {
+		return fmt.Errorf("open layer %s: %w", desc.Digest, err)
+	}
+	defer zr.Close()
+
+	if _, err := io.Copy(w, zr); err != nil {
+		return fmt.Errorf("read layer %s: %w", desc.Digest, err)
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return fmt.Errorf("read layer %s: %w", desc.Digest, err)
+	}
+	if verifier.Digest() != desc.Digest {
+		return fmt.Errorf("layer digest mismatch: expected %s, got %s", desc.Digest, verifier.Digest())
+	}
+	return nil
+}
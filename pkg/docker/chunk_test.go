@@ -0,0 +1,178 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// memoryBlobs stores the blobs handed to splitFile's or dedupFile's put.
+type memoryBlobs map[string][]byte
+
+func (m memoryBlobs) putStream(mediaType string) func(io.Reader) (Descriptor, error) {
+	return func(r io.Reader) (Descriptor, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return Descriptor{}, err
+		}
+		m[digestOf(data)] = data
+		return Descriptor{MediaType: mediaType, Digest: digestOf(data), Size: int64(len(data))}, nil
+	}
+}
+
+func (m memoryBlobs) putBlob(desc Descriptor, data []byte) error {
+	m[desc.Digest] = bytes.Clone(data)
+	return nil
+}
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestSplitFile(t *testing.T) {
+	const partSize = 1000
+	for _, algorithm := range []string{config.CompressionGzip, config.CompressionZstd, config.CompressionNone} {
+		for _, size := range []int{0, 1, partSize, 2*partSize + partSize/2} {
+			t.Run(algorithm+"/"+strconv.Itoa(size), func(t *testing.T) {
+				comp := compression{algorithm: algorithm}
+				blobs := memoryBlobs{}
+				data := randomBytes(1, size)
+
+				f, err := splitFile(bytes.NewReader(data), "db.dump", partSize, comp, blobs.putStream(comp.fileMediaType()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantParts := max(1, (size+partSize-1)/partSize)
+				if len(f.layers) != wantParts || len(f.diffIDs) != wantParts {
+					t.Fatalf("got %d layers and %d diff IDs, want %d", len(f.layers), len(f.diffIDs), wantParts)
+				}
+				if f.sha256 != sha256Hex(data) || f.size != int64(size) {
+					t.Fatalf("sha256 %s, size %d; want %s, %d", f.sha256, f.size, sha256Hex(data), size)
+				}
+
+				var joined bytes.Buffer
+				for i, l := range f.layers {
+					want := map[string]string{
+						AnnotationTitle: "db.dump",
+						AnnotationPart:  strconv.Itoa(i),
+						AnnotationParts: strconv.Itoa(wantParts),
+					}
+					for k, v := range want {
+						if l.Annotations[k] != v {
+							t.Errorf("layer %d: %s = %q, want %q", i, k, l.Annotations[k], v)
+						}
+					}
+					var part bytes.Buffer
+					if err := extractPart(bytes.NewReader(blobs[l.Digest]), l, &part); err != nil {
+						t.Fatalf("layer %d: %v", i, err)
+					}
+					if got := "sha256:" + sha256Hex(part.Bytes()); got != f.diffIDs[i] {
+						t.Errorf("layer %d: diff ID %s, want %s", i, f.diffIDs[i], got)
+					}
+					joined.Write(part.Bytes())
+				}
+				if !bytes.Equal(joined.Bytes(), data) {
+					t.Fatal("the parts don't add up to the file")
+				}
+			})
+		}
+	}
+}
+
+// The parts of a file are complete compressed streams, so their
+// concatenation decompresses to the whole file in one go.
+func TestSplitFileConcatenates(t *testing.T) {
+	for _, algorithm := range []string{config.CompressionGzip, config.CompressionZstd} {
+		comp := compression{algorithm: algorithm}
+		blobs := memoryBlobs{}
+		data := randomBytes(2, 5500)
+		f, err := splitFile(bytes.NewReader(data), "db.dump", 1000, comp, blobs.putStream(comp.fileMediaType()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var all bytes.Buffer
+		for _, l := range f.layers {
+			all.Write(blobs[l.Digest])
+		}
+		zr, err := decompress(comp.fileMediaType(), &all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(zr)
+		zr.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s: concatenated parts decompress to %d bytes, want %d", algorithm, len(got), len(data))
+		}
+	}
+}
+
+func TestFileParts(t *testing.T) {
+	layer := func(name, part, parts string) Descriptor {
+		a := map[string]string{AnnotationTitle: name}
+		if part != "" {
+			a[AnnotationPart], a[AnnotationParts] = part, parts
+		}
+		return Descriptor{MediaType: MediaTypeFileGzip, Digest: "sha256:" + name + part, Annotations: a}
+	}
+
+	files, err := fileParts([]Descriptor{
+		layer("a", "2", "3"), layer("b", "1", "2"), layer("a", "0", "3"),
+		layer("b", "0", "2"), layer("a", "1", "3"),
+		// Layers pushed before files were split have no part annotations.
+		layer("roles.sql", "", ""),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"a":         {"sha256:a0", "sha256:a1", "sha256:a2"},
+		"b":         {"sha256:b0", "sha256:b1"},
+		"roles.sql": {"sha256:roles.sql"},
+	}
+	if len(files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(files), len(want))
+	}
+	for name, digests := range want {
+		var got []string
+		for _, l := range files[name] {
+			got = append(got, l.Digest)
+		}
+		if strings.Join(got, " ") != strings.Join(digests, " ") {
+			t.Errorf("%s: parts %v, want %v", name, got, digests)
+		}
+	}
+
+	untitled := layer("", "", "")
+	untitled.Annotations = nil
+	chunk := layer("c", "", "")
+	chunk.MediaType = MediaTypeChunkGzip
+	bad := map[string][]Descriptor{
+		"missing part":    {layer("a", "0", "3"), layer("a", "2", "3")},
+		"too few parts":   {layer("a", "0", "3"), layer("a", "1", "3")},
+		"duplicate part":  {layer("a", "0", "2"), layer("a", "0", "2")},
+		"no file name":    {untitled},
+		"not a file part": {chunk},
+	}
+	for name, layers := range bad {
+		if _, err := fileParts(layers); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
@@ -17,13 +18,69 @@ type HTTPClient struct {
 	httpClient http.Client
 	apiHost    string
 	token      string
+	namespace  string
+	repository string
 }
 
 type AuthResp struct {
 	Token string
 }
 
+type HubLayer struct {
+	Digest      string `json:"digest"`
+	Size        int    `json:"size"`
+	Instruction string `json:"instruction"`
+}
+
+type HubImage struct {
+	Architecture string     `json:"architecture"`
+	Features     string     `json:"features"`
+	Variant      string     `json:"variant,omitempty"`
+	Digest       string     `json:"digest"`
+	Layers       []HubLayer `json:"layers"`
+	OS           string     `json:"os"`
+	OSFeatures   string     `json:"os_features"`
+	OSVersion    string     `json:"os_version,omitempty"`
+	Size         int        `json:"size"`
+	Status       string     `json:"status"`
+	LastPulled   string     `json:"last_pulled,omitempty"`
+	LastPushed   string     `json:"last_pushed"`
+}
+
+type HubTag struct {
+	ID                  int        `json:"id"`
+	Images              []HubImage `json:"images"`
+	Creator             int        `json:"creator"`
+	LastUpdated         string     `json:"last_updated"`
+	LastUpdater         int        `json:"last_updater"`
+	LastUpdaterUsername string     `json:"last_updater_username"`
+	Name                string     `json:"name"`
+	Repository          int        `json:"repository"`
+	FullSize            int        `json:"full_size"`
+	V2                  bool       `json:"v2"`
+	Status              string     `json:"status"`
+	TagLastPulled       string     `json:"tag_last_pulled,omitempty"`
+	TagLastPushed       string     `json:"tag_last_pushed"`
+	Digest              string     `json:"digest"`
+}
+
+type HubTagList struct {
+	Count    int      `json:"count"`
+	Next     string   `json:"next,omitempty"`
+	Previous string   `json:"previous,omitempty"`
+	Results  []HubTag `json:"results"`
+}
+
+// DockerHubAPI is the origin of Docker Hub's own API, which lists and
+// deletes tags; pushes and pulls go through DockerHubRegistry.
+const DockerHubAPI = "https://hub.docker.com"
+
+// NewHTTPClient logs in to the Docker Hub API.
 func NewHTTPClient(app *config.Application) (*HTTPClient, error) {
+	return newHTTPClient(app, DockerHubAPI)
+}
+
+func newHTTPClient(app *config.Application, apiHost string) (*HTTPClient, error) {
 	if strings.HasPrefix(app.Config.Docker.Password, "dckr_oat") {
 		return nil, fmt.Errorf("cannot use a docker organization token to list repositories")
 	}
@@ -42,7 +99,7 @@ func NewHTTPClient(app *config.Application) (*HTTPClient, error) {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, app.Config.Docker.Host+path, bytes.NewBuffer(out))
+	req, err := http.NewRequest(http.MethodPost, apiHost+path, bytes.NewBuffer(out))
 	if err != nil {
 		return nil, err
 	}
@@ -68,7 +125,9 @@ func NewHTTPClient(app *config.Application) (*HTTPClient, error) {
 	return &HTTPClient{
 		httpClient: c,
 		token:      resp.Token,
-		apiHost:    app.Config.Docker.Host,
+		apiHost:    apiHost,
+		namespace:  app.Config.Docker.Namespace,
+		repository: app.Config.Docker.Repository,
 	}, nil
 }
 
@@ -82,3 +141,79 @@ func (c *HTTPClient) DoRequest(ctx context.Context, method, path string, body io
 	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", c.token))
 	return c.httpClient.Do(req)
 }
+
+// Tags lists the repository's tags through Docker Hub's own API, which
+// reports size and push time without fetching every manifest. All pages are
+// walked by following the `next` links.
+func (c *HTTPClient) Tags(ctx context.Context) ([]Tag, error) {
+	api, err := url.Parse(c.apiHost)
+	if err != nil {
+		return nil, err
+	}
+	path := fmt.Sprintf("/v2/namespaces/%s/repositories/%s/tags?page_size=100", c.namespace, c.repository)
+
+	var tags []Tag
+	for path != "" {
+		list, err := c.tagPage(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range list.Results {
+			dateTime, err := time.Parse(time.RFC3339, v.LastUpdated)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse timestamp: %w", err)
+			}
+			tags = append(tags, Tag{
+				Name:       v.Name,
+				Digest:     v.Digest,
+				Size:       int64(v.FullSize),
+				LastPushed: dateTime,
+			})
+		}
+
+		path = ""
+		if list.Next != "" {
+			// Only follow links back to the API origin so the token never
+			// leaves it.
+			next, err := url.Parse(list.Next)
+			if err != nil || next.Scheme != api.Scheme || next.Host != api.Host {
+				return nil, fmt.Errorf("docker hub returned an unexpected next page %q", list.Next)
+			}
+			path = next.RequestURI()
+		}
+	}
+	return tags, nil
+}
+
+func (c *HTTPClient) tagPage(ctx context.Context, path string) (*HubTagList, error) {
+	resp, err := c.DoRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("docker hub returned status %d", resp.StatusCode)
+	}
+
+	var list HubTagList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return &list, nil
+}
+
+// Delete removes a tag through the Hub API.
+func (c *HTTPClient) Delete(ctx context.Context, tag Tag) error {
+	path := fmt.Sprintf("/v2/namespaces/%s/repositories/%s/tags/%s", c.namespace, c.repository, tag.Name)
+	resp, err := c.DoRequest(ctx, http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("docker hub returned status %d deleting %s", resp.StatusCode, tag.Name)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// fakeHub serves the Docker Hub login and tag list endpoints for ns/repo,
+// with count tags split into pages of page_size.
+func fakeHub(t *testing.T, count int, next func(srv *httptest.Server, page int) string) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/users/login":
+			fmt.Fprint(w, `{"token":"tok"}`)
+		case "/v2/namespaces/ns/repositories/repo/tags":
+			if req.Header.Get("Authorization") != "Bearer tok" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			size, _ := strconv.Atoi(req.URL.Query().Get("page_size"))
+			page, _ := strconv.Atoi(req.URL.Query().Get("page"))
+			page = max(page, 1)
+			list := HubTagList{Count: count}
+			for i := (page - 1) * size; i < min(page*size, count); i++ {
+				list.Results = append(list.Results, HubTag{
+					Name:        fmt.Sprintf("tag-%03d", i),
+					LastUpdated: time.Date(2024, 1, 1, 0, 0, i, 0, time.UTC).Format(time.RFC3339),
+				})
+			}
+			if page*size < count {
+				list.Next = next(srv, page+1)
+			}
+			json.NewEncoder(w).Encode(list)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func hubClient(t *testing.T, srv *httptest.Server) *HTTPClient {
+	t.Helper()
+	app := &config.Application{}
+	app.Config.Docker.Namespace = "ns"
+	app.Config.Docker.Repository = "repo"
+	c, err := newHTTPClient(app, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestHubTagsPagination(t *testing.T) {
+	srv := fakeHub(t, 250, func(srv *httptest.Server, page int) string {
+		return fmt.Sprintf("%s/v2/namespaces/ns/repositories/repo/tags?page=%d&page_size=100", srv.URL, page)
+	})
+	tags, err := hubClient(t, srv).Tags(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 250 {
+		t.Fatalf("got %d tags, want 250", len(tags))
+	}
+	for i, tag := range tags {
+		if want := fmt.Sprintf("tag-%03d", i); tag.Name != want {
+			t.Fatalf("tag %d is %s, want %s", i, tag.Name, want)
+		}
+	}
+}
+
+func TestHubTagsForeignNextPage(t *testing.T) {
+	for _, next := range []string{
+		"https://evil.example/v2/namespaces/ns/repositories/repo/tags?page=2",
+		"unix:///var/run/docker.sock/v2/namespaces/ns/repositories/repo/tags?page=2",
+		"/v2/namespaces/ns/repositories/repo/tags?page=2",
+	} {
+		srv := fakeHub(t, 150, func(*httptest.Server, int) string { return next })
+		if _, err := hubClient(t, srv).Tags(t.Context()); err == nil {
+			t.Errorf("followed next page %q", next)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"bocker.software-services.dev/pkg/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Layer media types for the other --compression settings; they mirror
+// MediaTypeFileGzip and MediaTypeChunkGzip, and restore picks the
+// decompressor from them.
+const (
+	MediaTypeFileZstd  = "application/vnd.dev.software-services.bocker.file.v1+zstd"
+	MediaTypeFile      = "application/vnd.dev.software-services.bocker.file.v1"
+	MediaTypeChunkZstd = "application/vnd.dev.software-services.bocker.chunk.v1+zstd"
+	MediaTypeChunk     = "application/vnd.dev.software-services.bocker.chunk.v1"
+)
+
+var (
+	fileMediaTypes = map[string]string{
+		config.CompressionGzip: MediaTypeFileGzip,
+		config.CompressionZstd: MediaTypeFileZstd,
+		config.CompressionNone: MediaTypeFile,
+	}
+	chunkMediaTypes = map[string]string{
+		config.CompressionGzip: MediaTypeChunkGzip,
+		config.CompressionZstd: MediaTypeChunkZstd,
+		config.CompressionNone: MediaTypeChunk,
+	}
+)
+
+// compression is the algorithm and level new layers are written with. A
+// level of 0 is the algorithm's default.
+type compression struct {
+	algorithm string
+	level     int
+}
+
+// CheckCompression reports whether --compression and --compression-level
+// name a supported combination, so a typo fails before the dump is taken.
+func CheckCompression(app *config.Application) error {
+	_, err := compressionOf(app)
+	return err
+}
+
+func compressionOf(app *config.Application) (compression, error) {
+	c := compression{algorithm: app.Config.Docker.Compression, level: app.Config.Docker.CompressionLevel}
+	if c.algorithm == "" {
+		c.algorithm = config.CompressionGzip
+	}
+	var lo, hi int
+	switch c.algorithm {
+	case config.CompressionGzip:
+		lo, hi = gzip.BestSpeed, gzip.BestCompression
+	case config.CompressionZstd:
+		lo, hi = 1, 22
+	case config.CompressionNone:
+	default:
+		return c, fmt.Errorf("unknown compression %q (want %s, %s or %s)", c.algorithm, config.CompressionGzip, config.CompressionZstd, config.CompressionNone)
+	}
+	if c.level != 0 && (c.level < lo || c.level > hi) {
+		if hi == 0 {
+			return c, fmt.Errorf("--compression-level does not apply to compression %s", c.algorithm)
+		}
+		return c, fmt.Errorf("%s compression level must be between %d and %d", c.algorithm, lo, hi)
+	}
+	return c, nil
+}
+
+// fileMediaType and chunkMediaType are the media types of layers written
+// with c.
+func (c compression) fileMediaType() string  { return fileMediaTypes[c.algorithm] }
+func (c compression) chunkMediaType() string { return chunkMediaTypes[c.algorithm] }
+
+// writer compresses what is written to it into w. Its output only depends on
+// the input and the settings, which deduplication relies on.
+func (c compression) writer(w io.Writer) (io.WriteCloser, error) {
+	switch c.algorithm {
+	case config.CompressionZstd:
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if c.level != 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(c.level)))
+		}
+		return zstd.NewWriter(w, opts...)
+	case config.CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+	if c.level != 0 {
+		return gzip.NewWriterLevel(w, c.level)
+	}
+	return gzip.NewWriter(w), nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// isFileLayer and isChunkLayer tell the layers of split and of deduplicated
+// backups apart, whatever their compression.
+func isFileLayer(mediaType string) bool  { return hasValue(fileMediaTypes, mediaType) }
+func isChunkLayer(mediaType string) bool { return hasValue(chunkMediaTypes, mediaType) }
+
+func hasValue(m map[string]string, v string) bool {
+	for _, mt := range m {
+		if mt == v {
+			return true
+		}
+	}
+	return false
+}
+
+// decompress returns the content of a layer of the given media type read
+// from r.
+func decompress(mediaType string, r io.Reader) (io.ReadCloser, error) {
+	switch mediaType {
+	case MediaTypeFileGzip, MediaTypeChunkGzip:
+		return gzip.NewReader(r)
+	case MediaTypeFileZstd, MediaTypeChunkZstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case MediaTypeFile, MediaTypeChunk:
+		return io.NopCloser(r), nil
+	}
+	return nil, fmt.Errorf("unsupported layer media type %q", mediaType)
+}
+
+// layerCompression is the --compression setting the backup with the given
+// layers was pushed with. Images from before backups were split hold a
+// single gzipped tar layer.
+func layerCompression(layers []Descriptor) string {
+	if len(layers) == 0 {
+		return ""
+	}
+	mediaType := layers[0].MediaType
+	for _, m := range []map[string]string{fileMediaTypes, chunkMediaTypes} {
+		for algorithm, mt := range m {
+			if mt == mediaType {
+				return algorithm
+			}
+		}
+	}
+	switch layers[len(layers)-1].MediaType {
+	case MediaTypeLayerGzip, MediaTypeDockerLayerGzip:
+		return config.CompressionGzip
+	}
+	return ""
+}
@@ -0,0 +1,193 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"bocker.software-services.dev/pkg/db"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+)
+
+// PostgresImage picks the official postgres image matching a server version
+// as recorded in the backup metadata ("16.2", "9.6.24", "16.2 (Debian ...)").
+// Without a version it falls back to fallback.
+func PostgresImage(serverVersion, fallback string) string {
+	v, _, _ := strings.Cut(strings.TrimSpace(serverVersion), " ")
+	parts := strings.Split(v, ".")
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return fallback
+	}
+	// Before PostgreSQL 10 the major version had two components.
+	if major < 10 && len(parts) > 1 {
+		return "postgres:" + parts[0] + "." + parts[1]
+	}
+	return "postgres:" + parts[0]
+}
+
+// StartPostgres pulls ref and starts a disposable PostgreSQL container from
+// it with trust authentication. It returns the container ID; the caller must
+// remove it with RemoveContainer.
+func StartPostgres(ctx context.Context, ref string) (string, error) {
+	c, err := NewClient()
+	if err != nil {
+		return "", err
+	}
+	defer c.docker.Close()
+
+	if err := c.pull(ctx, ref); err != nil {
+		return "", err
+	}
+
+	resp, err := c.docker.ContainerCreate(ctx, &container.Config{
+		Image: ref,
+		Env:   []string{"POSTGRES_HOST_AUTH_METHOD=trust"},
+		Labels: map[string]string{
+			annotationPrefix + "verify": "true",
+		},
+	}, nil, nil, nil, "")
+	if err != nil {
+		return "", fmt.Errorf("create container: %w", err)
+	}
+	if err := c.docker.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		_ = c.docker.ContainerRemove(context.WithoutCancel(ctx), resp.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+		return "", fmt.Errorf("start container: %w", err)
+	}
+	return resp.ID, nil
+}
+
+// pull fetches ref from its registry.
+func (c *APIClient) pull(ctx context.Context, ref string) error {
+	out, err := c.docker.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("pull %s: %w", ref, err)
+	}
+	defer out.Close()
+	return c.ParseOutput(out)
+}
+
+// RestoreVolume lays out the base backup at file as the data directory in
+// volume, which is created if it does not exist yet. It is mounted at the
+// PGDATA of ref, the image a container is later started from, in a container
+// that never runs. A volume that already holds a data directory is refused.
+// Non-empty recovery settings are set up as db.WriteRecovery does.
+func RestoreVolume(ctx context.Context, ref, volume, file, recovery string) error {
+	c, err := NewClient()
+	if err != nil {
+		return err
+	}
+	defer c.docker.Close()
+
+	if err := c.pull(ctx, ref); err != nil {
+		return err
+	}
+	img, err := c.docker.ImageInspect(ctx, ref)
+	if err != nil {
+		return fmt.Errorf("inspect %s: %w", ref, err)
+	}
+	pgdata := "/var/lib/postgresql/data"
+	if img.Config != nil {
+		for _, env := range img.Config.Env {
+			if v, ok := strings.CutPrefix(env, "PGDATA="); ok {
+				pgdata = v
+			}
+		}
+	}
+
+	resp, err := c.docker.ContainerCreate(ctx, &container.Config{
+		Image: ref,
+		Labels: map[string]string{
+			annotationPrefix + "restore": "true",
+		},
+	}, &container.HostConfig{
+		Mounts: []mount.Mount{{Type: mount.TypeVolume, Source: volume, Target: pgdata}},
+	}, nil, nil, "")
+	if err != nil {
+		return fmt.Errorf("create container: %w", err)
+	}
+	// The named volume outlives the container.
+	defer c.docker.ContainerRemove(context.WithoutCancel(ctx), resp.ID, container.RemoveOptions{Force: true})
+
+	if _, err := c.docker.ContainerStatPath(ctx, resp.ID, path.Join(pgdata, "PG_VERSION")); err == nil {
+		return fmt.Errorf("volume %s already holds a data directory", volume)
+	}
+	err = db.WalkBaseBackup(file, func(dir string, r io.Reader) error {
+		dst := path.Join(pgdata, dir)
+		if err := c.docker.CopyToContainer(ctx, resp.ID, dst, r, container.CopyToContainerOptions{}); err != nil {
+			return fmt.Errorf("copy to %s: %w", dst, err)
+		}
+		return nil
+	})
+	if err != nil || recovery == "" {
+		return err
+	}
+	return c.writeRecovery(ctx, resp.ID, pgdata, recovery)
+}
+
+// writeRecovery is db.WriteRecovery for the data directory pgdata in the
+// container id.
+func (c *APIClient) writeRecovery(ctx context.Context, id, pgdata, settings string) error {
+	conf, _, err := c.docker.CopyFromContainer(ctx, id, path.Join(pgdata, "postgresql.auto.conf"))
+	if err != nil {
+		return fmt.Errorf("read postgresql.auto.conf: %w", err)
+	}
+	defer conf.Close()
+	tr := tar.NewReader(conf)
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("read postgresql.auto.conf: %w", err)
+	}
+	old, err := io.ReadAll(tr)
+	if err != nil {
+		return fmt.Errorf("read postgresql.auto.conf: %w", err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{"postgresql.auto.conf", append(old, settings...)},
+		{"recovery.signal", nil},
+	} {
+		err := tw.WriteHeader(&tar.Header{
+			Name: f.name, Mode: 0600, Size: int64(len(f.data)),
+			Uid: hdr.Uid, Gid: hdr.Gid, ModTime: time.Now(),
+		})
+		if err == nil {
+			_, err = tw.Write(f.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := c.docker.CopyToContainer(ctx, id, pgdata, &buf, container.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("write recovery settings: %w", err)
+	}
+	return nil
+}
+
+// RemoveContainer force-removes a container together with its anonymous
+// volumes.
+func RemoveContainer(ctx context.Context, id string) error {
+	c, err := NewClient()
+	if err != nil {
+		return err
+	}
+	defer c.docker.Close()
+
+	return c.docker.ContainerRemove(ctx, id, container.RemoveOptions{Force: true, RemoveVolumes: true})
+}
@@ -3,19 +3,20 @@ package docker
 import (
 	"bytes"
 	"context"
-	_ "embed"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/crypt"
+	"bocker.software-services.dev/pkg/db"
 	"bocker.software-services.dev/pkg/logger"
-	"bocker.software-services.dev/pkg/tar"
-	"github.com/docker/docker/api/types/image"
 )
 
 // wrapExecErr produces an error that carries the underlying *exec.ExitError
@@ -28,15 +29,6 @@ func wrapExecErr(tool string, err error, stderr string) error {
 	return fmt.Errorf("%s failed: %w: %s", tool, err, stderr)
 }
 
-//go:embed "Dockerfile"
-var Dockerfile []byte
-
-type Image struct {
-	Config   string   `json:"Config"`
-	RepoTags []string `json:"RepoTags"`
-	Layers   []string `json:"Layers"`
-}
-
 // dockerBin resolves an absolute path to the docker binary.
 func dockerBin() (string, error) {
 	bin, err := exec.LookPath("docker")
@@ -86,133 +78,309 @@ func CopyTo(ctx context.Context, container, filename string) error {
 	return nil
 }
 
+// Build assembles the backup image as an OCI image layout in TmpDir. Each
+// file is split into layers of ChunkSize bytes, or into content-defined
+// chunks with --dedup, written directly in Go, so no Docker daemon or
+// `docker build` is involved.
 func Build(ctx context.Context, app *config.Application) error {
-	dockerfilePath := filepath.Join(app.Config.TmpDir, "Dockerfile")
-	if err := os.WriteFile(dockerfilePath, Dockerfile, 0600); err != nil {
-		return fmt.Errorf("unable to write Dockerfile: %w", err)
+	files := []string{app.Config.DB.BackupFileName}
+	if app.Config.DB.ExportRoles {
+		files = append(files, app.Config.DB.RolesFileName)
 	}
 
-	bin, err := dockerBin()
+	layout := filepath.Join(app.Config.TmpDir, layoutDir)
+	if err := initLayout(layout); err != nil {
+		return fmt.Errorf("unable to build image: %w", err)
+	}
+	img := newImageFiles()
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(app.Config.TmpDir, name))
+		if err != nil {
+			return fmt.Errorf("unable to build image: %w", err)
+		}
+		err = img.add(app, f, name, layoutSink(layout))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("unable to build image: %w", err)
+		}
+	}
+
+	meta := buildMetadata(app, img)
+	err := writeImage(layout, app.Config.Docker.Tag, img.layers, img.diffIDs, img.chunked, time.Now(), meta.Annotations())
 	if err != nil {
-		return err
+		return fmt.Errorf("unable to build image: %w", err)
 	}
+	return ctx.Err()
+}
 
-	buildArgs := []string{"build",
-		"--build-arg", "backup_file=" + app.Config.DB.BackupFileName,
+// chunkSize returns the configured part size, or DefaultChunkSize.
+func chunkSize(app *config.Application) int64 {
+	if app.Config.Docker.ChunkSize > 0 {
+		return app.Config.Docker.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+// buildMetadata describes the backup being made from img.
+func buildMetadata(app *config.Application, img *imageFiles) Metadata {
+	meta := Metadata{
+		Engine:        app.Config.DB.Engine,
+		Database:      app.Config.DB.SourceName,
+		ServerVersion: app.Config.DB.ServerVersion,
+		DumpVersion:   app.Config.DB.DumpVersion,
+		Format:        app.Config.DB.Format,
+		Roles:         app.Config.DB.ExportRoles,
+		FileName:      app.Config.DB.BackupFileName,
+		SHA256:        img.sums[app.Config.DB.BackupFileName],
+		PlainSHA256:   img.plainSums[app.Config.DB.BackupFileName],
+		WALStart:      app.Config.DB.WALStart,
+		LogicalSize:   img.logical,
+		BockerVersion: app.Version,
+		Encryption:    app.Config.Encryption.Mode,
+	}
+	if app.Config.Encryption.Mode == crypt.ModeX25519 {
+		meta.Recipients = app.Config.Encryption.Recipients
 	}
 	if app.Config.DB.ExportRoles {
-		buildArgs = append(buildArgs, "--build-arg", "roles_file="+app.Config.DB.RolesFileName)
+		meta.RolesFileName = app.Config.DB.RolesFileName
 	}
-	buildArgs = append(buildArgs, "-t", app.Config.Docker.ImagePath, "-f", dockerfilePath, app.Config.TmpDir)
 
-	var outb, errb bytes.Buffer
-	buildCmd := exec.CommandContext(ctx, bin, buildArgs...)
-	buildCmd.Stdout = &outb
-	buildCmd.Stderr = &errb
-	if err := buildCmd.Run(); err != nil {
-		return wrapExecErr("docker build", err, errb.String())
-	}
-	return nil
+	return meta
 }
 
+// Push uploads the image written by Build to the registry using the
+// Distribution v2 API: blobs first, skipping those the registry already has,
+// then the manifest under the backup tag.
 func Push(ctx context.Context, app *config.Application) error {
-	c, err := NewClient()
+	layout := filepath.Join(app.Config.TmpDir, layoutDir)
+	desc, manifest, raw, err := readLayout(layout)
 	if err != nil {
-		return err
+		return fmt.Errorf("read image layout: %w", err)
 	}
-	defer c.docker.Close()
 
-	authStr, err := c.Authentication(app)
-	if err != nil {
-		return err
+	c := NewRegistryClient(app)
+	blobs := append([]Descriptor{manifest.Config}, manifest.Layers...)
+	var uploaded int64
+	for _, blob := range blobs {
+		logger.LogCommand("pushing blob " + blob.Digest)
+		// PushBlob skips blobs the registry already has, so a retry or a
+		// rerun after a failed push only sends the missing chunks.
+		err := retry(ctx, "pushing blob "+blob.Digest, func() error {
+			sent, err := c.PushBlob(ctx, blob, app.Config.Docker.MountFrom, func() (io.ReadCloser, error) {
+				return os.Open(blobPath(layout, blob.Digest))
+			})
+			if sent {
+				uploaded += blob.Size
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	out, err := c.docker.ImagePush(ctx, app.Config.Docker.ImagePath, image.PushOptions{RegistryAuth: authStr})
-	if err != nil {
+	// How much had to be sent is only known now, so it is added to the
+	// manifest Build wrote.
+	if raw, err = setAnnotation(raw, annotationPrefix+"uploaded", strconv.FormatInt(uploaded, 10)); err != nil {
 		return err
 	}
-	defer out.Close()
-
-	return c.ParseOutput(out)
+	logger.LogCommand("pushing manifest " + digestOf(raw) + " as " + app.Config.Docker.ImagePath)
+	return c.PushManifest(ctx, app.Config.Docker.Tag, desc.MediaType, raw)
 }
 
-func Pull(ctx context.Context, app *config.Application) error {
-	c, err := NewClient()
+// Unpack fetches the backup layer of the tagged image straight from the
+// registry and extracts the backup (and roles) file into TmpDir. Only the
+// manifest and that one blob are downloaded; the blob is streamed through
+// gzip and tar readers and its digest is checked once it has been read.
+//
+// File names and the source database are taken from the image's metadata;
+// for images without metadata they are derived from --db-source and the tag
+// the way older bocker versions named them.
+func Unpack(ctx context.Context, app *config.Application) error {
+	c := NewRegistryClient(app)
+	_, manifest, _, err := c.GetManifest(ctx, app.Config.Docker.Tag)
 	if err != nil {
 		return err
 	}
-	defer c.docker.Close()
-
-	authStr, err := c.Authentication(app)
-	if err != nil {
+	meta := MetadataFromAnnotations(manifest.Annotations)
+	if err := applyMetadata(app, meta); err != nil {
 		return err
 	}
-
-	out, err := c.docker.ImagePull(ctx, app.Config.Docker.ImagePath, image.PullOptions{RegistryAuth: authStr})
-	if err != nil {
-		return err
+	if len(manifest.Layers) == 0 {
+		return fmt.Errorf("docker image manifest has no layers")
 	}
-	defer out.Close()
 
-	return c.ParseOutput(out)
-}
+	// The roles file is small and lives in the same layer, so take it along
+	// whenever the metadata says it's there, not only on --import-roles.
+	wanted := map[string]bool{app.Config.DB.BackupFileName: true}
+	if app.Config.DB.ImportRoles || meta.Roles {
+		wanted[app.Config.DB.RolesFileName] = true
+	}
 
-func Save(ctx context.Context, app *config.Application, outputFile string) (string, error) {
-	outputFilePath := filepath.Join(app.Config.TmpDir, outputFile)
+	// The layer media type says how the backup was stored and compressed.
+	switch mediaType := manifest.Layers[0].MediaType; {
+	case isChunkLayer(mediaType):
+		if err := unpackChunks(ctx, c, manifest, app.Config.TmpDir, wanted, meta); err != nil {
+			return err
+		}
+	case isFileLayer(mediaType):
+		if err := unpackFiles(ctx, c, manifest.Layers, app.Config.TmpDir, wanted, meta); err != nil {
+			return err
+		}
+	default:
+		// Images from before backups were split hold all files in a single
+		// tar layer, the last one of the image.
+		layer := manifest.Layers[len(manifest.Layers)-1]
+		if layer.MediaType != MediaTypeLayerGzip && layer.MediaType != MediaTypeDockerLayerGzip {
+			return fmt.Errorf("unsupported layer media type %q", layer.MediaType)
+		}
 
-	c, err := NewClient()
-	if err != nil {
-		return "", err
+		logger.LogCommand("fetching blob " + layer.Digest)
+		body, err := c.GetBlob(ctx, layer.Digest)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		if err := extractLayer(body, layer, app.Config.TmpDir, wanted); err != nil {
+			return err
+		}
+	}
+	for name := range wanted {
+		if _, err := os.Stat(filepath.Join(app.Config.TmpDir, name)); err != nil {
+			return fmt.Errorf("%s not found in backup image", name)
+		}
 	}
-	defer c.docker.Close()
+	return nil
+}
 
-	rc, err := c.docker.ImageSave(ctx, []string{app.Config.Docker.ImagePath})
+// unpackFiles reassembles the wanted files of a split backup into dir. The
+// backup file is checked as a whole against meta.SHA256 on top of the
+// per-part digests.
+func unpackFiles(ctx context.Context, c *RegistryClient, layers []Descriptor, dir string, wanted map[string]bool, meta Metadata) error {
+	files, err := fileParts(layers)
 	if err != nil {
-		return "", err
+		return err
+	}
+	for name := range wanted {
+		parts, ok := files[name]
+		if !ok {
+			continue
+		}
+		sum, err := joinParts(ctx, c, parts, dir, name)
+		if err != nil {
+			return err
+		}
+		if err := checkSum(name, sum, meta); err != nil {
+			return err
+		}
 	}
-	defer rc.Close()
+	return nil
+}
 
-	f, err := os.Create(outputFilePath)
+// maxConfigSize caps how much of an image config is read. The chunk list of
+// a deduplicated backup takes about 80 bytes per chunk.
+const maxConfigSize = 64 << 20
+
+// unpackChunks reassembles the wanted files of a deduplicated backup into dir
+// from the chunk lists in the image config.
+func unpackChunks(ctx context.Context, c *RegistryClient, manifest *Manifest, dir string, wanted map[string]bool, meta Metadata) error {
+	var raw []byte
+	err := retry(ctx, "fetching config "+manifest.Config.Digest, func() error {
+		body, err := c.GetBlob(ctx, manifest.Config.Digest)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		if raw, err = io.ReadAll(io.LimitReader(body, maxConfigSize)); err != nil {
+			return err
+		}
+		if digestOf(raw) != manifest.Config.Digest {
+			return fmt.Errorf("config digest mismatch: expected %s, got %s", manifest.Config.Digest, digestOf(raw))
+		}
+		return nil
+	})
 	if err != nil {
-		return "", err
+		return err
+	}
+	var cfg ImageConfig
+	if err := json.Unmarshal(raw, &cfg); err != nil {
+		return fmt.Errorf("parse image config: %w", err)
 	}
-	defer f.Close()
 
-	if _, err := io.Copy(f, rc); err != nil {
-		return "", err
+	chunks := make(map[string]Descriptor, len(manifest.Layers))
+	for _, l := range manifest.Layers {
+		chunks[l.Digest] = l
+	}
+	for _, f := range cfg.Files {
+		if !wanted[f.Name] {
+			continue
+		}
+		parts := make([]Descriptor, 0, len(f.Chunks))
+		for _, d := range f.Chunks {
+			l, ok := chunks[d]
+			if !ok {
+				return fmt.Errorf("%s: chunk %s is not a layer of the image", f.Name, d)
+			}
+			parts = append(parts, l)
+		}
+		sum, err := joinParts(ctx, c, parts, dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if err := checkSum(f.Name, sum, meta); err != nil {
+			return err
+		}
 	}
-	return outputFilePath, nil
+	return nil
 }
 
-func Unpack(ctx context.Context, app *config.Application) error {
-	outputFile := "output.tar"
-	outputFilePath, err := Save(ctx, app, outputFile)
-	if err != nil {
-		return err
+// checkSum compares the SHA-256 of a reassembled file with the one recorded
+// for the backup file.
+func checkSum(name, sum string, meta Metadata) error {
+	if name == meta.FileName && meta.SHA256 != "" && sum != meta.SHA256 {
+		return fmt.Errorf("%s: checksum mismatch after reassembly: expected %s, got %s", name, meta.SHA256, sum)
 	}
+	return nil
+}
 
-	manifestFile := "manifest.json"
-	if err := tar.Untar(ctx, outputFilePath, manifestFile, app.Config.TmpDir); err != nil {
-		logger.LogCommand("Couldn't unpack file")
-		logger.LogCommand(err.Error())
-		return err
+// applyMetadata points the restore at the files described by meta.
+func applyMetadata(app *config.Application, meta Metadata) error {
+	engine := meta.Engine
+	if engine == "" {
+		engine = db.EnginePostgres
+	}
+	if app.Config.DB.Engine != "" && app.Config.DB.Engine != engine {
+		return fmt.Errorf("backup %s was made with the %s engine, not %s", app.Config.Docker.Tag, engine, app.Config.DB.Engine)
 	}
+	app.Config.DB.Engine = engine
 
-	file, err := os.ReadFile(filepath.Join(app.Config.TmpDir, manifestFile))
-	if err != nil {
-		return err
+	if meta.FileName == "" {
+		if app.Config.DB.SourceName == "" {
+			return fmt.Errorf("image %s carries no bocker metadata; pass --db-source", app.Config.Docker.ImagePath)
+		}
+		app.Config.DB.BackupFileName = fmt.Sprintf("%s_%s_backup.psql", app.Config.DB.SourceName, app.Config.Docker.Tag)
+		app.Config.DB.RolesFileName = fmt.Sprintf("%s_%s_roles_backup.sql", app.Config.DB.SourceName, app.Config.Docker.Tag)
+		return nil
 	}
-	var manifest []Image
-	if err := json.Unmarshal(file, &manifest); err != nil {
-		return err
+
+	if app.Config.DB.SourceName == "" {
+		app.Config.DB.SourceName = meta.Database
 	}
-	if len(manifest) == 0 || len(manifest[0].Layers) == 0 {
-		return fmt.Errorf("docker image manifest has no layers")
+	app.Config.DB.BackupFileName = meta.FileName
+	app.Config.DB.RolesFileName = meta.RolesFileName
+	app.Config.DB.ServerVersion = meta.ServerVersion
+	app.Config.DB.Format = meta.Format
+	if app.Config.DB.ImportRoles && !meta.Roles {
+		return fmt.Errorf("backup %s was created without --export-roles; cannot import roles", app.Config.Docker.Tag)
 	}
 
-	backupLayerTar := manifest[0].Layers[len(manifest[0].Layers)-1]
-	if err := tar.Untar(ctx, filepath.Join(app.Config.TmpDir, outputFile), backupLayerTar, app.Config.TmpDir); err != nil {
+	app.Config.Encryption.Mode = meta.Encryption
+	if meta.Encryption == "" {
+		return nil
+	}
+	ids, err := crypt.Identities(app)
+	if err != nil {
 		return err
 	}
-	return tar.Untar(ctx, filepath.Join(app.Config.TmpDir, backupLayerTar), app.Config.DB.BackupFileName, app.Config.TmpDir)
+	return crypt.CheckIdentities(ids, meta.Encryption, meta.Recipients)
 }
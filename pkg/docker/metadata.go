@@ -0,0 +1,198 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// annotationPrefix namespaces bocker's annotations, following the reverse-DNS
+// convention of the OCI image spec.
+const annotationPrefix = "dev.software-services.bocker."
+
+// Metadata describes the backup stored in an image. It is written as manifest
+// annotations and image labels when the backup is created and read back by
+// `backup list` and `restore`.
+type Metadata struct {
+	// Engine is the pkg/db engine that made the dump. Backups from before
+	// engines existed leave it empty and are PostgreSQL.
+	Engine        string `json:"engine,omitempty" yaml:"engine,omitempty"`
+	Database      string `json:"database,omitempty" yaml:"database,omitempty"`
+	ServerVersion string `json:"server_version,omitempty" yaml:"server_version,omitempty"`
+	DumpVersion   string `json:"dump_version,omitempty" yaml:"dump_version,omitempty"`
+	Format        string `json:"format,omitempty" yaml:"format,omitempty"`
+	Roles         bool   `json:"roles" yaml:"roles"`
+	FileName      string `json:"file_name,omitempty" yaml:"file_name,omitempty"`
+	RolesFileName string `json:"roles_file_name,omitempty" yaml:"roles_file_name,omitempty"`
+	SHA256        string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	// PlainSHA256 is the checksum of the backup file before encryption,
+	// recorded by streamed pushes such as wal-push.
+	PlainSHA256 string `json:"plain_sha256,omitempty" yaml:"plain_sha256,omitempty"`
+	// WALStart is the WAL file a physical backup starts in; archived WAL
+	// before it is of no use for restoring the backup.
+	WALStart      string `json:"wal_start,omitempty" yaml:"wal_start,omitempty"`
+	BockerVersion string `json:"bocker_version,omitempty" yaml:"bocker_version,omitempty"`
+	// LogicalSize is the uncompressed size of the backup's files and
+	// Uploaded how many bytes the push actually sent; with --dedup the
+	// latter is usually a small fraction of the image size.
+	LogicalSize int64 `json:"logical_size,omitempty" yaml:"logical_size,omitempty"`
+	Uploaded    int64 `json:"uploaded,omitempty" yaml:"uploaded,omitempty"`
+	// Encryption is the crypt mode the files were encrypted with, if any,
+	// and Recipients the age public keys they were encrypted to.
+	Encryption string   `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+	Recipients []string `json:"recipients,omitempty" yaml:"recipients,omitempty"`
+	// Verified is the RFC 3339 time `bocker verify --record` last restored
+	// the backup successfully. It is read from the backup's verification
+	// record (see MarkVerified); older bocker versions wrote it into the
+	// backup's own manifest.
+	Verified string `json:"verified,omitempty" yaml:"verified,omitempty"`
+}
+
+// Annotations encodes m as OCI annotations. Empty fields are left out.
+func (m Metadata) Annotations() map[string]string {
+	a := map[string]string{}
+	set := func(key, value string) {
+		if value != "" {
+			a[annotationPrefix+key] = value
+		}
+	}
+	set("engine", m.Engine)
+	set("database", m.Database)
+	set("server-version", m.ServerVersion)
+	set("dump-version", m.DumpVersion)
+	set("format", m.Format)
+	set("roles", strconv.FormatBool(m.Roles))
+	set("file", m.FileName)
+	set("roles-file", m.RolesFileName)
+	set("sha256", m.SHA256)
+	set("plain-sha256", m.PlainSHA256)
+	set("wal-start", m.WALStart)
+	set("version", m.BockerVersion)
+	if m.LogicalSize > 0 {
+		set("logical-size", strconv.FormatInt(m.LogicalSize, 10))
+		set("uploaded", strconv.FormatInt(m.Uploaded, 10))
+	}
+	set("encryption", m.Encryption)
+	set("recipients", strings.Join(m.Recipients, ","))
+	set("verified", m.Verified)
+	return a
+}
+
+// MetadataFromAnnotations is the inverse of Metadata.Annotations. Images
+// created before bocker recorded metadata yield the zero value.
+func MetadataFromAnnotations(a map[string]string) Metadata {
+	roles, _ := strconv.ParseBool(a[annotationPrefix+"roles"])
+	logical, _ := strconv.ParseInt(a[annotationPrefix+"logical-size"], 10, 64)
+	uploaded, _ := strconv.ParseInt(a[annotationPrefix+"uploaded"], 10, 64)
+	var recipients []string
+	if r := a[annotationPrefix+"recipients"]; r != "" {
+		recipients = strings.Split(r, ",")
+	}
+	return Metadata{
+		Engine:        a[annotationPrefix+"engine"],
+		Database:      a[annotationPrefix+"database"],
+		ServerVersion: a[annotationPrefix+"server-version"],
+		DumpVersion:   a[annotationPrefix+"dump-version"],
+		Format:        a[annotationPrefix+"format"],
+		Roles:         roles,
+		FileName:      a[annotationPrefix+"file"],
+		RolesFileName: a[annotationPrefix+"roles-file"],
+		SHA256:        a[annotationPrefix+"sha256"],
+		PlainSHA256:   a[annotationPrefix+"plain-sha256"],
+		WALStart:      a[annotationPrefix+"wal-start"],
+		BockerVersion: a[annotationPrefix+"version"],
+		LogicalSize:   logical,
+		Uploaded:      uploaded,
+		Encryption:    a[annotationPrefix+"encryption"],
+		Recipients:    recipients,
+		Verified:      a[annotationPrefix+"verified"],
+	}
+}
+
+// MediaTypeVerification is the artifact type of the records `bocker verify
+// --record` pushes.
+const MediaTypeVerification = "application/vnd.dev.software-services.bocker.verification.v1"
+
+// emptyJSON is the OCI empty descriptor's content, used as the config and
+// only layer of verification records.
+var emptyJSON = []byte("{}")
+
+// MarkVerified records a successful verification at the given time. The
+// record is a separate artifact, tagged VerifiedTagPrefix plus the backup's
+// tag, whose subject is the backup's manifest: the backup itself is left
+// untouched and keeps its digest. A newer record replaces an older one, and
+// a record whose subject no longer matches the tag is ignored.
+func MarkVerified(ctx context.Context, app *config.Application, at time.Time) error {
+	c := NewRegistryClient(app)
+	tag := app.Config.Docker.Tag
+	desc, _, _, err := c.GetManifest(ctx, tag)
+	if err != nil {
+		return err
+	}
+	if desc.MediaType == "" {
+		desc.MediaType = MediaTypeImageManifest
+	}
+
+	empty := Descriptor{MediaType: MediaTypeEmptyJSON, Digest: digestOf(emptyJSON), Size: int64(len(emptyJSON))}
+	if _, err := c.PushBlob(ctx, empty, "", func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(emptyJSON)), nil
+	}); err != nil {
+		return err
+	}
+
+	verified := at.UTC().Format(time.RFC3339)
+	record, err := json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		ArtifactType:  MediaTypeVerification,
+		Config:        empty,
+		Layers:        []Descriptor{empty},
+		Subject:       &desc,
+		Annotations:   map[string]string{AnnotationCreated: verified, annotationPrefix + "verified": verified},
+	})
+	if err != nil {
+		return err
+	}
+	return c.PushManifest(ctx, VerifiedTagPrefix+tag, MediaTypeImageManifest, record)
+}
+
+// verifiedAt returns when the backup with the given manifest digest was
+// verified according to the record tagged record, or "" if the record is
+// gone or belongs to an earlier backup under the same tag.
+func (c *RegistryClient) verifiedAt(ctx context.Context, record, digest string) (string, error) {
+	_, manifest, _, err := c.GetManifest(ctx, record)
+	if errors.Is(err, ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if manifest.Subject == nil || manifest.Subject.Digest != digest {
+		return "", nil
+	}
+	return manifest.Annotations[annotationPrefix+"verified"], nil
+}
+
+// setAnnotation returns the manifest raw with the annotation key set to
+// value. It decodes into a generic map so fields bocker doesn't know about
+// survive the round trip.
+func setAnnotation(raw []byte, key, value string) ([]byte, error) {
+	var manifest map[string]any
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, err
+	}
+	annotations, _ := manifest["annotations"].(map[string]any)
+	if annotations == nil {
+		annotations = map[string]any{}
+	}
+	annotations[key] = value
+	manifest["annotations"] = annotations
+	return json.Marshal(manifest)
+}
@@ -0,0 +1,323 @@
+package docker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MediaTypeImageManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeImageIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeImageConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayerGzip     = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeEmptyJSON     = "application/vnd.oci.empty.v1+json"
+
+	// Images pushed by older bocker versions went through `docker push` and
+	// carry Docker's media types instead of the OCI ones.
+	MediaTypeDockerManifest  = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// MediaTypeFileGzip is a layer holding a gzip-compressed part of a single
+	// file rather than a tar archive: a tar entry needs its size up front,
+	// which a dump still being produced doesn't have, and a tar layer can't
+	// be split. The file name is in the layer's AnnotationTitle and the
+	// position in AnnotationPart.
+	MediaTypeFileGzip = "application/vnd.dev.software-services.bocker.file.v1+gzip"
+
+	// AnnotationCreated and AnnotationTitle are the pre-defined OCI annotation
+	// keys for the creation time of an image and the file name of a blob.
+	AnnotationCreated = "org.opencontainers.image.created"
+	AnnotationTitle   = "org.opencontainers.image.title"
+	AnnotationRefName = "org.opencontainers.image.ref.name"
+)
+
+// Descriptor points at a blob in a registry or OCI layout.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// Manifest is an OCI image manifest. ArtifactType and Subject are only set
+// on artifacts that refer to another manifest, such as verification records.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	ArtifactType  string            `json:"artifactType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Subject       *Descriptor       `json:"subject,omitempty"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Index is the index.json of an OCI image layout.
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// ImageConfig is the subset of the OCI image configuration bocker writes.
+// The backup image has no entrypoint; the config carries the diff IDs of the
+// layers and the metadata labels.
+type ImageConfig struct {
+	Created      string `json:"created"`
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Config       struct {
+		Labels map[string]string `json:"Labels,omitempty"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+	// Files is only set for deduplicated backups and says how to reassemble
+	// each file from the MediaTypeChunkGzip layers.
+	Files []ChunkedFile `json:"dev.software-services.bocker.files,omitempty"`
+}
+
+// layoutDir is where Build writes the OCI image layout inside TmpDir.
+const layoutDir = "image"
+
+// digestWriter hashes and counts everything written to it.
+type digestWriter struct {
+	h hash.Hash
+	n int64
+}
+
+func newDigestWriter() *digestWriter { return &digestWriter{h: sha256.New()} }
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	d.n += int64(len(p))
+	return d.h.Write(p)
+}
+
+func (d *digestWriter) Digest() string { return "sha256:" + hex.EncodeToString(d.h.Sum(nil)) }
+
+func digestOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// blobPath returns the location of a blob inside an OCI layout.
+func blobPath(layout, digest string) string {
+	algo, hexDigest, _ := strings.Cut(digest, ":")
+	return filepath.Join(layout, "blobs", algo, hexDigest)
+}
+
+// writeBlob stores data in the layout and returns its descriptor.
+func writeBlob(layout, mediaType string, data []byte) (Descriptor, error) {
+	desc := Descriptor{
+		MediaType: mediaType,
+		Digest:    digestOf(data),
+		Size:      int64(len(data)),
+	}
+	if err := os.WriteFile(blobPath(layout, desc.Digest), data, 0600); err != nil {
+		return Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// initLayout creates the skeleton of an OCI image layout.
+func initLayout(layout string) error {
+	if err := os.MkdirAll(filepath.Join(layout, "blobs", "sha256"), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(layout, "oci-layout"), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0600)
+}
+
+// writeBlobFrom stores everything read from r as a blob in the layout and
+// returns its descriptor.
+func writeBlobFrom(layout, mediaType string, r io.Reader) (Descriptor, error) {
+	tmp, err := os.CreateTemp(filepath.Join(layout, "blobs", "sha256"), "blob-")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	digest := newDigestWriter()
+	if _, err := io.Copy(io.MultiWriter(tmp, digest), r); err != nil {
+		return Descriptor{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Descriptor{}, err
+	}
+	desc := Descriptor{MediaType: mediaType, Digest: digest.Digest(), Size: digest.n}
+	if err := os.Rename(tmp.Name(), blobPath(layout, desc.Digest)); err != nil {
+		return Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// encodeImage returns the config and manifest for an image made of layers.
+// annotations end up both on the manifest and as labels in the image config,
+// so they are visible to registries as well as to `docker inspect`.
+func encodeImage(layers []Descriptor, diffIDs []string, files []ChunkedFile, created time.Time, annotations map[string]string) (cfgJSON []byte, cfgDesc Descriptor, manifestJSON []byte, err error) {
+	var cfg ImageConfig
+	cfg.Created = created.UTC().Format(time.RFC3339)
+	cfg.Architecture = "amd64"
+	cfg.OS = "linux"
+	cfg.Config.Labels = annotations
+	cfg.RootFS.Type = "layers"
+	cfg.RootFS.DiffIDs = diffIDs
+	cfg.Files = files
+	cfgJSON, err = json.Marshal(cfg)
+	if err != nil {
+		return nil, Descriptor{}, nil, err
+	}
+	cfgDesc = Descriptor{
+		MediaType: MediaTypeImageConfig,
+		Digest:    digestOf(cfgJSON),
+		Size:      int64(len(cfgJSON)),
+	}
+
+	manifestAnnotations := map[string]string{AnnotationCreated: cfg.Created}
+	for k, v := range annotations {
+		manifestAnnotations[k] = v
+	}
+	manifestJSON, err = json.Marshal(Manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageManifest,
+		Config:        cfgDesc,
+		Layers:        layers,
+		Annotations:   manifestAnnotations,
+	})
+	if err != nil {
+		return nil, Descriptor{}, nil, err
+	}
+	return cfgJSON, cfgDesc, manifestJSON, nil
+}
+
+// writeImage writes the config, manifest and index for layers into layout and
+// tags the result as tag.
+func writeImage(layout, tag string, layers []Descriptor, diffIDs []string, files []ChunkedFile, created time.Time, annotations map[string]string) error {
+	cfgJSON, _, manifestJSON, err := encodeImage(layers, diffIDs, files, created, annotations)
+	if err != nil {
+		return err
+	}
+	if _, err := writeBlob(layout, MediaTypeImageConfig, cfgJSON); err != nil {
+		return err
+	}
+	manifestDesc, err := writeBlob(layout, MediaTypeImageManifest, manifestJSON)
+	if err != nil {
+		return err
+	}
+	manifestDesc.Annotations = map[string]string{AnnotationRefName: tag}
+
+	index, err := json.Marshal(Index{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeImageIndex,
+		Manifests:     []Descriptor{manifestDesc},
+	})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(layout, "index.json"), index, 0600)
+}
+
+// readLayout returns the tagged manifest stored in an OCI layout together
+// with its raw bytes, which are pushed verbatim so the digest is preserved.
+func readLayout(layout string) (Descriptor, *Manifest, []byte, error) {
+	data, err := os.ReadFile(filepath.Join(layout, "index.json"))
+	if err != nil {
+		return Descriptor{}, nil, nil, err
+	}
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return Descriptor{}, nil, nil, err
+	}
+	if len(index.Manifests) != 1 {
+		return Descriptor{}, nil, nil, fmt.Errorf("expected exactly one manifest in %s, found %d", layout, len(index.Manifests))
+	}
+
+	desc := index.Manifests[0]
+	raw, err := os.ReadFile(blobPath(layout, desc.Digest))
+	if err != nil {
+		return Descriptor{}, nil, nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return Descriptor{}, nil, nil, err
+	}
+	return desc, &manifest, raw, nil
+}
+
+// extractLayer reads a gzip-compressed tar layer from r and writes the
+// entries named in wanted into dir. Entries are matched by exact name, so
+// paths in the archive never influence where files land. The whole blob is
+// consumed so its digest can be verified against desc; on mismatch the
+// extracted files are removed again.
+func extractLayer(r io.Reader, desc Descriptor, dir string, wanted map[string]bool) (err error) {
+	verifier := newDigestWriter()
+	tee := io.TeeReader(r, verifier)
+	gz, err := gzip.NewReader(tee)
+	if err != nil {
+		return fmt.Errorf("open layer %s: %w", desc.Digest, err)
+	}
+	defer gz.Close()
+
+	var written []string
+	defer func() {
+		if err != nil {
+			for _, p := range written {
+				os.Remove(p)
+			}
+		}
+	}()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read layer %s: %w", desc.Digest, err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !wanted[hdr.Name] {
+			continue
+		}
+		path := filepath.Join(dir, hdr.Name)
+		written = append(written, path)
+		if err := writeFile(path, tr); err != nil {
+			return err
+		}
+	}
+
+	// Drain whatever trails the tar end-of-archive marker so the digest covers
+	// the complete blob.
+	if _, err := io.Copy(io.Discard, gz); err != nil {
+		return fmt.Errorf("read layer %s: %w", desc.Digest, err)
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return fmt.Errorf("read layer %s: %w", desc.Digest, err)
+	}
+	if verifier.Digest() != desc.Digest {
+		return fmt.Errorf("layer digest mismatch: expected %s, got %s", desc.Digest, verifier.Digest())
+	}
+	return nil
+}
+
+func writeFile(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", filepath.Base(path), err)
+	}
+	return f.Close()
+}
@@ -0,0 +1,529 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// DockerHubRegistry is the registry host used when --registry is left at its
+// default. Docker Hub serves the Distribution API from a different host than
+// the one people type, so registryURL translates it.
+const DockerHubRegistry = "docker.io"
+
+// RegistryClient talks to an OCI Distribution v2 registry over HTTP, without
+// going through a Docker daemon.
+type RegistryClient struct {
+	httpClient *http.Client
+	baseURL    string
+	name       string
+	username   string
+	password   string
+	token      string
+	basic      bool
+}
+
+type registryError struct {
+	Errors []struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// NewRegistryClient returns a client for the repository configured on app.
+func NewRegistryClient(app *config.Application) *RegistryClient {
+	return &RegistryClient{
+		// Blob uploads can take a long time; rely on ctx for cancellation
+		// instead of a global timeout.
+		httpClient: &http.Client{},
+		baseURL:    registryURL(app.Config.Docker.Registry),
+		name:       RepositoryName(app),
+		username:   app.Config.Docker.Username,
+		password:   app.Config.Docker.Password,
+	}
+}
+
+// RepositoryName returns the repository path inside the registry, e.g.
+// "bueti/greenlight_backup".
+func RepositoryName(app *config.Application) string {
+	if app.Config.Docker.Namespace == "" {
+		return app.Config.Docker.Repository
+	}
+	return app.Config.Docker.Namespace + "/" + app.Config.Docker.Repository
+}
+
+// ImagePath returns the full image reference for the configured tag. The
+// registry host is omitted for Docker Hub to match what `docker pull` expects.
+func ImagePath(app *config.Application) string {
+	ref := RepositoryName(app) + ":" + app.Config.Docker.Tag
+	if IsDockerHub(app.Config.Docker.Registry) {
+		return ref
+	}
+	return app.Config.Docker.Registry + "/" + ref
+}
+
+// registryURL maps a registry host to the base URL of its Distribution API.
+// Plain HTTP is only assumed for loopback registries such as a local
+// registry:2; anything else must be reachable over TLS.
+func registryURL(host string) string {
+	if IsDockerHub(host) {
+		return "https://registry-1.docker.io"
+	}
+	if strings.HasPrefix(host, "http://") || strings.HasPrefix(host, "https://") {
+		return strings.TrimSuffix(host, "/")
+	}
+	hostname := host
+	if i := strings.LastIndex(hostname, ":"); i != -1 {
+		hostname = hostname[:i]
+	}
+	if hostname == "localhost" || hostname == "127.0.0.1" || hostname == "[::1]" {
+		return "http://" + host
+	}
+	return "https://" + host
+}
+
+// do sends the request built by newReq and transparently answers a 401
+// challenge (Basic or Bearer token auth) by retrying once with credentials.
+// newReq is called again for the retry, so it must be able to produce a fresh
+// body each time.
+func (c *RegistryClient) do(ctx context.Context, newReq func() (*http.Request, error)) (*http.Response, error) {
+	req, err := newReq()
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+	res, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		return res, nil
+	}
+
+	challenge := res.Header.Get("WWW-Authenticate")
+	drainAndClose(res)
+	if err := c.authenticate(ctx, challenge); err != nil {
+		return nil, err
+	}
+
+	req, err = newReq()
+	if err != nil {
+		return nil, err
+	}
+	c.authorize(req)
+	return c.httpClient.Do(req.WithContext(ctx))
+}
+
+func (c *RegistryClient) authorize(req *http.Request) {
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.basic:
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
+
+// authenticate handles a WWW-Authenticate challenge. For Bearer challenges it
+// fetches a token from the advertised realm; Basic challenges are satisfied by
+// authorize on the retry.
+func (c *RegistryClient) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.username == "" {
+			return errors.New("registry requires authentication but no username is configured")
+		}
+		c.basic = true
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported registry auth challenge %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid token realm in challenge %q", challenge)
+	}
+	q := realm.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull,push", c.name)
+	}
+	q.Set("scope", scope)
+	realm.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	tokenClient := http.Client{Timeout: 30 * time.Second}
+	res, err := tokenClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		if res.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("registry authentication failed, status code: %d", res.StatusCode)
+		}
+		return fmt.Errorf("token endpoint returned status %d", res.StatusCode)
+	}
+
+	var tok struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil {
+		return fmt.Errorf("decode registry token: %w", err)
+	}
+	c.token = tok.Token
+	if c.token == "" {
+		c.token = tok.AccessToken
+	}
+	if c.token == "" {
+		return errors.New("token endpoint returned an empty token")
+	}
+	return nil
+}
+
+// parseChallenge splits `Bearer realm="...",service="...",scope="..."` into
+// the scheme and its parameters.
+func parseChallenge(h string) (string, map[string]string) {
+	params := map[string]string{}
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(h), " ")
+	for rest != "" {
+		rest = strings.TrimLeft(rest, ", ")
+		key, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		var val string
+		if strings.HasPrefix(after, `"`) {
+			end := strings.Index(after[1:], `"`)
+			if end == -1 {
+				val, rest = after[1:], ""
+			} else {
+				val, rest = after[1:end+1], after[end+2:]
+			}
+		} else {
+			val, rest, _ = strings.Cut(after, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = val
+	}
+	return scheme, params
+}
+
+func (c *RegistryClient) url(format string, a ...any) string {
+	return c.baseURL + fmt.Sprintf(format, a...)
+}
+
+// resolve turns a Location header, which registries may send relative to the
+// API root, into an absolute URL.
+func (c *RegistryClient) resolve(location string) (*url.URL, error) {
+	base, err := url.Parse(c.baseURL)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload location %q: %w", location, err)
+	}
+	return base.ResolveReference(loc), nil
+}
+
+// BlobExists reports whether the repository already holds the blob.
+func (c *RegistryClient) BlobExists(ctx context.Context, digest string) (bool, error) {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodHead, c.url("/v2/%s/blobs/%s", c.name, digest), nil)
+	})
+	if err != nil {
+		return false, err
+	}
+	drainAndClose(res)
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("registry returned status %d for blob %s", res.StatusCode, digest)
+}
+
+// startUpload opens an upload session. When from is set the registry is
+// first asked to cross-mount the blob from that repository; mounted reports
+// whether that succeeded, in which case no upload is necessary.
+func (c *RegistryClient) startUpload(ctx context.Context, digest, from string) (location *url.URL, mounted bool, err error) {
+	path := c.url("/v2/%s/blobs/uploads/", c.name)
+	if from != "" && digest != "" {
+		path += "?" + url.Values{"mount": {digest}, "from": {from}}.Encode()
+	}
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, path, nil)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	defer drainAndClose(res)
+
+	switch res.StatusCode {
+	case http.StatusCreated:
+		return nil, true, nil
+	case http.StatusAccepted:
+		location, err = c.resolve(res.Header.Get("Location"))
+		return location, false, err
+	}
+	return nil, false, responseError(res, "start blob upload")
+}
+
+// PushBlob uploads a blob unless the repository already has it. open is
+// called only when the content actually needs to be sent; uploaded reports
+// whether it was.
+func (c *RegistryClient) PushBlob(ctx context.Context, desc Descriptor, from string, open func() (io.ReadCloser, error)) (uploaded bool, err error) {
+	exists, err := c.BlobExists(ctx, desc.Digest)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	location, mounted, err := c.startUpload(ctx, desc.Digest, from)
+	if err != nil {
+		return false, err
+	}
+	if mounted {
+		return false, nil
+	}
+
+	q := location.Query()
+	q.Set("digest", desc.Digest)
+	location.RawQuery = q.Encode()
+
+	body, err := open()
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	// The upload URL is already authorised by the session, so a retry on 401
+	// (which would need to rewind body) isn't expected here.
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, location.String(), body)
+	if err != nil {
+		return false, err
+	}
+	req.ContentLength = desc.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	c.authorize(req)
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer drainAndClose(res)
+	if res.StatusCode != http.StatusCreated {
+		return false, responseError(res, "upload blob "+desc.Digest)
+	}
+	return true, nil
+}
+
+// uploadChunkSize is the size of the PATCH requests PushStream sends. Each
+// chunk is held in memory so it can be resent after an auth challenge.
+const uploadChunkSize = 32 << 20
+
+// PushStream uploads everything read from r as a blob of the given media type.
+// Neither size nor digest need to be known up front: the content goes out in
+// chunked PATCH requests while it is hashed, and the digest is only named in
+// the final PUT that closes the upload.
+func (c *RegistryClient) PushStream(ctx context.Context, mediaType string, r io.Reader) (Descriptor, error) {
+	location, _, err := c.startUpload(ctx, "", "")
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	digest := newDigestWriter()
+	buf := make([]byte, uploadChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		if n > 0 {
+			// The chunk is in memory, so a failed request can simply be sent
+			// again; the data already uploaded stays in the session.
+			err := retry(ctx, "uploading blob chunk", func() error {
+				next, err := c.patchChunk(ctx, location, digest.n, buf[:n])
+				if err == nil {
+					location = next
+				}
+				return err
+			})
+			if err != nil {
+				return Descriptor{}, err
+			}
+			digest.Write(buf[:n])
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return Descriptor{}, readErr
+		}
+	}
+
+	desc := Descriptor{MediaType: mediaType, Digest: digest.Digest(), Size: digest.n}
+	q := location.Query()
+	q.Set("digest", desc.Digest)
+	location.RawQuery = q.Encode()
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodPut, location.String(), nil)
+	})
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer drainAndClose(res)
+	if res.StatusCode != http.StatusCreated {
+		return Descriptor{}, responseError(res, "finish blob upload "+desc.Digest)
+	}
+	return desc, nil
+}
+
+// patchChunk appends chunk, which starts at offset, to the upload session at
+// location and returns the location for the next request.
+func (c *RegistryClient) patchChunk(ctx context.Context, location *url.URL, offset int64, chunk []byte) (*url.URL, error) {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPatch, location.String(), bytes.NewReader(chunk))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+int64(len(chunk))-1))
+		return req, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer drainAndClose(res)
+	if res.StatusCode != http.StatusAccepted {
+		return nil, responseError(res, "upload blob chunk")
+	}
+	return c.resolve(res.Header.Get("Location"))
+}
+
+// PushManifest uploads a manifest under the given tag or digest reference.
+func (c *RegistryClient) PushManifest(ctx context.Context, reference, mediaType string, manifest []byte) error {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, c.url("/v2/%s/manifests/%s", c.name, reference), bytes.NewReader(manifest))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mediaType)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(res)
+	if res.StatusCode != http.StatusCreated {
+		return responseError(res, "push manifest "+reference)
+	}
+	return nil
+}
+
+// ErrNotFound is returned by GetManifest for tags the repository does not
+// have.
+var ErrNotFound = errors.New("not found")
+
+// maxManifestSize caps how much of a manifest is read; registries commonly
+// reject larger ones anyway.
+const maxManifestSize = 4 << 20
+
+// GetManifest fetches the image manifest for a tag or digest reference and
+// returns its descriptor along with the parsed and raw manifest.
+func (c *RegistryClient) GetManifest(ctx context.Context, reference string) (Descriptor, *Manifest, []byte, error) {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, c.url("/v2/%s/manifests/%s", c.name, reference), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", MediaTypeImageManifest+", "+MediaTypeDockerManifest)
+		return req, nil
+	})
+	if err != nil {
+		return Descriptor{}, nil, nil, err
+	}
+	defer drainAndClose(res)
+	if res.StatusCode != http.StatusOK {
+		if res.StatusCode == http.StatusNotFound {
+			return Descriptor{}, nil, nil, fmt.Errorf("tag %q %w in %s", reference, ErrNotFound, c.name)
+		}
+		return Descriptor{}, nil, nil, responseError(res, "get manifest "+reference)
+	}
+
+	// Manifests are small; cap the read so a misbehaving server can't make us
+	// buffer an arbitrary amount of data.
+	raw, err := io.ReadAll(io.LimitReader(res.Body, maxManifestSize))
+	if err != nil {
+		return Descriptor{}, nil, nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return Descriptor{}, nil, nil, fmt.Errorf("decode manifest %s: %w", reference, err)
+	}
+	desc := Descriptor{
+		MediaType: res.Header.Get("Content-Type"),
+		Digest:    res.Header.Get("Docker-Content-Digest"),
+		Size:      int64(len(raw)),
+	}
+	if desc.Digest == "" {
+		desc.Digest = digestOf(raw)
+	}
+	return desc, &manifest, raw, nil
+}
+
+// GetBlob opens a blob for reading. The caller must close the returned body
+// and is responsible for verifying its digest.
+func (c *RegistryClient) GetBlob(ctx context.Context, digest string) (io.ReadCloser, error) {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, c.url("/v2/%s/blobs/%s", c.name, digest), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer drainAndClose(res)
+		return nil, responseError(res, "get blob "+digest)
+	}
+	return res.Body, nil
+}
+
+// responseError turns a non-success registry response into an error carrying
+// the registry's own error codes where available.
+func responseError(res *http.Response, action string) error {
+	var regErr registryError
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	if json.Unmarshal(body, &regErr) == nil && len(regErr.Errors) > 0 {
+		msgs := make([]string, 0, len(regErr.Errors))
+		for _, e := range regErr.Errors {
+			msgs = append(msgs, e.Code+": "+e.Message)
+		}
+		return fmt.Errorf("%s: registry returned status %d: %s", action, res.StatusCode, strings.Join(msgs, "; "))
+	}
+	return fmt.Errorf("%s: registry returned status %d", action, res.StatusCode)
+}
+
+func drainAndClose(res *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+}
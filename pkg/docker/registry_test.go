@@ -0,0 +1,431 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// fakeRegistry is an in-memory Distribution API registry serving the
+// repository ns/repo.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	uploads   map[string][]byte
+	manifests map[string][]byte
+	// foreign are the blobs of other repositories, keyed by
+	// "<repository>@<digest>", which can be mounted into ns/repo.
+	foreign  map[string][]byte
+	requests []string
+	next     int
+}
+
+func newFakeRegistry(t *testing.T) (*fakeRegistry, *RegistryClient) {
+	t.Helper()
+	r := &fakeRegistry{
+		blobs:     map[string][]byte{},
+		uploads:   map[string][]byte{},
+		manifests: map[string][]byte{},
+		foreign:   map[string][]byte{},
+	}
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	app := &config.Application{}
+	app.Config.Docker.Registry = srv.URL
+	app.Config.Docker.Namespace = "ns"
+	app.Config.Docker.Repository = "repo"
+	return r, NewRegistryClient(app)
+}
+
+// count returns how many requests matched method and a path containing part.
+func (r *fakeRegistry) count(method, part string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, req := range r.requests {
+		m, path, _ := strings.Cut(req, " ")
+		if m == method && strings.Contains(path, part) {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.RequestURI())
+
+	const prefix = "/v2/ns/repo"
+	path, ok := strings.CutPrefix(req.URL.Path, prefix)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch {
+	case path == "/blobs/uploads/" && req.Method == http.MethodPost:
+		q := req.URL.Query()
+		if data, ok := r.foreign[q.Get("from")+"@"+q.Get("mount")]; ok {
+			r.blobs[q.Get("mount")] = data
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		r.next++
+		id := strconv.Itoa(r.next)
+		r.uploads[id] = nil
+		w.Header().Set("Location", prefix+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.HasPrefix(path, "/blobs/uploads/"):
+		r.serveUpload(w, req, strings.TrimPrefix(path, "/blobs/uploads/"))
+	case strings.HasPrefix(path, "/blobs/"):
+		data, ok := r.blobs[strings.TrimPrefix(path, "/blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if req.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case strings.HasPrefix(path, "/manifests/"):
+		r.serveManifest(w, req, strings.TrimPrefix(path, "/manifests/"))
+	case path == "/tags/list":
+		r.serveTags(w, req)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, id string) {
+	data, ok := r.uploads[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	switch req.Method {
+	case http.MethodPatch:
+		var start, end int
+		fmt.Sscanf(req.Header.Get("Content-Range"), "%d-%d", &start, &end)
+		if start != len(data) || end != start+len(body)-1 {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		r.uploads[id] = append(data, body...)
+		w.Header().Set("Location", req.URL.Path)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		data = append(data, body...)
+		digest := req.URL.Query().Get("digest")
+		if digestOf(data) != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		delete(r.uploads, id)
+		r.blobs[digest] = data
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *fakeRegistry) serveManifest(w http.ResponseWriter, req *http.Request, ref string) {
+	switch req.Method {
+	case http.MethodPut:
+		raw, _ := io.ReadAll(req.Body)
+		r.manifests[ref] = raw
+		r.manifests[digestOf(raw)] = raw
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet:
+		raw, ok := r.manifests[ref]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", MediaTypeImageManifest)
+		w.Header().Set("Docker-Content-Digest", digestOf(raw))
+		w.Write(raw)
+	case http.MethodDelete:
+		// Like registry:2, manifests can only be deleted by digest, which
+		// drops every tag pointing at them.
+		if !strings.HasPrefix(ref, "sha256:") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := r.manifests[ref]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, raw := range r.manifests {
+			if digestOf(raw) == ref {
+				delete(r.manifests, name)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveTags lists the tags n at a time, linking to the next page.
+func (r *fakeRegistry) serveTags(w http.ResponseWriter, req *http.Request) {
+	var names []string
+	for name := range r.manifests {
+		if !strings.HasPrefix(name, "sha256:") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	q := req.URL.Query()
+	last := q.Get("last")
+	start := sort.SearchStrings(names, last)
+	if last != "" && start < len(names) && names[start] == last {
+		start++
+	}
+	n, _ := strconv.Atoi(q.Get("n"))
+	page := names[start:]
+	if n > 0 && len(page) > n {
+		page = page[:n]
+		next := url.Values{"n": {strconv.Itoa(n)}, "last": {page[len(page)-1]}}
+		w.Header().Set("Link", fmt.Sprintf(`</v2/ns/repo/tags/list?%s>; rel="next"`, next.Encode()))
+	}
+	fmt.Fprintf(w, `{"name":"ns/repo","tags":[%s]}`, quoteAll(page))
+}
+
+func quoteAll(s []string) string {
+	q := make([]string, len(s))
+	for i, v := range s {
+		q[i] = strconv.Quote(v)
+	}
+	return strings.Join(q, ",")
+}
+
+func blobDescriptor(data []byte) Descriptor {
+	return Descriptor{MediaType: MediaTypeFileGzip, Digest: digestOf(data), Size: int64(len(data))}
+}
+
+func opener(data []byte, opened *int) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		*opened++
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+}
+
+func TestPushBlob(t *testing.T) {
+	reg, c := newFakeRegistry(t)
+	ctx := context.Background()
+	data := []byte("layer contents")
+	desc := blobDescriptor(data)
+
+	opened := 0
+	uploaded, err := c.PushBlob(ctx, desc, "", opener(data, &opened))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uploaded || opened != 1 {
+		t.Fatalf("first push: uploaded = %v, opened %d times; want true, once", uploaded, opened)
+	}
+	if got := reg.blobs[desc.Digest]; !bytes.Equal(got, data) {
+		t.Fatalf("stored blob = %q, want %q", got, data)
+	}
+
+	uploaded, err = c.PushBlob(ctx, desc, "", opener(data, &opened))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded || opened != 1 {
+		t.Fatalf("second push: uploaded = %v, opened %d times; want the existing blob to be skipped", uploaded, opened)
+	}
+	if n := reg.count(http.MethodPost, "/blobs/uploads/"); n != 1 {
+		t.Fatalf("started %d uploads, want 1", n)
+	}
+}
+
+func TestPushBlobDigestMismatch(t *testing.T) {
+	_, c := newFakeRegistry(t)
+	desc := blobDescriptor([]byte("expected"))
+	opened := 0
+	if _, err := c.PushBlob(context.Background(), desc, "", opener([]byte("actual"), &opened)); err == nil {
+		t.Fatal("push of content not matching its digest succeeded")
+	}
+}
+
+func TestPushBlobMount(t *testing.T) {
+	reg, c := newFakeRegistry(t)
+	ctx := context.Background()
+	data := []byte("shared layer")
+	desc := blobDescriptor(data)
+	reg.foreign["ns/other@"+desc.Digest] = data
+
+	opened := 0
+	uploaded, err := c.PushBlob(ctx, desc, "ns/other", opener(data, &opened))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded || opened != 0 {
+		t.Fatalf("uploaded = %v, opened %d times; want the blob mounted without sending it", uploaded, opened)
+	}
+	if _, ok := reg.blobs[desc.Digest]; !ok {
+		t.Fatal("mounted blob missing from the repository")
+	}
+
+	// A blob the other repository lacks is uploaded after all.
+	data = []byte("not shared")
+	desc = blobDescriptor(data)
+	uploaded, err = c.PushBlob(ctx, desc, "ns/other", opener(data, &opened))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uploaded || opened != 1 {
+		t.Fatalf("uploaded = %v, opened %d times; want an upload when the mount fails", uploaded, opened)
+	}
+	if got := reg.blobs[desc.Digest]; !bytes.Equal(got, data) {
+		t.Fatalf("stored blob = %q, want %q", got, data)
+	}
+}
+
+func TestPushStream(t *testing.T) {
+	for _, size := range []int{0, 1, uploadChunkSize, uploadChunkSize + 1000} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			reg, c := newFakeRegistry(t)
+			data := bytes.Repeat([]byte("0123456789abcdef"), size/16+1)[:size]
+
+			desc, err := c.PushStream(context.Background(), MediaTypeFileGzip, bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := blobDescriptor(data)
+			if !reflect.DeepEqual(desc, want) {
+				t.Fatalf("descriptor = %+v, want %+v", desc, want)
+			}
+			if got := reg.blobs[desc.Digest]; !bytes.Equal(got, data) {
+				t.Fatalf("stored %d bytes, want %d", len(got), len(data))
+			}
+			wantPatches := (size + uploadChunkSize - 1) / uploadChunkSize
+			if n := reg.count(http.MethodPatch, "/blobs/uploads/"); n != wantPatches {
+				t.Fatalf("sent %d chunks, want %d", n, wantPatches)
+			}
+		})
+	}
+}
+
+func TestGetManifest(t *testing.T) {
+	_, c := newFakeRegistry(t)
+	ctx := context.Background()
+	raw := []byte(`{"schemaVersion":2,"mediaType":"` + MediaTypeImageManifest + `","annotations":{"a":"b"}}`)
+	if err := c.PushManifest(ctx, "t1", MediaTypeImageManifest, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	desc, manifest, got, err := c.GetManifest(ctx, "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, raw) {
+		t.Fatalf("raw manifest = %s, want %s", got, raw)
+	}
+	want := Descriptor{MediaType: MediaTypeImageManifest, Digest: digestOf(raw), Size: int64(len(raw))}
+	if !reflect.DeepEqual(desc, want) {
+		t.Fatalf("descriptor = %+v, want %+v", desc, want)
+	}
+	if manifest.Annotations["a"] != "b" {
+		t.Fatalf("annotations = %v, want a=b", manifest.Annotations)
+	}
+
+	if _, _, _, err := c.GetManifest(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("missing tag: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	var realm string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/token":
+			user, pw, _ := req.BasicAuth()
+			if user != "alice" || pw != "secret" || req.URL.Query().Get("scope") != "repository:ns/repo:pull,push" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, `{"token":"tok"}`)
+		case req.Header.Get("Authorization") != "Bearer tok":
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm=%q,service="test"`, realm))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+	realm = srv.URL + "/token"
+
+	app := &config.Application{}
+	app.Config.Docker.Registry = srv.URL
+	app.Config.Docker.Namespace = "ns"
+	app.Config.Docker.Repository = "repo"
+	app.Config.Docker.Username = "alice"
+	app.Config.Docker.Password = "secret"
+	exists, err := NewRegistryClient(app).BlobExists(context.Background(), digestOf(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatal("request was not retried with the token")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:ns/repo:pull,push"`,
+			"Bearer",
+			map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:ns/repo:pull,push"},
+		},
+		{`Basic realm="Registry Realm"`, "Basic", map[string]string{"realm": "Registry Realm"}},
+		{`Bearer Realm=https://example.com/token, Service=example`, "Bearer", map[string]string{"realm": "https://example.com/token", "service": "example"}},
+		{`Bearer realm="https://example.com/token`, "Bearer", map[string]string{"realm": "https://example.com/token"}},
+		{"Basic", "Basic", map[string]string{}},
+		{"", "", map[string]string{}},
+	}
+	for _, tt := range tests {
+		scheme, params := parseChallenge(tt.header)
+		if scheme != tt.scheme || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("parseChallenge(%q) = %q, %v; want %q, %v", tt.header, scheme, params, tt.scheme, tt.params)
+		}
+	}
+}
+
+func TestRegistryURL(t *testing.T) {
+	tests := map[string]string{
+		"docker.io":              "https://registry-1.docker.io",
+		"ghcr.io":                "https://ghcr.io",
+		"localhost:5000":         "http://localhost:5000",
+		"127.0.0.1:5000":         "http://127.0.0.1:5000",
+		"registry.example:5000":  "https://registry.example:5000",
+		"http://registry.lan/":   "http://registry.lan",
+		"https://registry.lan:1": "https://registry.lan:1",
+	}
+	for host, want := range tests {
+		if got := registryURL(host); got != want {
+			t.Errorf("registryURL(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
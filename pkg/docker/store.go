@@ -0,0 +1,113 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// storedFile describes how one file of a backup ended up in the image.
+type storedFile struct {
+	layers  []Descriptor
+	diffIDs []string
+	sha256  string
+	size    int64
+	// chunks is only set for deduplicated files, whose layers are the
+	// chunks that weren't already stored.
+	chunks *ChunkedFile
+}
+
+// blobSink receives the layers of a backup as they are produced: the OCI
+// layout written by Build, or the registry itself when streaming.
+type blobSink interface {
+	// putStream stores a blob whose size and digest are not known up front.
+	putStream(mediaType string, r io.Reader) (Descriptor, error)
+	// putBlob stores a blob held in memory.
+	putBlob(desc Descriptor, data []byte) error
+}
+
+type layoutSink string
+
+func (l layoutSink) putStream(mediaType string, r io.Reader) (Descriptor, error) {
+	return writeBlobFrom(string(l), mediaType, r)
+}
+
+func (l layoutSink) putBlob(desc Descriptor, data []byte) error {
+	_, err := writeBlob(string(l), desc.MediaType, data)
+	return err
+}
+
+// registrySink uploads straight to the registry and counts the bytes it
+// actually had to send.
+type registrySink struct {
+	ctx      context.Context
+	c        *RegistryClient
+	uploaded int64
+}
+
+func (r *registrySink) putStream(mediaType string, src io.Reader) (Descriptor, error) {
+	desc, err := r.c.PushStream(r.ctx, mediaType, src)
+	if err == nil {
+		r.uploaded += desc.Size
+	}
+	return desc, err
+}
+
+func (r *registrySink) putBlob(desc Descriptor, data []byte) error {
+	return retry(r.ctx, "pushing blob "+desc.Digest, func() error {
+		uploaded, err := r.c.PushBlob(r.ctx, desc, "", func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		})
+		if uploaded {
+			r.uploaded += desc.Size
+		}
+		return err
+	})
+}
+
+// imageFiles collects the files of a backup image.
+type imageFiles struct {
+	layers  []Descriptor
+	diffIDs []string
+	chunked []ChunkedFile
+	sums    map[string]string
+	// plainSums are the checksums of encrypted files before encryption,
+	// where known.
+	plainSums map[string]string
+	logical   int64
+	seen      map[string]bool
+}
+
+func newImageFiles() *imageFiles {
+	return &imageFiles{sums: map[string]string{}, plainSums: map[string]string{}, seen: map[string]bool{}}
+}
+
+// add stores the contents of src as the file name, deduplicated when
+// --dedup is set and split into ChunkSize parts otherwise.
+func (img *imageFiles) add(app *config.Application, src io.Reader, name string, sink blobSink) error {
+	comp, err := compressionOf(app)
+	if err != nil {
+		return err
+	}
+	var f storedFile
+	if app.Config.Docker.Dedup {
+		f, err = dedupFile(src, name, comp, img.seen, sink.putBlob)
+	} else {
+		f, err = splitFile(src, name, chunkSize(app), comp, func(r io.Reader) (Descriptor, error) {
+			return sink.putStream(comp.fileMediaType(), r)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	img.layers = append(img.layers, f.layers...)
+	img.diffIDs = append(img.diffIDs, f.diffIDs...)
+	if f.chunks != nil {
+		img.chunked = append(img.chunked, *f.chunks)
+	}
+	img.sums[name] = f.sha256
+	img.logical += f.size
+	return nil
+}
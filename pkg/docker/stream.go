@@ -0,0 +1,104 @@
+package docker
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/crypt"
+	"bocker.software-services.dev/pkg/logger"
+)
+
+// StreamFile is one file of a streamed backup: the name it is restored under
+// and a function writing its contents, typically a dump tool's stdout.
+type StreamFile struct {
+	Name  string
+	Write func(ctx context.Context, w io.Writer) error
+}
+
+// PushStream is the streaming counterpart of Build followed by Push. The
+// output of each file's Write is encrypted when encryption is enabled, then
+// split (or deduplicated), compressed and hashed on its way into layer
+// uploads, so neither the dump nor the image ever touch the disk. The config
+// and manifest follow once all layers are in the registry.
+func PushStream(ctx context.Context, app *config.Application, files []StreamFile) error {
+	c := NewRegistryClient(app)
+	sink := &registrySink{ctx: ctx, c: c}
+	img := newImageFiles()
+	for _, f := range files {
+		logger.LogCommand("streaming " + f.Name)
+		if err := pushFile(ctx, app, img, sink, f); err != nil {
+			return fmt.Errorf("stream %s: %w", f.Name, err)
+		}
+	}
+
+	meta := buildMetadata(app, img)
+	cfgJSON, cfgDesc, manifestJSON, err := encodeImage(img.layers, img.diffIDs, img.chunked, time.Now(), meta.Annotations())
+	if err != nil {
+		return err
+	}
+	if err := sink.putBlob(cfgDesc, cfgJSON); err != nil {
+		return err
+	}
+	// As in Push, the upload count is only added to the manifest: putting it
+	// in the config would change the digest the manifest refers to.
+	if manifestJSON, err = setAnnotation(manifestJSON, annotationPrefix+"uploaded", strconv.FormatInt(sink.uploaded, 10)); err != nil {
+		return err
+	}
+	logger.LogCommand("pushing manifest " + digestOf(manifestJSON) + " as " + app.Config.Docker.ImagePath)
+	return c.PushManifest(ctx, app.Config.Docker.Tag, MediaTypeImageManifest, manifestJSON)
+}
+
+// pushFile runs f.Write in a goroutine and adds what it produces to img.
+func pushFile(ctx context.Context, app *config.Application, img *imageFiles, sink blobSink, f StreamFile) error {
+	// Cancelling stops the dump tool should the upload fail halfway.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	// The plaintext is hashed on its way into the encryption, so what was
+	// encrypted can be compared with a file later on.
+	plain := sha256.New()
+	go func() {
+		var w io.Writer = pw
+		var enc io.WriteCloser
+		err := func() error {
+			if crypt.Enabled(app) {
+				var err error
+				if enc, err = crypt.Encrypt(app, w); err != nil {
+					return err
+				}
+				w = io.MultiWriter(enc, plain)
+			}
+			if err := f.Write(ctx, w); err != nil {
+				return err
+			}
+			if enc != nil {
+				return enc.Close()
+			}
+			return nil
+		}()
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	if err := img.add(app, pr, f.Name, sink); err != nil {
+		pr.CloseWithError(err)
+		cancel()
+		<-done
+		return err
+	}
+	if err := <-done; err != nil {
+		return err
+	}
+	if crypt.Enabled(app) {
+		img.plainSums[f.Name] = hex.EncodeToString(plain.Sum(nil))
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+// Tag is one backup image in a repository.
+type Tag struct {
+	Name       string
+	Digest     string
+	Size       int64
+	LastPushed time.Time
+	Metadata   Metadata
+	// Compression is the --compression setting the backup was pushed with,
+	// read from its layer media types along with Metadata.
+	Compression string
+	// Verification is the tag of the backup's verification record, if it
+	// has one; Delete removes it along with the backup.
+	Verification string
+}
+
+// Registry is what backup listing and pruning need from a repository. Docker
+// Hub is served by its proprietary API (HTTPClient); every other registry by
+// the standard Distribution API (RegistryClient).
+type Registry interface {
+	// Tags lists the backups; WALTags the archived WAL files next to them.
+	// Tags may leave Metadata empty until Describe fills it in, so callers
+	// should narrow the list down first.
+	Tags(ctx context.Context) ([]Tag, error)
+	WALTags(ctx context.Context) ([]Tag, error)
+	Describe(ctx context.Context, tags []Tag) ([]Tag, error)
+	Delete(ctx context.Context, tag Tag) error
+}
+
+// WALTagPrefix starts the tags `bocker wal-push` stores WAL files under; the
+// rest of the tag is the file name PostgreSQL gave it.
+const WALTagPrefix = "wal-"
+
+// IsWALTag reports whether name is the tag of an archived WAL file.
+func IsWALTag(name string) bool {
+	return strings.HasPrefix(name, WALTagPrefix)
+}
+
+// VerifiedTagPrefix starts the tags `bocker verify --record` stores its
+// verification records under; the rest of the tag is the backup's tag.
+const VerifiedTagPrefix = "verified-"
+
+// isVerificationTag reports whether name is the tag of a verification record.
+func isVerificationTag(name string) bool {
+	return strings.HasPrefix(name, VerifiedTagPrefix)
+}
+
+// verificationTags returns the set of backup tags that have a verification
+// record among names.
+func verificationTags(names []string) map[string]bool {
+	verified := map[string]bool{}
+	for _, name := range names {
+		if isVerificationTag(name) {
+			verified[strings.TrimPrefix(name, VerifiedTagPrefix)] = true
+		}
+	}
+	return verified
+}
+
+// filterTags returns the tags whose name wal matches or not, leaving out
+// verification records and linking each backup to its record.
+func filterTags(tags []Tag, wal bool) []Tag {
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.Name
+	}
+	verified := verificationTags(names)
+
+	var out []Tag
+	for _, t := range tags {
+		if isVerificationTag(t.Name) || IsWALTag(t.Name) != wal {
+			continue
+		}
+		if verified[t.Name] {
+			t.Verification = VerifiedTagPrefix + t.Name
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// IsDockerHub reports whether host refers to Docker Hub.
+func IsDockerHub(host string) bool {
+	switch host {
+	case "", DockerHubRegistry, "index.docker.io", "registry-1.docker.io", "hub.docker.com":
+		return true
+	}
+	return false
+}
+
+// NewRegistry picks the Registry implementation for the configured registry.
+func NewRegistry(app *config.Application) (Registry, error) {
+	if IsDockerHub(app.Config.Docker.Registry) {
+		hub, err := NewHTTPClient(app)
+		if err != nil {
+			return nil, err
+		}
+		return &hubRegistry{hub: hub, registry: NewRegistryClient(app)}, nil
+	}
+	return NewRegistryClient(app), nil
+}
+
+// hubRegistry lists tags through the Hub API and fills in the backup metadata,
+// which the Hub API doesn't expose, from each tag's manifest. Every manifest
+// fetched counts as a pull against Hub's rate limit, so that only happens in
+// Describe.
+type hubRegistry struct {
+	hub      *HTTPClient
+	registry *RegistryClient
+}
+
+func (r *hubRegistry) Tags(ctx context.Context) ([]Tag, error) {
+	tags, err := r.hub.Tags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return filterTags(tags, false), nil
+}
+
+func (r *hubRegistry) Describe(ctx context.Context, tags []Tag) ([]Tag, error) {
+	out := make([]Tag, len(tags))
+	for i, t := range tags {
+		desc, manifest, _, err := r.registry.GetManifest(ctx, t.Name)
+		if err != nil {
+			return nil, err
+		}
+		t.Metadata = MetadataFromAnnotations(manifest.Annotations)
+		t.Compression = layerCompression(manifest.Layers)
+		if t.Verification != "" {
+			verified, err := r.registry.verifiedAt(ctx, t.Verification, desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if verified != "" {
+				t.Metadata.Verified = verified
+			}
+		}
+		out[i] = t
+	}
+	return out, nil
+}
+
+// WALTags needs nothing from the manifests: pruning goes by the tag names.
+func (r *hubRegistry) WALTags(ctx context.Context) ([]Tag, error) {
+	tags, err := r.hub.Tags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return filterTags(tags, true), nil
+}
+
+func (r *hubRegistry) Delete(ctx context.Context, tag Tag) error {
+	if err := r.hub.Delete(ctx, tag); err != nil {
+		return err
+	}
+	if tag.Verification == "" {
+		return nil
+	}
+	return r.hub.Delete(ctx, Tag{Name: tag.Verification})
+}
+
+// Tags lists the repository through the Distribution `/v2/<name>/tags/list`
+// endpoint, following `Link: <...>; rel="next"` headers across pages. The API
+// returns bare names, so each tag's manifest is fetched to fill in digest,
+// size and creation time.
+func (c *RegistryClient) Tags(ctx context.Context) ([]Tag, error) {
+	return c.tags(ctx, false)
+}
+
+// WALTags is Tags for the archived WAL files.
+func (c *RegistryClient) WALTags(ctx context.Context) ([]Tag, error) {
+	return c.tags(ctx, true)
+}
+
+// Describe returns tags unchanged: Tags already had to fetch every manifest
+// for the push times.
+func (c *RegistryClient) Describe(ctx context.Context, tags []Tag) ([]Tag, error) {
+	return tags, nil
+}
+
+// tags describes the backup tags, or with wal the WAL tags. There can be
+// thousands of WAL files, so their manifests are never fetched: WAL tags only
+// carry their name, which is all pruning them takes.
+func (c *RegistryClient) tags(ctx context.Context, wal bool) ([]Tag, error) {
+	var names []string
+	next := c.url("/v2/%s/tags/list?n=100", c.name)
+	for next != "" {
+		page, link, err := c.tagPage(ctx, next)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, page...)
+
+		next = ""
+		if link != "" {
+			u, err := c.resolve(link)
+			if err != nil {
+				return nil, err
+			}
+			next = u.String()
+		}
+	}
+
+	verified := verificationTags(names)
+	tags := make([]Tag, 0, len(names))
+	for _, name := range names {
+		if isVerificationTag(name) || IsWALTag(name) != wal {
+			continue
+		}
+		if wal {
+			tags = append(tags, Tag{Name: name})
+			continue
+		}
+		tag, err := c.describe(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if verified[name] {
+			tag.Verification = VerifiedTagPrefix + name
+			at, err := c.verifiedAt(ctx, tag.Verification, tag.Digest)
+			if err != nil {
+				return nil, err
+			}
+			if at != "" {
+				tag.Metadata.Verified = at
+			}
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+// tagPage fetches one page of the tag list and returns the tag names and the
+// target of the next-page link, if any.
+func (c *RegistryClient) tagPage(ctx context.Context, pageURL string) ([]string, string, error) {
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, pageURL, nil)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	defer drainAndClose(res)
+	if res.StatusCode != http.StatusOK {
+		return nil, "", responseError(res, "list tags")
+	}
+
+	var list struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, "", fmt.Errorf("decode tag list: %w", err)
+	}
+	return list.Tags, nextLink(res.Header.Values("Link")), nil
+}
+
+// nextLink extracts the rel="next" target from RFC 8288 Link headers.
+func nextLink(headers []string) string {
+	for _, h := range headers {
+		for _, link := range strings.Split(h, ",") {
+			target, params, _ := strings.Cut(link, ";")
+			target = strings.TrimSpace(target)
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, p := range strings.Split(params, ";") {
+				k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+				if strings.EqualFold(k, "rel") && strings.Trim(v, `"`) == "next" {
+					return target[1 : len(target)-1]
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// describe builds a Tag from the tag's manifest. Images pushed by bocker carry
+// their creation time as a manifest annotation; for older images the image
+// config blob is consulted instead.
+func (c *RegistryClient) describe(ctx context.Context, name string) (Tag, error) {
+	desc, manifest, _, err := c.GetManifest(ctx, name)
+	if err != nil {
+		return Tag{}, err
+	}
+
+	tag := Tag{
+		Name:        name,
+		Digest:      desc.Digest,
+		Size:        manifest.Config.Size,
+		Metadata:    MetadataFromAnnotations(manifest.Annotations),
+		Compression: layerCompression(manifest.Layers),
+	}
+	for _, l := range manifest.Layers {
+		tag.Size += l.Size
+	}
+
+	created := manifest.Annotations[AnnotationCreated]
+	if created == "" {
+		cfg, err := c.imageConfig(ctx, manifest.Config.Digest)
+		if err != nil {
+			return Tag{}, err
+		}
+		created = cfg.Created
+	}
+	if created != "" {
+		if tag.LastPushed, err = time.Parse(time.RFC3339, created); err != nil {
+			return Tag{}, fmt.Errorf("cannot parse timestamp: %w", err)
+		}
+	}
+	return tag, nil
+}
+
+func (c *RegistryClient) imageConfig(ctx context.Context, digest string) (*ImageConfig, error) {
+	body, err := c.GetBlob(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var cfg ImageConfig
+	if err := json.NewDecoder(io.LimitReader(body, 4<<20)).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("decode image config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// Delete removes the tag's manifest. The Distribution API only deletes by
+// digest, which also drops any other tag pointing at the same manifest; bocker
+// never reuses a manifest across tags, so that is fine here.
+func (c *RegistryClient) Delete(ctx context.Context, tag Tag) error {
+	digest := tag.Digest
+	if digest == "" {
+		desc, _, _, err := c.GetManifest(ctx, tag.Name)
+		if err != nil {
+			return err
+		}
+		digest = desc.Digest
+	}
+
+	res, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodDelete, c.url("/v2/%s/manifests/%s", c.name, digest), nil)
+	})
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(res)
+	if res.StatusCode != http.StatusAccepted && res.StatusCode != http.StatusOK {
+		return responseError(res, "delete "+tag.Name)
+	}
+	if tag.Verification == "" {
+		return nil
+	}
+	if err := c.Delete(ctx, Tag{Name: tag.Verification}); err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	return nil
+}
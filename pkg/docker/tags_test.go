@@ -0,0 +1,178 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+)
+
+func TestNextLink(t *testing.T) {
+	tests := []struct {
+		headers []string
+		want    string
+	}{
+		{nil, ""},
+		{[]string{`</v2/ns/repo/tags/list?n=100&last=b>; rel="next"`}, "/v2/ns/repo/tags/list?n=100&last=b"},
+		{[]string{`<https://r.example/v2/x/tags/list?last=a>; rel=next`}, "https://r.example/v2/x/tags/list?last=a"},
+		{[]string{`</first>; rel="prev", </second>; rel="next"`}, "/second"},
+		{[]string{`</first>; rel="prev"`, `</second>; type="x"; REL="next"`}, "/second"},
+		{[]string{`/no-brackets; rel="next"`}, ""},
+		{[]string{`</last>; rel="last"`}, ""},
+	}
+	for _, tt := range tests {
+		if got := nextLink(tt.headers); got != tt.want {
+			t.Errorf("nextLink(%q) = %q, want %q", tt.headers, got, tt.want)
+		}
+	}
+}
+
+func TestTagsPagination(t *testing.T) {
+	reg, c := newFakeRegistry(t)
+	ctx := context.Background()
+	var want []string
+	for i := range 250 {
+		name := fmt.Sprintf("2024-01-01_00-%02d-%02d", i/60, i%60)
+		want = append(want, name)
+		reg.manifests[name] = fmt.Appendf(nil, `{"schemaVersion":2,"annotations":{%q:"2024-01-01T00:%02d:%02dZ"}}`, AnnotationCreated, i/60, i%60)
+	}
+	// WAL tags are listed by name only; this manifest is never fetched.
+	reg.manifests["wal-000000010000000000000001"] = []byte("{}")
+
+	tags, err := c.Tags(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tag := range tags {
+		got = append(got, tag.Name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %d tags, want the %d backup tags in order", len(got), len(want))
+	}
+	if n := reg.count(http.MethodGet, "/tags/list"); n != 3 {
+		t.Fatalf("fetched %d pages, want 3", n)
+	}
+
+	wal, err := c.WALTags(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wal) != 1 || wal[0].Name != "wal-000000010000000000000001" {
+		t.Fatalf("WAL tags = %v", wal)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	reg, c := newFakeRegistry(t)
+	ctx := context.Background()
+	raw := []byte(`{"schemaVersion":2}`)
+	if err := c.PushManifest(ctx, "t1", MediaTypeImageManifest, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a digest, Delete looks it up first: the registry only deletes
+	// by digest.
+	if err := c.Delete(ctx, Tag{Name: "t1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := c.GetManifest(ctx, "t1"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("after delete: err = %v, want ErrNotFound", err)
+	}
+	if n := reg.count(http.MethodDelete, "/manifests/"+digestOf(raw)); n != 1 {
+		t.Fatalf("sent %d deletes by digest, want 1", n)
+	}
+
+	if err := c.Delete(ctx, Tag{Name: "t1"}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleting a missing tag: err = %v, want ErrNotFound", err)
+	}
+	if err := c.Delete(ctx, Tag{Name: "t2", Digest: digestOf([]byte("other"))}); err == nil {
+		t.Fatal("deleting an unknown digest succeeded")
+	}
+}
+
+func TestLayerCompression(t *testing.T) {
+	tests := []struct {
+		layers []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{MediaTypeFileGzip, MediaTypeFileGzip}, "gzip"},
+		{[]string{MediaTypeFileZstd}, "zstd"},
+		{[]string{MediaTypeFile}, "none"},
+		{[]string{MediaTypeChunkZstd, MediaTypeChunkZstd}, "zstd"},
+		{[]string{MediaTypeChunk}, "none"},
+		{[]string{MediaTypeDockerLayerGzip, MediaTypeLayerGzip}, "gzip"},
+		{[]string{"application/octet-stream"}, ""},
+	}
+	for _, tt := range tests {
+		var layers []Descriptor
+		for _, mt := range tt.layers {
+			layers = append(layers, Descriptor{MediaType: mt})
+		}
+		if got := layerCompression(layers); got != tt.want {
+			t.Errorf("layerCompression(%v) = %q, want %q", tt.layers, got, tt.want)
+		}
+	}
+}
+
+func TestMarkVerified(t *testing.T) {
+	reg, c := newFakeRegistry(t)
+	ctx := context.Background()
+	app := &config.Application{}
+	app.Config.Docker.Registry = c.baseURL
+	app.Config.Docker.Namespace = "ns"
+	app.Config.Docker.Repository = "repo"
+	app.Config.Docker.Tag = "2024-03-12_02-00-00"
+
+	backup := fmt.Appendf(nil, `{"schemaVersion":2,"annotations":{%q:"2024-03-12T02:00:00Z"}}`, AnnotationCreated)
+	if err := c.PushManifest(ctx, "2024-03-12_02-00-00", MediaTypeImageManifest, backup); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 3, 13, 8, 0, 0, 0, time.UTC)
+	if err := MarkVerified(ctx, app, at); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backup's manifest, and so its digest, is left alone.
+	desc, _, _, err := c.GetManifest(ctx, "2024-03-12_02-00-00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Digest != digestOf(backup) {
+		t.Fatalf("backup digest changed to %s", desc.Digest)
+	}
+
+	tags, err := c.Tags(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Metadata.Verified != "2024-03-13T08:00:00Z" || tags[0].Verification != "verified-2024-03-12_02-00-00" {
+		t.Fatalf("tags = %+v, want the backup alone, verified", tags)
+	}
+
+	// A new backup under the same tag isn't verified by the old record.
+	rebuilt := fmt.Appendf(nil, `{"schemaVersion":2,"annotations":{%q:"2024-03-12T03:00:00Z"}}`, AnnotationCreated)
+	if err := c.PushManifest(ctx, "2024-03-12_02-00-00", MediaTypeImageManifest, rebuilt); err != nil {
+		t.Fatal(err)
+	}
+	if tags, err = c.Tags(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Metadata.Verified != "" {
+		t.Fatalf("tags = %+v, want the stale record ignored", tags)
+	}
+
+	// Deleting the backup takes its record along.
+	if err := c.Delete(ctx, tags[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reg.manifests["verified-2024-03-12_02-00-00"]; ok {
+		t.Fatal("verification record left behind")
+	}
+}
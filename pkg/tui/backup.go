@@ -2,10 +2,15 @@ package tui
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/crypt"
 	"bocker.software-services.dev/pkg/db"
 	"bocker.software-services.dev/pkg/docker"
 	"bocker.software-services.dev/pkg/logger"
@@ -17,10 +22,52 @@ func InitBackupTui(ctx context.Context, app *config.Application) error {
 	if err := app.Setup(); err != nil {
 		return err
 	}
+	engine, err := db.Lookup(app.Config.DB.Engine)
+	if err != nil {
+		return err
+	}
+	streamer, canStream := engine.(db.Streamer)
+	if app.Config.Stream && !canStream {
+		return fmt.Errorf("the %s engine cannot stream its dump; drop --stream", engine.Name())
+	}
+	if err := docker.CheckCompression(app); err != nil {
+		return err
+	}
+	if app.Config.Docker.Dedup && crypt.Enabled(app) {
+		// age encrypts every run with a fresh file key, so no chunk would
+		// ever match one stored before.
+		return errors.New("encrypted backups cannot be deduplicated; drop --dedup or the encryption flags")
+	}
+	if app.Config.DB.Format, err = db.ResolveMode(engine, app.Config.DB.Mode, app.Config.DB.Format); err != nil {
+		return err
+	}
+	if app.Config.DB.Format == db.FormatBaseBackup {
+		// A base backup covers the whole cluster, roles included.
+		switch {
+		case app.Config.Stream:
+			return errors.New("physical backups cannot be streamed; drop --stream")
+		case db.Selection(app):
+			return errors.New("physical backups cover the whole cluster; drop the schema and table options")
+		case app.Config.DB.ExportRoles:
+			return errors.New("physical backups already include the roles; drop --export-roles")
+		}
+	}
+	if err := db.CheckJobs(engine, app.Config.DB.Format, app.Config.DB.Jobs, false); err != nil {
+		return err
+	}
+	if err := db.CheckSelection(engine, app, false); err != nil {
+		return err
+	}
+	if app.Config.Stream && app.Config.DB.Format == db.FormatDirectory {
+		return fmt.Errorf("the %s format cannot be streamed; drop --stream", db.FormatDirectory)
+	}
+	app.Config.DB.Engine = engine.Name()
 	app.Config.Docker.Tag = app.Config.DB.DateTime
-	app.Config.Docker.ImagePath = fmt.Sprintf("%s/%s:%s", app.Config.Docker.Namespace, app.Config.Docker.Repository, app.Config.Docker.Tag)
-	app.Config.DB.BackupFileName = fmt.Sprintf("%s_%s_backup.psql", app.Config.DB.SourceName, app.Config.DB.DateTime)
-	app.Config.DB.RolesFileName = fmt.Sprintf("%s_%s_roles_backup.sql", app.Config.DB.SourceName, app.Config.DB.DateTime)
+	app.Config.Docker.ImagePath = docker.ImagePath(app)
+	// SQLite sources are file paths; name the backup after the file.
+	name := strings.TrimSuffix(filepath.Base(app.Config.DB.SourceName), filepath.Ext(app.Config.DB.SourceName))
+	app.Config.DB.BackupFileName = fmt.Sprintf("%s_%s_backup.%s", name, app.Config.DB.DateTime, db.FileExtension(engine, app.Config.DB.Format))
+	app.Config.DB.RolesFileName = fmt.Sprintf("%s_%s_roles_backup.sql", name, app.Config.DB.DateTime)
 
 	tmpDir, err := os.MkdirTemp("", "")
 	if err != nil {
@@ -31,11 +78,29 @@ func InitBackupTui(ctx context.Context, app *config.Application) error {
 	app.Config.TmpDir = tmpDir
 
 	var stages = []Stage{
+		{
+			Name: "Reading Server Version",
+			Action: func() error {
+				var err error
+				if app.Config.DB.ServerVersion, err = engine.ServerVersion(ctx, app); err != nil {
+					logger.LogCommand("failed to read server version")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				if app.Config.DB.DumpVersion, err = engine.DumpVersion(ctx, app); err != nil {
+					logger.LogCommand("failed to read dump tool version")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
 		{
 			Name: "Creating Backup",
 			Action: func() error {
-				if err := db.Dump(ctx, app); err != nil {
-					logger.LogCommand("pg_dump failed")
+				if err := engine.Dump(ctx, app); err != nil {
+					logger.LogCommand("dump failed")
 					logger.LogCommand(err.Error())
 					return err
 				}
@@ -49,7 +114,7 @@ func InitBackupTui(ctx context.Context, app *config.Application) error {
 				if !app.Config.DB.ExportRoles {
 					return nil
 				}
-				if err := db.ExportRoles(ctx, app); err != nil {
+				if err := engine.ExportRoles(ctx, app); err != nil {
 					logger.LogCommand("failed to export roles")
 					logger.LogCommand(err.Error())
 					return err
@@ -61,11 +126,40 @@ func InitBackupTui(ctx context.Context, app *config.Application) error {
 		{
 			Name: "Copy from Container",
 			Action: func() error {
-				if app.Config.Docker.ContainerID == "" {
+				if app.Config.Docker.ContainerID != "" {
+					if err := docker.CopyFrom(ctx, app); err != nil {
+						logger.LogCommand("failed to copy backup from container")
+						logger.LogCommand(err.Error())
+						return err
+					}
+				}
+				if app.Config.DB.Format == db.FormatBaseBackup {
+					// Recorded so prune knows which archived WAL the backup
+					// still needs.
+					var err error
+					app.Config.DB.WALStart, err = db.BaseBackupWALStart(filepath.Join(app.Config.TmpDir, app.Config.DB.BackupFileName))
+					if err != nil {
+						logger.LogCommand("failed to read the base backup's WAL start")
+						logger.LogCommand(err.Error())
+						return err
+					}
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Encrypting Backup",
+			Action: func() error {
+				if !crypt.Enabled(app) {
 					return nil
 				}
-				if err := docker.CopyFrom(ctx, app); err != nil {
-					logger.LogCommand("failed to copy backup from container")
+				files := []string{app.Config.DB.BackupFileName}
+				if app.Config.DB.ExportRoles {
+					files = append(files, app.Config.DB.RolesFileName)
+				}
+				if err := crypt.EncryptFiles(app, app.Config.TmpDir, files...); err != nil {
+					logger.LogCommand("failed to encrypt backup")
 					logger.LogCommand(err.Error())
 					return err
 				}
@@ -99,6 +193,30 @@ func InitBackupTui(ctx context.Context, app *config.Application) error {
 		},
 	}
 
+	if app.Config.Stream {
+		// Dump, encryption, packaging and upload all happen in one pass.
+		stages = []Stage{stages[0], {
+			Name: "Streaming Backup",
+			Action: func() error {
+				files := []docker.StreamFile{{Name: app.Config.DB.BackupFileName, Write: func(ctx context.Context, w io.Writer) error {
+					return streamer.DumpTo(ctx, app, w)
+				}}}
+				if app.Config.DB.ExportRoles {
+					files = append(files, docker.StreamFile{Name: app.Config.DB.RolesFileName, Write: func(ctx context.Context, w io.Writer) error {
+						return streamer.ExportRolesTo(ctx, app, w)
+					}})
+				}
+				if err := docker.PushStream(ctx, app, files); err != nil {
+					logger.LogCommand("failed to stream backup")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		}}
+	}
+
 	m := newModel(stages)
 
 	var opts []tea.ProgramOption
@@ -109,6 +227,8 @@ func InitBackupTui(ctx context.Context, app *config.Application) error {
 	if err != nil {
 		return fmt.Errorf("failed to run backup tui: %w", err)
 	}
-
+	if m.Error != nil {
+		return fmt.Errorf("backup of %s failed: %w", app.Config.DB.SourceName, m.Error)
+	}
 	return nil
 }
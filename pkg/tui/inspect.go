@@ -0,0 +1,176 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"bocker.software-services.dev/pkg/backup"
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/crypt"
+	"bocker.software-services.dev/pkg/db"
+	"bocker.software-services.dev/pkg/docker"
+	"bocker.software-services.dev/pkg/logger"
+	tea "charm.land/bubbletea/v2"
+	"github.com/mattn/go-isatty"
+)
+
+// InspectOptions configures InitInspectTui.
+type InspectOptions struct {
+	// Output is backup.OutputTree or backup.OutputJSON.
+	Output string
+	// Sizes measures the data of each table, which reads the whole backup.
+	Sizes bool
+	// WriteList saves the pg_restore --list output to this file, ready to
+	// be edited and passed to `restore --use-list`.
+	WriteList string
+}
+
+// InitInspectTui fetches the tagged backup and lists its contents with
+// pg_restore --list, without restoring anything. The contents are written to
+// w once all stages have finished.
+func InitInspectTui(ctx context.Context, app *config.Application, opts InspectOptions, w io.Writer) error {
+	if opts.Output != "" && opts.Output != backup.OutputTree && opts.Output != backup.OutputJSON {
+		return fmt.Errorf("unknown output format %q (want %s or %s)", opts.Output, backup.OutputTree, backup.OutputJSON)
+	}
+	if err := app.Setup(); err != nil {
+		return err
+	}
+	app.Config.Docker.ImagePath = docker.ImagePath(app)
+	app.Config.DB.ImportRoles = false
+	// Only pg_dump archives have a table of contents; Unpack rejects the
+	// other engines.
+	app.Config.DB.Engine = db.EnginePostgres
+
+	tmpDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return fmt.Errorf("create tmp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	app.Config.TmpDir = tmpDir
+
+	var list string
+	var entries []db.TOCEntry
+
+	var stages = []Stage{
+		{
+			Name: "Fetching backup from registry",
+			Action: func() error {
+				err := docker.Unpack(ctx, app)
+				if err == nil && app.Config.DB.Format == db.FormatBaseBackup {
+					err = fmt.Errorf("backup %s is a physical backup and has no table of contents", app.Config.Docker.Tag)
+				}
+				if err != nil {
+					logger.LogCommand("failed to fetch backup")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Decrypting Backup",
+			Action: func() error {
+				if app.Config.Encryption.Mode == "" {
+					return nil
+				}
+				ids, err := crypt.Identities(app)
+				if err == nil {
+					err = crypt.DecryptFiles(ids, app.Config.TmpDir, app.Config.DB.BackupFileName)
+				}
+				if err != nil {
+					logger.LogCommand("failed to decrypt backup")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Copy backup to container",
+			Action: func() error {
+				if app.Config.Docker.ContainerID == "" {
+					return nil
+				}
+				backupFile := filepath.Join(app.Config.TmpDir, app.Config.DB.BackupFileName)
+				if err := docker.CopyTo(ctx, app.Config.Docker.ContainerID, backupFile); err != nil {
+					logger.LogCommand("failed to copy backup to container")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Reading contents",
+			Action: func() error {
+				var err error
+				if list, err = db.ListTOC(ctx, app); err == nil {
+					entries, err = db.ParseTOC(list)
+				}
+				if err != nil {
+					logger.LogCommand("failed to list backup contents")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Measuring table data",
+			Action: func() error {
+				if !opts.Sizes {
+					return nil
+				}
+				sizes, err := db.DataSizes(ctx, app)
+				if err != nil {
+					logger.LogCommand("failed to measure table data")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				for i, e := range entries {
+					if e.Type == "TABLE DATA" {
+						entries[i].Size = sizes[e.Schema+"."+e.Name]
+					}
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+	}
+
+	m := newModel(stages)
+
+	var progOpts []tea.ProgramOption
+	if !isatty.IsTerminal(os.Stdout.Fd()) || opts.Output == backup.OutputJSON {
+		progOpts = []tea.ProgramOption{tea.WithoutRenderer(), tea.WithInput(nil)}
+	}
+	if _, err := tea.NewProgram(&m, progOpts...).Run(); err != nil {
+		return fmt.Errorf("failed to run inspect tui: %w", err)
+	}
+	if m.Error != nil {
+		return fmt.Errorf("inspecting %s failed: %w", app.Config.Docker.Tag, m.Error)
+	}
+
+	if opts.WriteList != "" {
+		if err := os.WriteFile(opts.WriteList, []byte(list), 0600); err != nil {
+			return fmt.Errorf("write list: %w", err)
+		}
+	}
+	format := app.Config.DB.Format
+	if format == "" {
+		format = db.FormatCustom
+	}
+	return backup.WriteContents(w, backup.Contents{
+		Tag:      app.Config.Docker.Tag,
+		Database: app.Config.DB.SourceName,
+		Format:   format,
+		Entries:  entries,
+	}, opts.Output)
+}
@@ -2,24 +2,56 @@ package tui
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"bocker.software-services.dev/pkg/backup"
 	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/crypt"
 	"bocker.software-services.dev/pkg/db"
 	"bocker.software-services.dev/pkg/docker"
 	"bocker.software-services.dev/pkg/logger"
 	tea "charm.land/bubbletea/v2"
 )
 
-func InitRestoreTui(ctx context.Context, app *config.Application) error {
+// InitRestoreTui restores the backup app names. Without a tag it lets the
+// user pick one of the backups pick selects first.
+func InitRestoreTui(ctx context.Context, app *config.Application, pick backup.ListOptions) error {
 	if err := app.Setup(); err != nil {
 		return err
 	}
-	app.Config.Docker.ImagePath = fmt.Sprintf("%s/%s:%s", app.Config.Docker.Namespace, app.Config.Docker.Repository, app.Config.Docker.Tag)
-	app.Config.DB.BackupFileName = fmt.Sprintf("%s_%s_backup.psql", app.Config.DB.SourceName, app.Config.Docker.Tag)
-	app.Config.DB.RolesFileName = fmt.Sprintf("%s_%s_roles_backup.sql", app.Config.DB.SourceName, app.Config.Docker.Tag)
+	if app.Config.DB.Engine != "" {
+		if _, err := db.Lookup(app.Config.DB.Engine); err != nil {
+			return err
+		}
+	}
+
+	physical := app.Config.DB.DataDir != "" || app.Config.Docker.Volume != ""
+	if physical {
+		switch {
+		case app.Config.DB.DataDir != "" && app.Config.Docker.Volume != "":
+			return errors.New("pass either --data-dir or --volume, not both")
+		case app.Config.Docker.ContainerID != "":
+			return errors.New("a physical restore lays out a data directory and runs no server; drop --container-id")
+		case app.Config.DB.ImportRoles || app.Config.DB.Jobs > 1 || db.Selection(app):
+			return errors.New("a physical restore brings back the whole cluster; drop --import-roles, --jobs and the schema and table options")
+		}
+	} else if !app.Config.DB.TargetTime.IsZero() {
+		return errors.New("--target-time needs a physical backup restored with --data-dir or --volume")
+	}
+
+	if app.Config.Docker.Tag == "" {
+		tag, err := backup.Pick(ctx, app, pick)
+		if err != nil {
+			return err
+		}
+		app.Config.Docker.Tag = tag
+	}
+	app.Config.Docker.ImagePath = docker.ImagePath(app)
 
 	tmpDir, err := os.MkdirTemp("", "")
 	if err != nil {
@@ -28,12 +60,32 @@ func InitRestoreTui(ctx context.Context, app *config.Application) error {
 	defer os.RemoveAll(tmpDir)
 	app.Config.TmpDir = tmpDir
 
+	if physical {
+		return restorePhysical(ctx, app)
+	}
+
+	// The engine comes from the backup's metadata, so it is only known once
+	// the first stage has fetched it.
+	var engine db.Engine
 	var stages = []Stage{
 		{
-			Name: "Pull Backup Image",
+			Name: "Fetching backup from registry",
 			Action: func() error {
-				if err := docker.Pull(ctx, app); err != nil {
-					logger.LogCommand("docker pull failed")
+				err := docker.Unpack(ctx, app)
+				if err == nil && app.Config.DB.Format == db.FormatBaseBackup {
+					err = fmt.Errorf("backup %s is a physical backup; restore it with --data-dir or --volume", app.Config.Docker.Tag)
+				}
+				if err == nil {
+					engine, err = db.Lookup(app.Config.DB.Engine)
+				}
+				if err == nil {
+					err = db.CheckJobs(engine, app.Config.DB.Format, app.Config.DB.Jobs, true)
+				}
+				if err == nil {
+					err = db.CheckSelection(engine, app, true)
+				}
+				if err != nil {
+					logger.LogCommand("failed to fetch backup")
 					logger.LogCommand(err.Error())
 					return err
 				}
@@ -42,10 +94,21 @@ func InitRestoreTui(ctx context.Context, app *config.Application) error {
 			IsCompleteFunc: func() bool { return false },
 		},
 		{
-			Name: "Extracting backup from image",
+			Name: "Decrypting Backup",
 			Action: func() error {
-				if err := docker.Unpack(ctx, app); err != nil {
-					logger.LogCommand("failed to extract backup")
+				if app.Config.Encryption.Mode == "" {
+					return nil
+				}
+				ids, err := crypt.Identities(app)
+				if err == nil {
+					files := []string{app.Config.DB.BackupFileName}
+					if app.Config.DB.ImportRoles {
+						files = append(files, app.Config.DB.RolesFileName)
+					}
+					err = crypt.DecryptFiles(ids, app.Config.TmpDir, files...)
+				}
+				if err != nil {
+					logger.LogCommand("failed to decrypt backup")
 					logger.LogCommand(err.Error())
 					return err
 				}
@@ -56,7 +119,7 @@ func InitRestoreTui(ctx context.Context, app *config.Application) error {
 		{
 			Name: "Creating Database",
 			Action: func() error {
-				if err := db.CreateDB(ctx, app); err != nil {
+				if err := engine.CreateDB(ctx, app); err != nil {
 					logger.LogCommand("failed to create database")
 					logger.LogCommand(err.Error())
 					return err
@@ -77,6 +140,14 @@ func InitRestoreTui(ctx context.Context, app *config.Application) error {
 					logger.LogCommand(err.Error())
 					return err
 				}
+				if app.Config.DB.UseList == "" {
+					return nil
+				}
+				if err := docker.CopyTo(ctx, app.Config.Docker.ContainerID, app.Config.DB.UseList); err != nil {
+					logger.LogCommand("failed to copy list file to container")
+					logger.LogCommand(err.Error())
+					return err
+				}
 				return nil
 			},
 			IsCompleteFunc: func() bool { return false },
@@ -100,7 +171,7 @@ func InitRestoreTui(ctx context.Context, app *config.Application) error {
 		{
 			Name: "Restoring Database",
 			Action: func() error {
-				if err := db.Restore(ctx, app); err != nil {
+				if err := engine.Restore(ctx, app); err != nil {
 					logger.LogCommand("failed to restore database")
 					logger.LogCommand(err.Error())
 					return err
@@ -115,5 +186,134 @@ func InitRestoreTui(ctx context.Context, app *config.Application) error {
 	if _, err := tea.NewProgram(&m).Run(); err != nil {
 		return fmt.Errorf("failed to run restore tui: %w", err)
 	}
+	if m.Error != nil {
+		return fmt.Errorf("restoring %s failed: %w", app.Config.Docker.Tag, m.Error)
+	}
+	return nil
+}
+
+// restorePhysical lays out a base backup as a data directory, in DataDir or
+// in the Docker volume Volume, for a server of the backup's major version to
+// start on.
+func restorePhysical(ctx context.Context, app *config.Application) error {
+	var image string
+	var stages = []Stage{
+		{
+			Name: "Fetching backup from registry",
+			Action: func() error {
+				err := docker.Unpack(ctx, app)
+				if err == nil && app.Config.DB.Format != db.FormatBaseBackup {
+					err = fmt.Errorf("backup %s is a logical dump; restore it with --db-target", app.Config.Docker.Tag)
+				}
+				if err == nil && !app.Config.DB.TargetTime.IsZero() {
+					// The tag is the time the backup started; WAL replay can
+					// only move forward from there.
+					at, perr := time.ParseInLocation(config.DateTimeFormat, app.Config.Docker.Tag, time.Local)
+					if perr == nil && app.Config.DB.TargetTime.Before(at) {
+						err = fmt.Errorf("--target-time %s is before backup %s was taken", app.Config.DB.TargetTime.Format(time.RFC3339), app.Config.Docker.Tag)
+					}
+				}
+				if err == nil {
+					// Physical backups only start on the major version they
+					// were taken from.
+					if image = docker.PostgresImage(app.Config.DB.ServerVersion, ""); image == "" {
+						err = fmt.Errorf("backup %s records no server version", app.Config.Docker.Tag)
+					}
+				}
+				if err != nil {
+					logger.LogCommand("failed to fetch backup")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Decrypting Backup",
+			Action: func() error {
+				if app.Config.Encryption.Mode == "" {
+					return nil
+				}
+				ids, err := crypt.Identities(app)
+				if err == nil {
+					err = crypt.DecryptFiles(ids, app.Config.TmpDir, app.Config.DB.BackupFileName)
+				}
+				if err != nil {
+					logger.LogCommand("failed to decrypt backup")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Laying out data directory",
+			Action: func() error {
+				backupFile := filepath.Join(app.Config.TmpDir, app.Config.DB.BackupFileName)
+				var recovery string
+				if !app.Config.DB.TargetTime.IsZero() {
+					recovery = db.RecoverySettings(walFetchCommand(app), app.Config.DB.TargetTime)
+				}
+				var err error
+				if app.Config.Docker.Volume != "" {
+					err = docker.RestoreVolume(ctx, image, app.Config.Docker.Volume, backupFile, recovery)
+				} else {
+					err = db.LayoutDataDir(backupFile, app.Config.DB.DataDir)
+					if err == nil && recovery != "" {
+						err = db.WriteRecovery(app.Config.DB.DataDir, recovery)
+					}
+				}
+				if err != nil {
+					logger.LogCommand("failed to lay out data directory")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+	}
+
+	m := newModel(stages)
+	if _, err := tea.NewProgram(&m).Run(); err != nil {
+		return fmt.Errorf("failed to run restore tui: %w", err)
+	}
+	if m.Error != nil {
+		return fmt.Errorf("restoring %s failed: %w", app.Config.Docker.Tag, m.Error)
+	}
+	target := app.Config.DB.DataDir
+	if app.Config.Docker.Volume != "" {
+		target = "volume " + app.Config.Docker.Volume
+	}
+	fmt.Printf("Data directory ready in %s; start it with %s (server %s).\n", target, image, app.Config.DB.ServerVersion)
+	if !app.Config.DB.TargetTime.IsZero() {
+		fmt.Printf("On start it replays WAL up to %s with `bocker wal-fetch`, which must be installed and able to reach the registry there.\n", app.Config.DB.TargetTime.Format(time.RFC3339))
+	}
 	return nil
 }
+
+// walFetchCommand is the restore_command fetching WAL from the repository the
+// backup was restored from.
+func walFetchCommand(app *config.Application) string {
+	args := []string{
+		"bocker", "wal-fetch",
+		"--registry", app.Config.Docker.Registry,
+		"--namespace", app.Config.Docker.Namespace,
+		"--repository", app.Config.Docker.Repository,
+	}
+	if id := app.Config.Encryption.IdentityFile; id != "" {
+		// The server runs the command from its data directory.
+		if abs, err := filepath.Abs(id); err == nil {
+			id = abs
+		}
+		args = append(args, "--identity", id)
+	}
+	for i, a := range args {
+		if strings.Trim(a, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:") != "" {
+			args[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(args, " ") + " %f %p"
+}
@@ -0,0 +1,279 @@
+package tui
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bocker.software-services.dev/pkg/config"
+	"bocker.software-services.dev/pkg/crypt"
+	"bocker.software-services.dev/pkg/db"
+	"bocker.software-services.dev/pkg/docker"
+	"bocker.software-services.dev/pkg/logger"
+	tea "charm.land/bubbletea/v2"
+	"github.com/mattn/go-isatty"
+)
+
+// verifyDatabase is the database the backup is restored into inside the
+// throwaway container.
+const verifyDatabase = "bocker_verify"
+
+// defaultChecks run when the user supplies no sanity queries of their own.
+var defaultChecks = []string{
+	`SELECT count(*) || ' tables' FROM information_schema.tables WHERE table_schema NOT IN ('pg_catalog', 'information_schema')`,
+	`SELECT coalesce(sum(n_live_tup), 0) || ' rows' FROM pg_stat_user_tables`,
+}
+
+// VerifyOptions configures InitVerifyTui.
+type VerifyOptions struct {
+	// Image overrides the postgres image; by default it is derived from the
+	// server version recorded in the backup.
+	Image string
+	// Queries are sanity checks; each must succeed for the backup to pass.
+	Queries []string
+	// SQLFile is run after the queries, stopping at the first error.
+	SQLFile string
+	// Record pushes a verification record for the tag when all checks pass.
+	Record bool
+}
+
+// CheckResult is the outcome of one sanity check.
+type CheckResult struct {
+	Check  string
+	Output string
+}
+
+// InitVerifyTui restores the tagged backup into a disposable postgres
+// container, runs the sanity checks and tears the container down again. The
+// check results are written to w once all stages have finished.
+func InitVerifyTui(ctx context.Context, app *config.Application, opts VerifyOptions, w io.Writer) error {
+	if err := app.Setup(); err != nil {
+		return err
+	}
+	app.Config.Docker.ImagePath = docker.ImagePath(app)
+	app.Config.DB.TargetName = verifyDatabase
+	app.Config.DB.Owner = "postgres"
+	app.Config.DB.Host = "127.0.0.1"
+	app.Config.DB.ImportRoles = false
+	// Any error pg_restore reports fails the verification.
+	app.Config.DB.ExitOnError = true
+	// Only PostgreSQL backups can be verified; Unpack rejects the others.
+	app.Config.DB.Engine = db.EnginePostgres
+	pg := db.Postgres{}
+
+	tmpDir, err := os.MkdirTemp("", "")
+	if err != nil {
+		return fmt.Errorf("create tmp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	app.Config.TmpDir = tmpDir
+
+	// The container must go away even when Ctrl+C cancelled ctx.
+	defer func() {
+		if app.Config.Docker.ContainerID == "" {
+			return
+		}
+		if err := docker.RemoveContainer(context.WithoutCancel(ctx), app.Config.Docker.ContainerID); err != nil {
+			logger.LogCommand(fmt.Sprintf("failed to remove verification container %s: %v", app.Config.Docker.ContainerID, err))
+		}
+	}()
+
+	queries := opts.Queries
+	if len(queries) == 0 && opts.SQLFile == "" {
+		queries = defaultChecks
+	}
+	var results []CheckResult
+
+	var stages = []Stage{
+		{
+			Name: "Fetching backup from registry",
+			Action: func() error {
+				err := docker.Unpack(ctx, app)
+				if err == nil && app.Config.DB.Format == db.FormatBaseBackup {
+					err = fmt.Errorf("backup %s is a physical backup, which verify does not support", app.Config.Docker.Tag)
+				}
+				if err != nil {
+					logger.LogCommand("failed to fetch backup")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				// Unpack brings the roles file along when the backup has
+				// one; replay it so object owners exist in the fresh server.
+				_, err = os.Stat(filepath.Join(app.Config.TmpDir, app.Config.DB.RolesFileName))
+				app.Config.DB.ImportRoles = app.Config.DB.RolesFileName != "" && err == nil
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Decrypting Backup",
+			Action: func() error {
+				if app.Config.Encryption.Mode == "" {
+					return nil
+				}
+				ids, err := crypt.Identities(app)
+				if err == nil {
+					files := []string{app.Config.DB.BackupFileName}
+					if app.Config.DB.ImportRoles {
+						files = append(files, app.Config.DB.RolesFileName)
+					}
+					err = crypt.DecryptFiles(ids, app.Config.TmpDir, files...)
+				}
+				if err != nil {
+					logger.LogCommand("failed to decrypt backup")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Starting PostgreSQL container",
+			Action: func() error {
+				ref := opts.Image
+				if ref == "" {
+					ref = docker.PostgresImage(app.Config.DB.ServerVersion, "postgres:latest")
+				}
+				logger.LogCommand("starting " + ref)
+				id, err := docker.StartPostgres(ctx, ref)
+				if err != nil {
+					logger.LogCommand("failed to start postgres container")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				app.Config.Docker.ContainerID = id
+
+				waitCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+				defer cancel()
+				if err := db.WaitReady(waitCtx, app); err != nil {
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Copy backup to container",
+			Action: func() error {
+				files := []string{app.Config.DB.BackupFileName}
+				if app.Config.DB.ImportRoles {
+					files = append(files, app.Config.DB.RolesFileName)
+				}
+				for _, f := range files {
+					if err := docker.CopyTo(ctx, app.Config.Docker.ContainerID, filepath.Join(app.Config.TmpDir, f)); err != nil {
+						logger.LogCommand("failed to copy backup to container")
+						logger.LogCommand(err.Error())
+						return err
+					}
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Creating Database",
+			Action: func() error {
+				if app.Config.DB.ImportRoles {
+					if err := db.ApplyRoles(ctx, app); err != nil {
+						logger.LogCommand("failed to import roles")
+						logger.LogCommand(err.Error())
+						return err
+					}
+				}
+				if err := pg.CreateDB(ctx, app); err != nil {
+					logger.LogCommand("failed to create database")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Restoring Database",
+			Action: func() error {
+				if err := pg.Restore(ctx, app); err != nil {
+					logger.LogCommand("failed to restore database")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Running sanity checks",
+			Action: func() error {
+				// Fresh statistics so the default row count is meaningful.
+				if _, err := db.Query(ctx, app, "ANALYZE"); err != nil {
+					logger.LogCommand(err.Error())
+					return err
+				}
+				for _, q := range queries {
+					out, err := db.Query(ctx, app, q)
+					if err != nil {
+						logger.LogCommand("sanity query failed: " + q)
+						logger.LogCommand(err.Error())
+						return err
+					}
+					results = append(results, CheckResult{Check: q, Output: out})
+				}
+				if opts.SQLFile == "" {
+					return nil
+				}
+				if err := docker.CopyTo(ctx, app.Config.Docker.ContainerID, opts.SQLFile); err != nil {
+					logger.LogCommand(err.Error())
+					return err
+				}
+				out, err := db.RunFile(ctx, app, filepath.Join("/var/tmp", filepath.Base(opts.SQLFile)))
+				if err != nil {
+					logger.LogCommand("sanity file failed: " + opts.SQLFile)
+					logger.LogCommand(err.Error())
+					return err
+				}
+				results = append(results, CheckResult{Check: opts.SQLFile, Output: out})
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+		{
+			Name: "Recording result",
+			Action: func() error {
+				if !opts.Record {
+					return nil
+				}
+				if err := docker.MarkVerified(ctx, app, time.Now()); err != nil {
+					logger.LogCommand("failed to record verification")
+					logger.LogCommand(err.Error())
+					return err
+				}
+				return nil
+			},
+			IsCompleteFunc: func() bool { return false },
+		},
+	}
+
+	m := newModel(stages)
+
+	var progOpts []tea.ProgramOption
+	if !isatty.IsTerminal(os.Stdout.Fd()) {
+		progOpts = []tea.ProgramOption{tea.WithoutRenderer(), tea.WithInput(nil)}
+	}
+	if _, err := tea.NewProgram(&m, progOpts...).Run(); err != nil {
+		return fmt.Errorf("failed to run verify tui: %w", err)
+	}
+	if m.Error != nil {
+		return fmt.Errorf("verification of %s failed: %w", app.Config.Docker.Tag, m.Error)
+	}
+
+	fmt.Fprintf(w, "Backup %s restored successfully.\n", app.Config.Docker.Tag)
+	for _, r := range results {
+		fmt.Fprintf(w, "  %s\n    %s\n", r.Check, r.Output)
+	}
+	return nil
+}